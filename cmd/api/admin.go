@@ -0,0 +1,677 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"net/http"
+	"simple-ledger.itmo.ru/internal/data"
+	"simple-ledger.itmo.ru/internal/ratelimit"
+	"time"
+)
+
+func (app *application) migrateUserHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	var input struct {
+		FromUserId string `json:"from_user_id"`
+		ToUserId   string `json:"to_user_id"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		return NewBadRequestError(err)
+	}
+
+	fromId, fromErr := uuid.Parse(input.FromUserId)
+	toId, toErr := uuid.Parse(input.ToUserId)
+
+	v := app.newValidator(r)
+	v.CheckMsg(fromErr == nil, "from_user_id", "must_be_uuid", nil)
+	v.CheckMsg(toErr == nil, "to_user_id", "must_be_uuid", nil)
+	v.CheckMsg(fromId != toId, "to_user_id", "must_differ_from", "from_user_id")
+	if !v.Valid() {
+		return NewValidationError(v.Errors)
+	}
+
+	migrated, err := app.models.Transactions.MigrateUserID(r.Context(), fromId, toId)
+	if err != nil {
+		return NewInternalError(err)
+	}
+
+	response := map[string]any{
+		"from_user_id":          fromId,
+		"to_user_id":            toId,
+		"migrated_transactions": migrated,
+	}
+
+	if err = app.writeJSON(w, r, http.StatusOK, response, nil); err != nil {
+		return NewInternalError(err)
+	}
+
+	return nil
+}
+
+const maxReassignTransactions = 50
+
+func (app *application) reassignTransactionsHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	var input struct {
+		FromUserId     string   `json:"from_user_id"`
+		ToUserId       string   `json:"to_user_id"`
+		TransactionIds []string `json:"transaction_ids"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		return NewBadRequestError(err)
+	}
+
+	fromId, fromErr := uuid.Parse(input.FromUserId)
+	toId, toErr := uuid.Parse(input.ToUserId)
+
+	v := app.newValidator(r)
+	v.CheckMsg(fromErr == nil, "from_user_id", "must_be_uuid", nil)
+	v.CheckMsg(toErr == nil, "to_user_id", "must_be_uuid", nil)
+	v.CheckMsg(fromId != toId, "to_user_id", "must_differ_from", "from_user_id")
+	v.CheckMsg(len(input.TransactionIds) > 0, "transaction_ids", "must_contain_at_least_one", "id")
+	v.CheckMsg(len(input.TransactionIds) <= maxReassignTransactions, "transaction_ids", "must_not_contain_more_than", map[string]any{"max": maxReassignTransactions, "noun": "ids"})
+
+	ids := make([]uuid.UUID, len(input.TransactionIds))
+	for i, s := range input.TransactionIds {
+		id, err := uuid.Parse(s)
+		v.CheckMsg(err == nil, "transaction_ids", "must_only_contain_uuids", nil)
+		ids[i] = id
+	}
+	if !v.Valid() {
+		return NewValidationError(v.Errors)
+	}
+
+	reassigned, err := app.models.Transactions.ReassignTransactions(r.Context(), fromId, toId, ids)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return NewNotFoundError()
+		}
+		return NewInternalError(err)
+	}
+
+	response := map[string]any{
+		"from_user_id":            fromId,
+		"to_user_id":              toId,
+		"reassigned_transactions": reassigned,
+	}
+
+	if err = app.writeJSON(w, r, http.StatusOK, response, nil); err != nil {
+		return NewInternalError(err)
+	}
+
+	return nil
+}
+
+func (app *application) expireCategoryHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	category := r.PathValue("category")
+
+	var input struct {
+		Reason string `json:"reason"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		return NewBadRequestError(err)
+	}
+
+	v := app.newValidator(r)
+	data.ValidateCategory(v, category)
+	v.CheckMsg(input.Reason != "", "reason", "must_be_provided", nil)
+	if !v.Valid() {
+		return NewValidationError(v.Errors)
+	}
+
+	expired, err := app.models.Transactions.ExpireByCategory(r.Context(), category, input.Reason)
+	if err != nil {
+		return NewInternalError(err)
+	}
+
+	app.logger.Info("category expired", "category", category, "reason", input.Reason, "grants", expired)
+
+	response := map[string]any{
+		"category":       category,
+		"expired_grants": expired,
+	}
+
+	if err = app.writeJSON(w, r, http.StatusOK, response, nil); err != nil {
+		return NewInternalError(err)
+	}
+
+	return nil
+}
+
+// maxCancelRange keeps a mistyped range from cancelling a large part of the ledger
+const maxCancelRange = 7 * 24 * time.Hour
+
+func (app *application) cancelDateRangeHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	var input struct {
+		From   time.Time `json:"from"`
+		To     time.Time `json:"to"`
+		Reason string    `json:"reason"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		return NewBadRequestError(err)
+	}
+
+	v := app.newValidator(r)
+	v.CheckMsg(!input.From.IsZero(), "from", "must_be_provided", nil)
+	v.CheckMsg(!input.To.IsZero(), "to", "must_be_provided", nil)
+	v.CheckMsg(!input.To.Before(input.From), "to", "must_not_be_before", "from")
+	v.CheckMsg(input.To.Sub(input.From) <= maxCancelRange, "to", "must_be_at_most_days_after", map[string]any{"days": 7, "field": "from"})
+	v.CheckMsg(input.Reason != "", "reason", "must_be_provided", nil)
+	if !v.Valid() {
+		return NewValidationError(v.Errors)
+	}
+
+	cancelled, err := app.models.Transactions.CancelByDateRange(r.Context(), input.From, input.To, input.Reason)
+	if err != nil {
+		return NewInternalError(err)
+	}
+
+	app.logger.Info("grants cancelled", "from", input.From, "to", input.To, "reason", input.Reason, "grants", cancelled)
+
+	response := map[string]any{
+		"from":             input.From,
+		"to":               input.To,
+		"cancelled_grants": cancelled,
+	}
+
+	if err = app.writeJSON(w, r, http.StatusOK, response, nil); err != nil {
+		return NewInternalError(err)
+	}
+
+	return nil
+}
+
+func (app *application) expireAllHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		return NewNotFoundError()
+	}
+
+	expired, forfeited, err := app.models.Transactions.ExpireAllForUser(r.Context(), id)
+	if err != nil {
+		return NewInternalError(err)
+	}
+
+	response := map[string]any{
+		"user_id":          id,
+		"expired_rows":     expired,
+		"points_forfeited": forfeited,
+	}
+
+	if err = app.writeJSON(w, r, http.StatusOK, response, nil); err != nil {
+		return NewInternalError(err)
+	}
+
+	return nil
+}
+
+func (app *application) showLeaderboardHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	v := app.newValidator(r)
+	limit := app.readInt(r.URL.Query(), "limit", 10, v)
+	v.CheckMsg(limit > 0, "limit", "must_be_greater_than_zero", nil)
+	v.CheckMsg(limit <= 100, "limit", "must_be_maximum", 100)
+	if !v.Valid() {
+		return NewValidationError(v.Errors)
+	}
+
+	entries, ok := app.leaderboard.Get(limit)
+	if !ok {
+		var err error
+		entries, err = app.models.Transactions.GetLeaderboard(r.Context(), limit)
+		if err != nil {
+			return NewInternalError(err)
+		}
+		app.leaderboard.Set(limit, entries)
+	}
+
+	err := app.writeAmountsJSON(w, r, http.StatusOK, map[string]any{"leaderboard": entries}, nil)
+	if err != nil {
+		return NewInternalError(err)
+	}
+
+	return nil
+}
+
+func (app *application) listExpiringUsersHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	qs := r.URL.Query()
+	v := app.newValidator(r)
+
+	withinDays := app.readInt(qs, "within_days", 7, v)
+	minAmount := app.readInt(qs, "min_amount", 1, v)
+	limit := app.readInt(qs, "limit", 100, v)
+
+	v.CheckMsg(withinDays > 0, "within_days", "must_be_greater_than_zero", nil)
+	v.CheckMsg(withinDays <= 365, "within_days", "must_be_maximum", 365)
+	v.CheckMsg(minAmount > 0, "min_amount", "must_be_greater_than_zero", nil)
+	v.CheckMsg(limit > 0, "limit", "must_be_greater_than_zero", nil)
+	v.CheckMsg(limit <= 1000, "limit", "must_be_maximum", 1000)
+	if !v.Valid() {
+		return NewValidationError(v.Errors)
+	}
+
+	users, err := app.models.Transactions.GetUsersWithExpiringBalance(r.Context(), withinDays, minAmount, limit)
+	if err != nil {
+		return NewInternalError(err)
+	}
+
+	if err = app.writeAmountsJSON(w, r, http.StatusOK, map[string]any{"users": users}, nil); err != nil {
+		return NewInternalError(err)
+	}
+
+	return nil
+}
+
+func (app *application) showTopSpendersHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	qs := r.URL.Query()
+	v := app.newValidator(r)
+
+	limit := app.readInt(qs, "limit", 20, v)
+	since := app.readDate(qs, "since", v)
+
+	v.CheckMsg(limit > 0, "limit", "must_be_greater_than_zero", nil)
+	v.CheckMsg(limit <= 100, "limit", "must_be_maximum", 100)
+	v.CheckMsg(!since.After(time.Now()), "since", "must_not_be_in_future", nil)
+	if !v.Valid() {
+		return NewValidationError(v.Errors)
+	}
+
+	entries, err := app.models.Transactions.GetTopSpenders(r.Context(), limit, since)
+	if err != nil {
+		return NewInternalError(err)
+	}
+
+	if err = app.writeJSON(w, r, http.StatusOK, map[string]any{"top_spenders": entries}, nil); err != nil {
+		return NewInternalError(err)
+	}
+
+	return nil
+}
+
+func (app *application) listTransactionsHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	qs := r.URL.Query()
+	v := app.newValidator(r)
+
+	tag := qs.Get("tag")
+	page := data.Pagination{
+		Page:     app.readInt(qs, "page", 1, v),
+		PageSize: app.readInt(qs, "page_size", 20, v),
+	}
+
+	v.CheckMsg(tag != "", "tag", "must_be_provided", nil)
+	data.ValidatePagination(v, page)
+	if !v.Valid() {
+		return NewValidationError(v.Errors)
+	}
+
+	transactions, metadata, err := app.models.Transactions.ListByTag(r.Context(), tag, page)
+	if err != nil {
+		return NewInternalError(err)
+	}
+
+	response := map[string]any{
+		"transactions": transactions,
+		"metadata":     metadata,
+	}
+
+	if err = app.writeAmountsJSON(w, r, http.StatusOK, response, nil); err != nil {
+		return NewInternalError(err)
+	}
+
+	return nil
+}
+
+// listExpiredTransactionsHandler reports forfeited points, grants that
+// expired between from and to (both inclusive) without being fully spent
+func (app *application) listExpiredTransactionsHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	qs := r.URL.Query()
+	v := app.newValidator(r)
+
+	from := app.readDate(qs, "from", v)
+	to := app.readDate(qs, "to", v)
+	minAmount := app.readInt(qs, "min_amount", 1, v)
+
+	v.CheckMsg(qs.Get("from") != "", "from", "must_be_provided", nil)
+	v.CheckMsg(qs.Get("to") != "", "to", "must_be_provided", nil)
+	v.CheckMsg(!to.Before(from), "to", "must_not_be_before", "from")
+	v.CheckMsg(minAmount > 0, "min_amount", "must_be_greater_than_zero", nil)
+	if !v.Valid() {
+		return NewValidationError(v.Errors)
+	}
+
+	transactions, err := app.models.Transactions.ListExpiredWithRemainder(r.Context(), from, to.AddDate(0, 0, 1), minAmount)
+	if err != nil {
+		return NewInternalError(err)
+	}
+
+	totalForfeited := 0
+	for _, transaction := range transactions {
+		totalForfeited += transaction.RemainingAmount
+	}
+
+	response := map[string]any{
+		"transactions":    transactions,
+		"total_forfeited": totalForfeited,
+	}
+
+	if err = app.writeAmountsJSON(w, r, http.StatusOK, response, nil); err != nil {
+		return NewInternalError(err)
+	}
+
+	return nil
+}
+
+func (app *application) showTagSummaryHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	summaries, err := app.models.Transactions.GetTagSummary(r.Context())
+	if err != nil {
+		return NewInternalError(err)
+	}
+
+	if err = app.writeJSON(w, r, http.StatusOK, map[string]any{"tags": summaries}, nil); err != nil {
+		return NewInternalError(err)
+	}
+
+	return nil
+}
+
+func (app *application) showExpiryForecastHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	v := app.newValidator(r)
+	weeks := app.readInt(r.URL.Query(), "weeks", 4, v)
+	v.CheckMsg(weeks > 0, "weeks", "must_be_greater_than_zero", nil)
+	v.CheckMsg(weeks <= 52, "weeks", "must_be_maximum", 52)
+	if !v.Valid() {
+		return NewValidationError(v.Errors)
+	}
+
+	batches, err := app.models.Transactions.GetWeeklyExpiryBatches(r.Context(), weeks)
+	if err != nil {
+		return NewInternalError(err)
+	}
+
+	if err = app.writeAmountsJSON(w, r, http.StatusOK, map[string]any{"expiry_forecast": batches}, nil); err != nil {
+		return NewInternalError(err)
+	}
+
+	return nil
+}
+
+// impersonate serves fn, a user facing handler, to a support agent and
+// leaves an audit trail of the access
+func (app *application) impersonate(fn handlerFunc) handlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) *AppError {
+		app.logger.Warn("user impersonation",
+			"admin_key_id", adminKeyID(r),
+			"user_id", r.PathValue("id"),
+			"uri", r.URL.RequestURI(),
+		)
+		return fn(w, r)
+	}
+}
+
+func (app *application) showReportSummaryHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	qs := r.URL.Query()
+	v := app.newValidator(r)
+
+	from := app.readDate(qs, "from", v)
+	to := app.readDate(qs, "to", v)
+	granularity := qs.Get("granularity")
+	if granularity == "" {
+		granularity = "day"
+	}
+
+	v.CheckMsg(qs.Get("from") != "", "from", "must_be_provided", nil)
+	v.CheckMsg(qs.Get("to") != "", "to", "must_be_provided", nil)
+	v.CheckMsg(!to.Before(from), "to", "must_not_be_before", "from")
+	v.CheckMsg(data.ValidGranularity(granularity), "granularity", "must_be_granularity", nil)
+	if !v.Valid() {
+		return NewValidationError(v.Errors)
+	}
+
+	sums, err := app.models.Transactions.SumByDateRange(r.Context(), from, to.AddDate(0, 0, 1), granularity)
+	if err != nil {
+		return NewInternalError(err)
+	}
+
+	if err = app.writeAmountsJSON(w, r, http.StatusOK, map[string]any{"summary": sums}, nil); err != nil {
+		return NewInternalError(err)
+	}
+
+	return nil
+}
+
+func (app *application) listActiveTransactionsHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		return NewNotFoundError()
+	}
+
+	transactions, err := app.models.Transactions.GetActiveTransactions(r.Context(), id)
+	if err != nil {
+		return NewInternalError(err)
+	}
+
+	response := map[string]any{
+		"user_id":      id,
+		"transactions": transactions,
+	}
+
+	if err = app.writeAmountsJSON(w, r, http.StatusOK, response, nil); err != nil {
+		return NewInternalError(err)
+	}
+
+	return nil
+}
+
+func (app *application) showAuditLogHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		return NewNotFoundError()
+	}
+
+	entries, err := app.models.Transactions.GetAuditLog(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return NewNotFoundError()
+		}
+		return NewInternalError(err)
+	}
+
+	response := map[string]any{
+		"transaction_id": id,
+		"audit_log":      entries,
+	}
+
+	if err = app.writeAmountsJSON(w, r, http.StatusOK, response, nil); err != nil {
+		return NewInternalError(err)
+	}
+
+	return nil
+}
+
+func (app *application) createAPIKeyHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	id, _, err := app.readUserIDParam(r)
+	if err != nil {
+		return NewNotFoundError()
+	}
+
+	var input struct {
+		Scopes []string `json:"scopes"`
+	}
+	if err = app.readJSON(w, r, &input); err != nil {
+		return NewBadRequestError(err)
+	}
+
+	v := app.newValidator(r)
+	data.ValidateScopes(v, input.Scopes)
+	if !v.Valid() {
+		return NewValidationError(v.Errors)
+	}
+
+	key, err := app.models.ApiKeys.Create(r.Context(), id, input.Scopes)
+	if err != nil {
+		return NewInternalError(err)
+	}
+
+	response := map[string]any{
+		"user_id": id,
+		"api_key": key,
+		"scopes":  input.Scopes,
+	}
+
+	if err = app.writeJSON(w, r, http.StatusCreated, response, nil); err != nil {
+		return NewInternalError(err)
+	}
+
+	return nil
+}
+
+func (app *application) showGiniHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	coefficient, err := app.models.Transactions.ComputeGiniCoefficient(r.Context())
+	if err != nil {
+		return NewInternalError(err)
+	}
+
+	if err = app.writeJSON(w, r, http.StatusOK, map[string]any{"gini": coefficient}, nil); err != nil {
+		return NewInternalError(err)
+	}
+
+	return nil
+}
+
+const maxBulkWithdrawals = 100
+
+type bulkWithdrawalOut struct {
+	UserId        uuid.UUID  `json:"user_id"`
+	Amount        int        `json:"amount"`
+	TransactionId *uuid.UUID `json:"transaction_id,omitempty"`
+	Error         string     `json:"error,omitempty"`
+}
+
+// bulkWithdrawalError is the error code reported for a failed withdrawal
+// in a bulk withdrawal, the codes match the single withdrawal errors
+func bulkWithdrawalError(err error) string {
+	switch {
+	case errors.Is(err, data.ErrDailyWithdrawalLimitExceeded):
+		return "daily_withdrawal_limit_exceeded"
+	case errors.Is(err, data.ErrLockTimeout):
+		return "lock_timeout"
+	default:
+		return "insufficient_funds"
+	}
+}
+
+// bulkWithdrawalsHandler settles withdrawals of several users at once with
+// the settings of single withdrawals. Users whose withdrawal is rejected or
+// whose account is frozen fail without affecting the rest.
+func (app *application) bulkWithdrawalsHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	var input struct {
+		Withdrawals []struct {
+			UserId string `json:"user_id"`
+			Amount int    `json:"amount"`
+		} `json:"withdrawals"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		return NewBadRequestError(err)
+	}
+
+	v := app.newValidator(r)
+	v.CheckMsg(len(input.Withdrawals) > 0, "withdrawals", "must_contain_at_least_one", "withdrawal")
+	v.CheckMsg(len(input.Withdrawals) <= maxBulkWithdrawals, "withdrawals", "must_not_contain_more_than", map[string]any{"max": maxBulkWithdrawals, "noun": "withdrawals"})
+
+	ids := make([]uuid.UUID, len(input.Withdrawals))
+	for i, in := range input.Withdrawals {
+		id, _, err := app.parseUserID(in.UserId)
+		app.checkUserIDField(v, err == nil, fmt.Sprintf("withdrawals[%d].user_id", i))
+		v.CheckMsg(in.Amount > 0, fmt.Sprintf("withdrawals[%d].amount", i), "must_be_positive", nil)
+		ids[i] = id
+	}
+	if !v.Valid() {
+		return NewValidationError(v.Errors)
+	}
+
+	out := make([]bulkWithdrawalOut, len(input.Withdrawals))
+	var withdrawals []data.UserWithdrawal
+	var pending []int
+	var rateLimits []*ratelimit.Reservation
+	for i, in := range input.Withdrawals {
+		out[i] = bulkWithdrawalOut{UserId: ids[i], Amount: in.Amount}
+
+		frozen, err := app.models.Transactions.IsUserFrozen(r.Context(), ids[i])
+		if err != nil {
+			return NewInternalError(err)
+		}
+		if frozen {
+			out[i].Error = "account_frozen"
+			continue
+		}
+
+		var rateLimit *ratelimit.Reservation
+		if app.config.maxWithdrawPerMinute > 0 {
+			if rateLimit, _ = app.withdrawalRate.Reserve(ids[i]); rateLimit == nil {
+				out[i].Error = "withdrawal_rate_limited"
+				continue
+			}
+			defer rateLimit.Cancel()
+		}
+
+		withdrawals = append(withdrawals, data.UserWithdrawal{UserID: ids[i], Amount: in.Amount})
+		pending = append(pending, i)
+		rateLimits = append(rateLimits, rateLimit)
+	}
+
+	results, err := app.models.Transactions.BulkWithdrawForUsers(r.Context(), withdrawals, app.withdrawOptions(false))
+	if err != nil {
+		return NewInternalError(err)
+	}
+
+	var settled []uuid.UUID
+	for j, result := range results {
+		i := pending[j]
+		if result.Err != nil {
+			out[i].Error = bulkWithdrawalError(result.Err)
+			continue
+		}
+		if result.WithdrawalId != uuid.Nil {
+			out[i].TransactionId = &result.WithdrawalId
+		}
+		settled = append(settled, result.UserID)
+		if rateLimits[j] != nil {
+			rateLimits[j].Commit()
+		}
+		app.amountMetrics.withdrawal.Observe(float64(result.Amount))
+	}
+
+	if len(settled) > 0 {
+		app.setReadAfter(w)
+
+		balances, err := app.models.Transactions.GetBalancesForUsers(r.Context(), settled)
+		if err != nil {
+			app.logger.Error("get balances after bulk withdrawal", "error", err)
+		} else {
+			for _, result := range results {
+				if result.Err != nil {
+					continue
+				}
+				balance := balances[result.UserID].Balance
+				event := withdrawalEvent{Type: data.TransactionTypeWithdrawal, UserId: result.UserID.String(), Amount: result.Amount, Balance: balance}
+				if err := app.events.publish(event); err != nil {
+					app.logger.Error("publish event", "error", err)
+				}
+				app.onWithdrawal(data.Transaction{UserId: result.UserID, Amount: result.Amount}, balance)
+			}
+		}
+	}
+
+	status := http.StatusOK
+	if len(settled) < len(out) {
+		status = http.StatusMultiStatus
+	}
+
+	if err = app.writeAmountsJSON(w, r, status, map[string]any{"withdrawals": out}, nil); err != nil {
+		return NewInternalError(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/google/uuid"
+	"net/http"
+	"net/http/httptest"
+	"simple-ledger.itmo.ru/internal/data"
+	"strings"
+	"testing"
+)
+
+// postJSON runs handler on a POST of body, pathValues are set as
+// name/value pairs
+func postJSON(app *application, handler handlerFunc, body string, pathValues ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/v1/admin", strings.NewReader(body))
+	for i := 0; i+1 < len(pathValues); i += 2 {
+		r.SetPathValue(pathValues[i], pathValues[i+1])
+	}
+
+	rr := httptest.NewRecorder()
+	app.handle(handler).ServeHTTP(rr, r)
+	return rr
+}
+
+// grantRemaining returns the remaining amount of every grant of userId by category
+func grantRemaining(t *testing.T, app *application, userId uuid.UUID) map[string][]int {
+	t.Helper()
+
+	rows, err := app.db.Query(`SELECT category, remaining_amount FROM transactions WHERE user_id = $1 AND direction = 'deposit'`, userId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	remaining := make(map[string][]int)
+	for rows.Next() {
+		var category string
+		var amount int
+		if err := rows.Scan(&category, &amount); err != nil {
+			t.Fatal(err)
+		}
+		remaining[category] = append(remaining[category], amount)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return remaining
+}
+
+func TestExpireCategoryHandler(t *testing.T) {
+	app := testApp(t)
+	ctx := context.Background()
+
+	userId := uuid.New()
+	t.Cleanup(func() { app.models.Transactions.DeleteAllForUser(ctx, userId) })
+
+	// ExpireByCategory is not limited to one user, a fresh category keeps
+	// other data out of the test
+	promo := "promo2025-" + uuid.NewString()[:8]
+	for _, category := range []string{promo, promo, promo, data.DefaultCategory, data.DefaultCategory} {
+		grant := data.Grant{UserId: userId, Amount: 100, LifetimeDays: 30, Category: category}
+		if _, err := app.models.Balances.AddBonusPoints(ctx, grant, data.DepositOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rr := postJSON(app, app.expireCategoryHandler, `{"reason": "campaign ended"}`, "category", promo)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rr.Code, rr.Body)
+	}
+
+	var body struct {
+		ExpiredGrants int `json:"expired_grants"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.ExpiredGrants != 3 {
+		t.Errorf("expired_grants = %d, want 3", body.ExpiredGrants)
+	}
+
+	remaining := grantRemaining(t, app, userId)
+	for _, amount := range remaining[promo] {
+		if amount != 0 {
+			t.Errorf("%s grant keeps %d", promo, amount)
+		}
+	}
+	if got := remaining[data.DefaultCategory]; len(got) != 2 || got[0] != 100 || got[1] != 100 {
+		t.Errorf("%s grants = %v, want two of 100", data.DefaultCategory, got)
+	}
+}
+
+func TestCancelDateRangeHandler(t *testing.T) {
+	app := testApp(t)
+	ctx := context.Background()
+
+	userId := uuid.New()
+	t.Cleanup(func() { app.models.Transactions.DeleteAllForUser(ctx, userId) })
+
+	// Grants are moved far into the past, where no other data is created
+	days := []string{"2001-01-01", "2001-01-02", "2001-01-02", "2001-01-03", "2001-01-03"}
+	for i, day := range days {
+		grant := data.Grant{UserId: userId, Amount: 100, LifetimeDays: 30, Category: "day" + day[len(day)-1:]}
+		transaction, err := app.models.Balances.AddBonusPoints(ctx, grant, data.DepositOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		createdAt := day + "T12:00:00Z"
+		if i == 2 {
+			createdAt = day + "T23:59:59Z"
+		}
+		if _, err := app.db.Exec(`UPDATE transactions SET created_at = $2 WHERE id = $1`, transaction.Id, createdAt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rr := postJSON(app, app.cancelDateRangeHandler, `{"from": "2001-01-02T00:00:00Z", "to": "2001-01-02T23:59:59Z", "reason": "fraud"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rr.Code, rr.Body)
+	}
+
+	want := map[string][]int{"day1": {100}, "day2": {0, 0}, "day3": {100, 100}}
+	remaining := grantRemaining(t, app, userId)
+	for category, amounts := range want {
+		got := remaining[category]
+		if len(got) != len(amounts) {
+			t.Errorf("%s grants = %v, want %v", category, got, amounts)
+			continue
+		}
+		for i := range amounts {
+			if got[i] != amounts[i] {
+				t.Errorf("%s grants = %v, want %v", category, got, amounts)
+				break
+			}
+		}
+	}
+}
+
+func TestCancelDateRangeHandlerValidation(t *testing.T) {
+	app := &application{config: config{jsonNamingConvention: namingSnakeCase}}
+
+	tests := []struct {
+		name  string
+		body  string
+		field string
+	}{
+		{"longer than 7 days", `{"from": "2025-01-01T00:00:00Z", "to": "2025-01-08T00:00:01Z", "reason": "fraud"}`, "to"},
+		{"reversed", `{"from": "2025-01-02T00:00:00Z", "to": "2025-01-01T00:00:00Z", "reason": "fraud"}`, "to"},
+		{"missing from", `{"to": "2025-01-01T00:00:00Z", "reason": "fraud"}`, "from"},
+		{"missing reason", `{"from": "2025-01-01T00:00:00Z", "to": "2025-01-02T00:00:00Z"}`, "reason"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := postJSON(app, app.cancelDateRangeHandler, tt.body)
+			if rr.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("status = %d, want %d", rr.Code, http.StatusUnprocessableEntity)
+			}
+
+			var body struct {
+				Error map[string]string `json:"error"`
+			}
+			if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := body.Error[tt.field]; !ok {
+				t.Errorf("errors = %v, want one for %s", body.Error, tt.field)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"simple-ledger.itmo.ru/internal/data"
+	"strings"
+)
+
+type contextKey string
+
+const (
+	adminKeyIDContextKey = contextKey("adminKeyID")
+	apiKeyContextKey     = contextKey("apiKey")
+)
+
+// parseAdminKeys parses the -admin-api-keys value, a comma separated list
+// of id=key pairs. The id names the key holder in audit logs.
+func parseAdminKeys(s string) (map[string]string, error) {
+	keys := make(map[string]string)
+	if s == "" {
+		return keys, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		id, key, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || id == "" || key == "" {
+			return nil, errors.New("admin-api-keys must be a comma separated list of id=key pairs")
+		}
+		if _, exists := keys[id]; exists {
+			return nil, errors.New("admin-api-keys must not repeat an id")
+		}
+		keys[id] = key
+	}
+
+	return keys, nil
+}
+
+// requireAdminKey rejects requests without a valid X-Admin-API-Key header
+// and makes the id of the key available through adminKeyID. Without
+// configured keys every request is rejected.
+func (app *application) requireAdminKey(fn handlerFunc) handlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) *AppError {
+		id, ok := app.matchAdminKey(r.Header.Get("X-Admin-API-Key"))
+		if !ok {
+			return NewUnauthorizedError()
+		}
+
+		ctx := context.WithValue(r.Context(), adminKeyIDContextKey, id)
+		return fn(w, r.WithContext(ctx))
+	}
+}
+
+// matchAdminKey compares hashes in constant time, so neither the key nor
+// its length leaks through timing
+func (app *application) matchAdminKey(key string) (string, bool) {
+	if key == "" {
+		return "", false
+	}
+
+	given := sha256.Sum256([]byte(key))
+	for id, k := range app.adminKeys {
+		expected := sha256.Sum256([]byte(k))
+		if subtle.ConstantTimeCompare(given[:], expected[:]) == 1 {
+			return id, true
+		}
+	}
+
+	return "", false
+}
+
+func adminKeyID(r *http.Request) string {
+	id, _ := r.Context().Value(adminKeyIDContextKey).(string)
+	return id
+}
+
+// requireUserKey lets a user access their own resources with an API key
+// from the X-API-Key header that has scope. When the route has an {id} it
+// must be the key's user. The key is available through contextAPIKey.
+// Without -require-api-keys requests pass unchecked.
+func (app *application) requireUserKey(scope string, fn handlerFunc) handlerFunc {
+	return app.requireUserKeyFor(scope, func(r *http.Request) string { return r.PathValue("id") }, fn)
+}
+
+// requireUserKeyFor is requireUserKey for routes taking the user from
+// somewhere else than the path. An unparsable user is left to fn to reject.
+func (app *application) requireUserKeyFor(scope string, user func(*http.Request) string, fn handlerFunc) handlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) *AppError {
+		if !app.config.requireAPIKeys {
+			return fn(w, r)
+		}
+
+		key := r.Header.Get("X-API-Key")
+		if key == "" {
+			return NewInvalidAPIKeyError()
+		}
+
+		apiKey, err := app.models.ApiKeys.Verify(r.Context(), key)
+		if err != nil {
+			if errors.Is(err, data.ErrRecordNotFound) {
+				return NewInvalidAPIKeyError()
+			}
+			return NewInternalError(err)
+		}
+
+		if !apiKey.HasScope(scope) {
+			return NewForbiddenError(fmt.Sprintf("the API key lacks the %s scope", scope))
+		}
+
+		if s := user(r); s != "" {
+			id, _, err := app.parseUserID(s)
+			if err == nil && id != apiKey.UserId {
+				return NewForbiddenError("the API key does not belong to this user")
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), apiKeyContextKey, apiKey)
+		return fn(w, r.WithContext(ctx))
+	}
+}
+
+// requireEventsKey guards the event stream: a user may watch their own
+// balance with a read key, the stream of all transactions needs a service key
+func (app *application) requireEventsKey(fn handlerFunc) handlerFunc {
+	userId := func(r *http.Request) string { return r.URL.Query().Get("user_id") }
+	user := app.requireUserKeyFor(data.ScopeRead, userId, fn)
+	service := app.requireServiceKey(fn)
+
+	return func(w http.ResponseWriter, r *http.Request) *AppError {
+		if userId(r) != "" {
+			return user(w, r)
+		}
+		return service(w, r)
+	}
+}
+
+// requireServiceKey guards routes acting on several users. With
+// -require-api-keys they need an admin key, user keys are not enough.
+func (app *application) requireServiceKey(fn handlerFunc) handlerFunc {
+	if !app.config.requireAPIKeys {
+		return fn
+	}
+	return app.requireAdminKey(fn)
+}
+
+// contextAPIKey returns the user API key of the request, nil when the
+// route does not require one or keys are not enforced
+func contextAPIKey(r *http.Request) *data.ApiKey {
+	apiKey, _ := r.Context().Value(apiKeyContextKey).(*data.ApiKey)
+	return apiKey
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// validateConfig checks the parsed flags and reports every violation at
+// once, so operators can fix them in a single pass
+func validateConfig(cfg config) error {
+	var errs []error
+
+	if cfg.port < 1 || cfg.port > 65535 {
+		errs = append(errs, errors.New("port must be between 1 and 65535"))
+	}
+	if (cfg.tls.certFile == "") != (cfg.tls.keyFile == "") {
+		errs = append(errs, errors.New("tls-cert-file and tls-key-file must be set together"))
+	}
+	if cfg.tls.certFile != "" && cfg.port == 65535 {
+		errs = append(errs, errors.New("port must leave room for the HTTPS redirect server on port+1"))
+	}
+	if cfg.env != "development" && cfg.env != "staging" && cfg.env != "production" {
+		errs = append(errs, errors.New("env must be development, staging or production"))
+	}
+	if cfg.pointsLifetimeDays <= 0 {
+		errs = append(errs, errors.New("points-lifetime-days must be positive"))
+	}
+	// Balance expirations only cover the next 30 days
+	if cfg.expiryWarningDays < 0 || cfg.expiryWarningDays > 30 {
+		errs = append(errs, errors.New("expiry-warning-days must be between 0 and 30"))
+	}
+	if cfg.notificationLeadDays < 1 {
+		errs = append(errs, errors.New("notification-lead-days must be positive"))
+	}
+	if cfg.depositMultiplier <= 0 {
+		errs = append(errs, errors.New("deposit-multiplier must be positive"))
+	}
+	if !cfg.roundingMode.Valid() {
+		errs = append(errs, errors.New("rounding-mode must be floor, ceil or round"))
+	}
+	if cfg.maxDebt < 0 {
+		errs = append(errs, errors.New("max-debt must not be negative"))
+	}
+	if cfg.maxSSEClients < 1 {
+		errs = append(errs, errors.New("max-sse-clients must be positive"))
+	}
+	if cfg.loadThreshold < 0 {
+		errs = append(errs, errors.New("load-threshold must not be negative"))
+	}
+	if cfg.lowPriorityDelayMs < 0 {
+		errs = append(errs, errors.New("low-priority-delay-ms must not be negative"))
+	}
+	if cfg.lockTimeoutMs < 0 {
+		errs = append(errs, errors.New("lock-timeout-ms must not be negative"))
+	}
+	if cfg.maxConversionRate <= 0 || cfg.maxConversionRate > 1 {
+		errs = append(errs, errors.New("max-conversion-rate must be greater than 0 and at most 1"))
+	}
+	if cfg.pointsPerCurrencyUnit <= 0 {
+		errs = append(errs, errors.New("points-per-currency-unit must be positive"))
+	}
+	if cfg.currencyCode == "" {
+		errs = append(errs, errors.New("currency-code must not be empty"))
+	}
+	if cfg.dedupCacheSize < 0 {
+		errs = append(errs, errors.New("dedup-cache-size must not be negative"))
+	}
+	if cfg.dedupTTL <= 0 {
+		errs = append(errs, errors.New("dedup-ttl must be positive"))
+	}
+	if cfg.maxDailyWithdrawalAmount < 0 {
+		errs = append(errs, errors.New("max-daily-withdrawal-amount must not be negative"))
+	}
+	if cfg.maxWithdrawPerMinute < 0 {
+		errs = append(errs, errors.New("max-withdraw-per-minute must not be negative"))
+	}
+	if cfg.maxTransactionsPerUser < 0 {
+		errs = append(errs, errors.New("max-transactions-per-user must not be negative"))
+	}
+	if cfg.logMaxSizeMB < 0 {
+		errs = append(errs, errors.New("log-max-size-mb must not be negative"))
+	}
+	if cfg.jsonNamingConvention != namingSnakeCase && cfg.jsonNamingConvention != namingCamelCase {
+		errs = append(errs, errors.New("json-naming-convention must be snake_case or camelCase"))
+	}
+	if cfg.userIDMode != "uuid" && cfg.userIDMode != "external" {
+		errs = append(errs, errors.New("user-id-mode must be uuid or external"))
+	}
+	if cfg.webhook.url != "" {
+		u, err := url.Parse(cfg.webhook.url)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, errors.New("webhook-url must be an absolute http(s) URL"))
+		}
+	}
+	if _, err := parseAdminKeys(cfg.adminAPIKeys); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.db.replicaMaxLag < 0 {
+		errs = append(errs, errors.New("db-replica-max-lag must not be negative"))
+	}
+	if cfg.db.maxOpenConns < 1 {
+		errs = append(errs, errors.New("db-max-open-conns must be positive"))
+	}
+	if cfg.db.maxIdleConns < 0 || cfg.db.maxIdleConns > cfg.db.maxOpenConns {
+		errs = append(errs, errors.New("db-max-idle-conns must be between 0 and db-max-open-conns"))
+	}
+	if cfg.db.connMaxLifetime < 0 || cfg.db.connMaxIdleTime < 0 {
+		errs = append(errs, errors.New("db-conn-max-lifetime and db-conn-max-idle-time must not be negative"))
+	}
+	if cfg.db.maxRetries < 1 {
+		errs = append(errs, errors.New("db-max-retries must be positive"))
+	}
+	if cfg.db.initialBackoff < 0 {
+		errs = append(errs, errors.New("db-initial-backoff must not be negative"))
+	}
+	if cfg.db.maxBackoff < cfg.db.initialBackoff {
+		errs = append(errs, errors.New("db-max-backoff must not be less than db-initial-backoff"))
+	}
+	if strings.TrimSpace(cfg.db.healthQuery) == "" {
+		errs = append(errs, errors.New("db-health-query must not be empty"))
+	}
+	if cfg.timeouts.addBonusPoints <= 0 || cfg.timeouts.withdraw <= 0 || cfg.timeouts.getBalance <= 0 {
+		errs = append(errs, errors.New("timeout-add-bonus-points, timeout-withdraw and timeout-get-balance must be positive"))
+	}
+	if cfg.db.slowQueryThresholdMs < 0 {
+		errs = append(errs, errors.New("slow-query-threshold-ms must not be negative"))
+	}
+
+	return errors.Join(errs...)
+}
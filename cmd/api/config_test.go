@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"simple-ledger.itmo.ru/internal/data"
+	"strings"
+	"testing"
+	"time"
+)
+
+// validConfig returns the flag defaults, which must pass validateConfig
+func validConfig() config {
+	var cfg config
+	cfg.port = 8080
+	cfg.env = "production"
+	cfg.jsonNamingConvention = namingSnakeCase
+	cfg.userIDMode = "uuid"
+	cfg.pointsLifetimeDays = 365
+	cfg.expiryWarningDays = 7
+	cfg.notificationLeadDays = 3
+	cfg.depositMultiplier = 1.0
+	cfg.roundingMode = data.RoundNearest
+	cfg.maxSSEClients = 100
+	cfg.maxConversionRate = 0.5
+	cfg.pointsPerCurrencyUnit = 100.0
+	cfg.currencyCode = "USD"
+	cfg.dedupTTL = 24 * time.Hour
+	cfg.db.maxOpenConns = 25
+	cfg.db.maxIdleConns = 25
+	cfg.db.maxRetries = 5
+	cfg.db.initialBackoff = 500 * time.Millisecond
+	cfg.db.maxBackoff = 10 * time.Second
+	cfg.db.healthQuery = "SELECT 1"
+	cfg.timeouts.addBonusPoints = data.DefaultTimeouts.AddBonusPoints
+	cfg.timeouts.withdraw = data.DefaultTimeouts.Withdraw
+	cfg.timeouts.getBalance = data.DefaultTimeouts.GetBalance
+	return cfg
+}
+
+func TestValidateConfig(t *testing.T) {
+	if err := validateConfig(validConfig()); err != nil {
+		t.Fatalf("defaults rejected: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(*config)
+		wantErr string
+	}{
+		{"port zero", func(c *config) { c.port = 0 }, "port"},
+		{"port too large", func(c *config) { c.port = 65536 }, "port"},
+		{"tls cert without key", func(c *config) { c.tls.certFile = "cert.pem" }, "tls-cert-file"},
+		{"tls on last port", func(c *config) { c.tls.certFile, c.tls.keyFile, c.port = "cert.pem", "key.pem", 65535 }, "HTTPS redirect"},
+		{"unknown env", func(c *config) { c.env = "test" }, "env"},
+		{"zero lifetime", func(c *config) { c.pointsLifetimeDays = 0 }, "points-lifetime-days"},
+		{"expiry warning beyond window", func(c *config) { c.expiryWarningDays = 31 }, "expiry-warning-days"},
+		{"zero notification lead", func(c *config) { c.notificationLeadDays = 0 }, "notification-lead-days"},
+		{"zero multiplier", func(c *config) { c.depositMultiplier = 0 }, "deposit-multiplier"},
+		{"unknown rounding mode", func(c *config) { c.roundingMode = "up" }, "rounding-mode"},
+		{"negative max debt", func(c *config) { c.maxDebt = -1 }, "max-debt"},
+		{"no sse clients", func(c *config) { c.maxSSEClients = 0 }, "max-sse-clients"},
+		{"negative load threshold", func(c *config) { c.loadThreshold = -1 }, "load-threshold"},
+		{"negative low priority delay", func(c *config) { c.lowPriorityDelayMs = -1 }, "low-priority-delay-ms"},
+		{"negative lock timeout", func(c *config) { c.lockTimeoutMs = -1 }, "lock-timeout-ms"},
+		{"conversion rate above one", func(c *config) { c.maxConversionRate = 1.5 }, "max-conversion-rate"},
+		{"zero points per currency unit", func(c *config) { c.pointsPerCurrencyUnit = 0 }, "points-per-currency-unit"},
+		{"empty currency", func(c *config) { c.currencyCode = "" }, "currency-code"},
+		{"negative dedup cache", func(c *config) { c.dedupCacheSize = -1 }, "dedup-cache-size"},
+		{"zero dedup ttl", func(c *config) { c.dedupTTL = 0 }, "dedup-ttl"},
+		{"negative daily withdrawal limit", func(c *config) { c.maxDailyWithdrawalAmount = -1 }, "max-daily-withdrawal-amount"},
+		{"negative withdraw rate", func(c *config) { c.maxWithdrawPerMinute = -1 }, "max-withdraw-per-minute"},
+		{"negative transactions per user", func(c *config) { c.maxTransactionsPerUser = -1 }, "max-transactions-per-user"},
+		{"negative log size", func(c *config) { c.logMaxSizeMB = -1 }, "log-max-size-mb"},
+		{"unknown naming convention", func(c *config) { c.jsonNamingConvention = "kebab-case" }, "json-naming-convention"},
+		{"unknown user id mode", func(c *config) { c.userIDMode = "email" }, "user-id-mode"},
+		{"relative webhook url", func(c *config) { c.webhook.url = "/hooks" }, "webhook-url"},
+		{"webhook url without http", func(c *config) { c.webhook.url = "ftp://hooks.example.com" }, "webhook-url"},
+		{"negative replica lag", func(c *config) { c.db.replicaMaxLag = -time.Second }, "db-replica-max-lag"},
+		{"no open conns", func(c *config) { c.db.maxOpenConns = 0; c.db.maxIdleConns = 0 }, "db-max-open-conns"},
+		{"more idle than open conns", func(c *config) { c.db.maxIdleConns = 26 }, "db-max-idle-conns"},
+		{"negative conn lifetime", func(c *config) { c.db.connMaxLifetime = -time.Second }, "db-conn-max-lifetime"},
+		{"no retries", func(c *config) { c.db.maxRetries = 0 }, "db-max-retries"},
+		{"negative initial backoff", func(c *config) { c.db.initialBackoff = -time.Second }, "db-initial-backoff"},
+		{"max backoff below initial", func(c *config) { c.db.maxBackoff = time.Millisecond }, "db-max-backoff"},
+		{"blank health query", func(c *config) { c.db.healthQuery = "  " }, "db-health-query"},
+		{"zero withdraw timeout", func(c *config) { c.timeouts.withdraw = 0 }, "timeout-withdraw"},
+		{"negative slow query threshold", func(c *config) { c.db.slowQueryThresholdMs = -1 }, "slow-query-threshold-ms"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validConfig()
+			tt.modify(&cfg)
+
+			err := validateConfig(cfg)
+			if err == nil {
+				t.Fatal("no error")
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error %q does not mention %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateConfigReportsAllViolations(t *testing.T) {
+	cfg := validConfig()
+	cfg.port = 0
+	cfg.pointsLifetimeDays = 0
+	cfg.webhook.url = "not a url"
+
+	err := validateConfig(cfg)
+
+	var joined interface{ Unwrap() []error }
+	if !errors.As(err, &joined) {
+		t.Fatalf("error %v is not a joined error", err)
+	}
+	if n := len(joined.Unwrap()); n != 3 {
+		t.Errorf("%d errors reported, want 3: %v", n, err)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"simple-ledger.itmo.ru/internal/data"
+	"strconv"
+	"time"
+)
+
+// readAfterHeader carries the time of the client's last write (Unix
+// milliseconds). Writes return it, clients echo it back on reads.
+const readAfterHeader = "X-Read-After"
+
+// setReadAfter marks the response of a committed write
+func (app *application) setReadAfter(w http.ResponseWriter) {
+	w.Header().Set(readAfterHeader, strconv.FormatInt(time.Now().UnixMilli(), 10))
+}
+
+// readModels returns the models for balance reads. They go to the replica
+// unless the client wrote less than replicaMaxLag ago, then the replica may
+// not have caught up yet and the primary is read to see the client's writes.
+func (app *application) readModels(r *http.Request) data.Models {
+	token := r.Header.Get(readAfterHeader)
+	if token == "" {
+		return app.replica
+	}
+
+	ms, err := strconv.ParseInt(token, 10, 64)
+	if err != nil || time.Since(time.UnixMilli(ms)) < app.config.db.replicaMaxLag {
+		return app.models
+	}
+
+	return app.replica
+}
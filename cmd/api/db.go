@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"log/slog"
+	"simple-ledger.itmo.ru/internal/circuit"
+	"simple-ledger.itmo.ru/internal/data"
+	"time"
+)
+
+// queryLogger wraps *sql.DB and logs queries slower than threshold at DEBUG level.
+// Statements executed inside a *sql.Tx returned by BeginTx are not instrumented.
+type queryLogger struct {
+	db        *sql.DB
+	logger    *slog.Logger
+	threshold time.Duration
+}
+
+func newQueryLogger(db *sql.DB, logger *slog.Logger, threshold time.Duration) queryLogger {
+	return queryLogger{db: db, logger: logger, threshold: threshold}
+}
+
+func (q queryLogger) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	defer q.log(ctx, time.Now(), query, args)
+	return q.db.QueryRowContext(ctx, query, args...)
+}
+
+func (q queryLogger) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	defer q.log(ctx, time.Now(), query, args)
+	return q.db.QueryContext(ctx, query, args...)
+}
+
+func (q queryLogger) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	defer q.log(ctx, time.Now(), query, args)
+	return q.db.ExecContext(ctx, query, args...)
+}
+
+func (q queryLogger) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	defer q.log(ctx, time.Now(), "BEGIN", nil)
+	return q.db.BeginTx(ctx, opts)
+}
+
+func (q queryLogger) log(ctx context.Context, start time.Time, query string, args []any) {
+	duration := time.Since(start)
+	if duration < q.threshold {
+		return
+	}
+
+	// Bind values may contain user data, so only their types are logged
+	types := make([]string, len(args))
+	for i, arg := range args {
+		types[i] = fmt.Sprintf("%T", arg)
+	}
+
+	q.logger.DebugContext(ctx, "slow query",
+		"query", query,
+		"args", types,
+		"duration", duration,
+	)
+}
+
+// circuitQuerier fails fast with circuit.ErrCircuitOpen while the database
+// is considered down. Only connection level failures trip the breaker,
+// query errors such as constraint violations mean the database is up.
+type circuitQuerier struct {
+	db      data.Querier
+	breaker *circuit.Breaker
+}
+
+func newCircuitQuerier(db data.Querier, breaker *circuit.Breaker) circuitQuerier {
+	return circuitQuerier{db: db, breaker: breaker}
+}
+
+// QueryRowContext defers its error to Scan, so the outcome cannot be
+// recorded. While the circuit is open the query runs with a cancelled
+// context, which fails without touching the database.
+func (c circuitQuerier) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	if c.breaker.State() == circuit.Open {
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		ctx = cancelled
+	}
+	return c.db.QueryRowContext(ctx, query, args...)
+}
+
+func (c circuitQuerier) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	if err := c.breaker.Allow(); err != nil {
+		return nil, err
+	}
+
+	rows, err := c.db.QueryContext(ctx, query, args...)
+	c.record(ctx, err)
+	return rows, err
+}
+
+func (c circuitQuerier) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	if err := c.breaker.Allow(); err != nil {
+		return nil, err
+	}
+
+	result, err := c.db.ExecContext(ctx, query, args...)
+	c.record(ctx, err)
+	return result, err
+}
+
+func (c circuitQuerier) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	if err := c.breaker.Allow(); err != nil {
+		return nil, err
+	}
+
+	tx, err := c.db.BeginTx(ctx, opts)
+	c.record(ctx, err)
+	return tx, err
+}
+
+func (c circuitQuerier) record(ctx context.Context, err error) {
+	var pqErr *pq.Error
+	switch {
+	case err == nil, errors.As(err, &pqErr):
+		c.breaker.Success()
+	case ctx.Err() == context.Canceled:
+		// The client went away, this says nothing about the database
+		c.breaker.Success()
+	default:
+		c.breaker.Failure()
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"simple-ledger.itmo.ru/internal/cache"
+	"sync"
+	"time"
+)
+
+var errDuplicateInFlight = errors.New("a request with this idempotency_key is still in progress")
+
+// cachedResponse is a successful response replayed for a repeated
+// idempotency key
+type cachedResponse struct {
+	status int
+	body   []byte
+}
+
+// deduplicator replays the responses of repeated idempotency keys. A key is
+// reserved while its request runs, so concurrent retries cannot both write.
+type deduplicator struct {
+	responses *cache.LRU[string, cachedResponse]
+	inFlight  sync.Map
+}
+
+func newDeduplicator(size int, ttl time.Duration) *deduplicator {
+	return &deduplicator{responses: cache.NewLRU[string, cachedResponse](size, ttl)}
+}
+
+// bodyRecorder passes a response through and keeps a copy of it
+type bodyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *bodyRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *bodyRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+func (rec *bodyRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// deduplicate writes the cached response of key and reports true when
+// there is one. Otherwise it reserves key and wraps w, the returned function
+// caches a successful response and releases key. While key is reserved by
+// another request it returns errDuplicateInFlight. Without a cache w is
+// returned as is.
+func (app *application) deduplicate(w http.ResponseWriter, key string) (http.ResponseWriter, func(), bool, error) {
+	if app.dedup == nil {
+		return w, func() {}, false, nil
+	}
+
+	if _, loaded := app.dedup.inFlight.LoadOrStore(key, struct{}{}); loaded {
+		return w, nil, false, errDuplicateInFlight
+	}
+
+	// Checked after reserving, a request finishing in between has
+	// already stored its response
+	if cached, ok := app.dedup.responses.Get(key); ok {
+		app.dedup.inFlight.Delete(key)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(cached.status)
+		w.Write(cached.body)
+		return w, nil, true, nil
+	}
+
+	rec := &bodyRecorder{ResponseWriter: w}
+	return rec, func() {
+		if rec.status >= 200 && rec.status < 300 {
+			app.dedup.responses.Set(key, cachedResponse{status: rec.status, body: bytes.Clone(rec.body.Bytes())})
+		}
+		app.dedup.inFlight.Delete(key)
+	}, false, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// serveDeduplicated runs a request for key through deduplicate, handing
+// misses to fn
+func serveDeduplicated(app *application, key string, fn http.HandlerFunc) (*httptest.ResponseRecorder, error) {
+	rr := httptest.NewRecorder()
+
+	w, done, replayed, err := app.deduplicate(rr, key)
+	if err != nil || replayed {
+		return rr, err
+	}
+	defer done()
+
+	fn(w, httptest.NewRequest(http.MethodPost, "/v1/transactions", nil))
+	return rr, nil
+}
+
+func TestDeduplicateReplaysIdenticalBytes(t *testing.T) {
+	app := &application{dedup: newDeduplicator(10, time.Hour)}
+
+	calls := 0
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "{\n\t\"balance\": %d\n}\n", 100*calls)
+	}
+
+	first, err := serveDeduplicated(app, "user:key", fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := serveDeduplicated(app, "user:key", fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if calls != 1 {
+		t.Errorf("handler ran %d times, want 1", calls)
+	}
+	if second.Code != first.Code {
+		t.Errorf("replayed status %d, want %d", second.Code, first.Code)
+	}
+	if !bytes.Equal(second.Body.Bytes(), first.Body.Bytes()) {
+		t.Errorf("replayed body %q, want %q", second.Body, first.Body)
+	}
+	if second.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("replayed response lacks Idempotent-Replayed")
+	}
+}
+
+func TestDeduplicateSkipsFailedResponses(t *testing.T) {
+	app := &application{dedup: newDeduplicator(10, time.Hour)}
+
+	calls := 0
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+
+	for range 2 {
+		if _, err := serveDeduplicated(app, "user:key", fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if calls != 2 {
+		t.Errorf("handler ran %d times, want 2", calls)
+	}
+}
+
+func TestDeduplicateRejectsConcurrentDuplicate(t *testing.T) {
+	app := &application{dedup: newDeduplicator(10, time.Hour)}
+
+	_, done, _, err := app.deduplicate(httptest.NewRecorder(), "user:key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, _, err = app.deduplicate(httptest.NewRecorder(), "user:key")
+	if !errors.Is(err, errDuplicateInFlight) {
+		t.Errorf("got %v, want errDuplicateInFlight", err)
+	}
+
+	done()
+
+	if _, _, _, err = app.deduplicate(httptest.NewRecorder(), "user:key"); err != nil {
+		t.Errorf("key still reserved after done: %v", err)
+	}
+}
+
+// The miss path stands in for the handler without its database work, the
+// difference to the hit path is the cost deduplication adds per request
+func BenchmarkDeduplicate(b *testing.B) {
+	body := []byte(`{"user_id":"8d1f0c5e-5b7a-4c1e-9f3b-2f7c1d9e6a41","balance":1000,"expirations":[]}`)
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	}
+
+	b.Run("hit", func(b *testing.B) {
+		app := &application{dedup: newDeduplicator(10000, time.Hour)}
+		serveDeduplicated(app, "user:key", fn)
+
+		b.ResetTimer()
+		for range b.N {
+			serveDeduplicated(app, "user:key", fn)
+		}
+	})
+
+	b.Run("miss", func(b *testing.B) {
+		app := &application{dedup: newDeduplicator(10000, time.Hour)}
+
+		b.ResetTimer()
+		for i := range b.N {
+			serveDeduplicated(app, fmt.Sprintf("user:%d", i), fn)
+		}
+	})
+}
@@ -2,36 +2,220 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 )
 
-func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message any) {
-	msg := map[string]any{"error": message}
+// AppError is an error a handler reports to the client. Code is a stable
+// machine readable identifier, Message is sent as "error" and Err is the
+// underlying cause, logged for server errors but never sent.
+type AppError struct {
+	Code       string
+	Message    any
+	StatusCode int
+	Err        error
+	// Headers are added to the error response
+	Headers http.Header
+}
 
-	if err := app.writeJSON(w, status, msg, nil); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+func (e *AppError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %v", e.Code, e.Err)
+	}
+	return fmt.Sprintf("%s: %v", e.Code, e.Message)
+}
+
+func (e *AppError) Unwrap() error {
+	return e.Err
+}
+
+func NewInternalError(err error) *AppError {
+	return &AppError{
+		Code:       "internal_error",
+		Message:    "the server encountered a problem and could not process your request",
+		StatusCode: http.StatusInternalServerError,
+		Err:        err,
+	}
+}
+
+func NewNotFoundError() *AppError {
+	return &AppError{
+		Code:       "not_found",
+		Message:    "the requested resource could not be found",
+		StatusCode: http.StatusNotFound,
+	}
+}
+
+func NewMethodNotAllowedError(method string) *AppError {
+	return &AppError{
+		Code:       "method_not_allowed",
+		Message:    fmt.Sprintf("the %s method is not supported for this resource", method),
+		StatusCode: http.StatusMethodNotAllowed,
+	}
+}
+
+func NewBadRequestError(err error) *AppError {
+	return &AppError{
+		Code:       "bad_request",
+		Message:    err.Error(),
+		StatusCode: http.StatusBadRequest,
+		Err:        err,
+	}
+}
+
+// NewValidationError reports field errors, the message is the field -> error map
+func NewValidationError(errors map[string]string) *AppError {
+	return &AppError{
+		Code:       "validation_failed",
+		Message:    errors,
+		StatusCode: http.StatusUnprocessableEntity,
+	}
+}
+
+// NewInsufficientFundsError covers withdrawals rejected for the balance,
+// including an exceeded debt limit
+func NewInsufficientFundsError(err error) *AppError {
+	return &AppError{
+		Code:       "insufficient_funds",
+		Message:    err.Error(),
+		StatusCode: http.StatusBadRequest,
+		Err:        err,
+	}
+}
+
+func NewUnauthorizedError() *AppError {
+	return &AppError{
+		Code:       "unauthorized",
+		Message:    "a valid admin API key is required",
+		StatusCode: http.StatusUnauthorized,
+	}
+}
+
+func NewInvalidAPIKeyError() *AppError {
+	return &AppError{
+		Code:       "invalid_api_key",
+		Message:    "a valid API key is required in X-API-Key",
+		StatusCode: http.StatusUnauthorized,
+	}
+}
+
+func NewForbiddenError(message string) *AppError {
+	return &AppError{
+		Code:       "forbidden",
+		Message:    message,
+		StatusCode: http.StatusForbidden,
+	}
+}
+
+func NewConflictError(err error) *AppError {
+	return &AppError{
+		Code:       "conflict",
+		Message:    err.Error(),
+		StatusCode: http.StatusConflict,
+		Err:        err,
 	}
 }
 
-func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
-	message := "the server encountered a problem and could not process your request"
-	app.errorResponse(w, r, http.StatusInternalServerError, message)
+// NewUnprocessableError reports a well-formed request the current state
+// does not allow
+func NewUnprocessableError(err error) *AppError {
+	return &AppError{
+		Code:       "unprocessable",
+		Message:    err.Error(),
+		StatusCode: http.StatusUnprocessableEntity,
+		Err:        err,
+	}
 }
 
-func (app *application) notFoundResponse(w http.ResponseWriter, r *http.Request) {
-	message := "the requested resource could not be found"
-	app.errorResponse(w, r, http.StatusNotFound, message)
+func NewAccountFrozenError() *AppError {
+	return &AppError{
+		Code:       "account_frozen",
+		Message:    "account frozen",
+		StatusCode: http.StatusForbidden,
+	}
 }
 
-func (app *application) methodNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
-	message := fmt.Sprintf("the %s method is not supported for this resource", r.Method)
-	app.errorResponse(w, r, http.StatusMethodNotAllowed, message)
+func NewDailyWithdrawalLimitError(err error) *AppError {
+	return &AppError{
+		Code:       "daily_withdrawal_limit_exceeded",
+		Message:    err.Error(),
+		StatusCode: http.StatusUnprocessableEntity,
+		Err:        err,
+	}
 }
 
-func (app *application) badRequestResponse(w http.ResponseWriter, r *http.Request, err error) {
-	app.errorResponse(w, r, http.StatusBadRequest, err.Error())
+func NewTransactionLimitError(err error) *AppError {
+	return &AppError{
+		Code:       "transaction_limit_exceeded",
+		Message:    err.Error(),
+		StatusCode: http.StatusUnprocessableEntity,
+		Err:        err,
+	}
+}
+
+func NewServiceUnavailableError(message string) *AppError {
+	return &AppError{
+		Code:       "service_unavailable",
+		Message:    message,
+		StatusCode: http.StatusServiceUnavailable,
+	}
+}
+
+func NewWithdrawalInProgressError() *AppError {
+	return &AppError{
+		Code:       "withdrawal_in_progress",
+		Message:    "withdrawal in progress",
+		StatusCode: http.StatusTooManyRequests,
+	}
 }
 
-func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string]string) {
-	app.errorResponse(w, r, http.StatusUnprocessableEntity, errors)
+// NewWithdrawalRateLimitError rejects a withdrawal over the per-minute
+// limit, retryAfter is when the next one would be allowed
+func NewWithdrawalRateLimitError(retryAfter time.Duration) *AppError {
+	seconds := max(int(math.Ceil(retryAfter.Seconds())), 1)
+	return &AppError{
+		Code:       "withdrawal_rate_limited",
+		Message:    "too many withdrawals, please retry later",
+		StatusCode: http.StatusTooManyRequests,
+		Headers:    http.Header{"Retry-After": []string{strconv.Itoa(seconds)}},
+	}
+}
+
+// NewLockTimeoutError reports a withdrawal that gave up waiting for a
+// concurrent one, the client may retry after a second
+func NewLockTimeoutError(err error) *AppError {
+	return &AppError{
+		Code:       "lock_timeout",
+		Message:    "the account is busy with another transaction, please retry",
+		StatusCode: http.StatusServiceUnavailable,
+		Err:        err,
+		Headers:    http.Header{"Retry-After": []string{"1"}},
+	}
+}
+
+// handlerFunc is a handler that reports failures by returning them
+type handlerFunc func(w http.ResponseWriter, r *http.Request) *AppError
+
+// handle adapts fn to http.Handler, writing any returned error through errorResponse
+func (app *application) handle(fn handlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if appErr := fn(w, r); appErr != nil {
+			app.errorResponse(w, r, appErr)
+		}
+	})
+}
+
+// errorResponse is the single place error responses are written
+func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, appErr *AppError) {
+	if appErr.StatusCode >= http.StatusInternalServerError && appErr.Err != nil {
+		app.logger.Error(appErr.Err.Error(), "method", r.Method, "uri", r.URL.RequestURI())
+	}
+
+	msg := map[string]any{"error": appErr.Message, "code": appErr.Code}
+
+	if err := app.writeJSON(w, r, appErr.StatusCode, msg, appErr.Headers); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
 }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAppErrorConstructors(t *testing.T) {
+	cause := errors.New("cause")
+
+	tests := []struct {
+		name       string
+		err        *AppError
+		wantCode   string
+		wantStatus int
+		wantCause  bool
+	}{
+		{"internal", NewInternalError(cause), "internal_error", http.StatusInternalServerError, true},
+		{"not found", NewNotFoundError(), "not_found", http.StatusNotFound, false},
+		{"method not allowed", NewMethodNotAllowedError(http.MethodPut), "method_not_allowed", http.StatusMethodNotAllowed, false},
+		{"bad request", NewBadRequestError(cause), "bad_request", http.StatusBadRequest, true},
+		{"validation", NewValidationError(map[string]string{"amount": "must be positive"}), "validation_failed", http.StatusUnprocessableEntity, false},
+		{"insufficient funds", NewInsufficientFundsError(cause), "insufficient_funds", http.StatusBadRequest, true},
+		{"unauthorized", NewUnauthorizedError(), "unauthorized", http.StatusUnauthorized, false},
+		{"invalid api key", NewInvalidAPIKeyError(), "invalid_api_key", http.StatusUnauthorized, false},
+		{"forbidden", NewForbiddenError("no"), "forbidden", http.StatusForbidden, false},
+		{"conflict", NewConflictError(cause), "conflict", http.StatusConflict, true},
+		{"unprocessable", NewUnprocessableError(cause), "unprocessable", http.StatusUnprocessableEntity, true},
+		{"account frozen", NewAccountFrozenError(), "account_frozen", http.StatusForbidden, false},
+		{"daily withdrawal limit", NewDailyWithdrawalLimitError(cause), "daily_withdrawal_limit_exceeded", http.StatusUnprocessableEntity, true},
+		{"transaction limit", NewTransactionLimitError(cause), "transaction_limit_exceeded", http.StatusUnprocessableEntity, true},
+		{"service unavailable", NewServiceUnavailableError("down"), "service_unavailable", http.StatusServiceUnavailable, false},
+		{"withdrawal in progress", NewWithdrawalInProgressError(), "withdrawal_in_progress", http.StatusTooManyRequests, false},
+		{"withdrawal rate limited", NewWithdrawalRateLimitError(time.Second), "withdrawal_rate_limited", http.StatusTooManyRequests, false},
+		{"lock timeout", NewLockTimeoutError(cause), "lock_timeout", http.StatusServiceUnavailable, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.err.Code != tt.wantCode || tt.err.StatusCode != tt.wantStatus {
+				t.Errorf("got %s %d, want %s %d", tt.err.Code, tt.err.StatusCode, tt.wantCode, tt.wantStatus)
+			}
+			if tt.err.Message == nil || tt.err.Message == "" {
+				t.Error("message is empty")
+			}
+			if got := errors.Is(tt.err, cause); got != tt.wantCause {
+				t.Errorf("errors.Is(err, cause) = %t, want %t", got, tt.wantCause)
+			}
+		})
+	}
+}
+
+func TestNewWithdrawalRateLimitErrorRetryAfter(t *testing.T) {
+	tests := []struct {
+		retryAfter time.Duration
+		want       string
+	}{
+		{0, "1"},
+		{100 * time.Millisecond, "1"},
+		{time.Second, "1"},
+		{1500 * time.Millisecond, "2"},
+		{time.Minute, "60"},
+	}
+
+	for _, tt := range tests {
+		if got := NewWithdrawalRateLimitError(tt.retryAfter).Headers.Get("Retry-After"); got != tt.want {
+			t.Errorf("Retry-After for %s = %q, want %q", tt.retryAfter, got, tt.want)
+		}
+	}
+}
+
+func TestHandleWritesAppError(t *testing.T) {
+	app := &application{logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	h := app.handle(func(w http.ResponseWriter, r *http.Request) *AppError {
+		return NewLockTimeoutError(errors.New("lock timeout"))
+	})
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/v1/transactions", nil))
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusServiceUnavailable)
+	}
+	if got := rr.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After = %q, want 1", got)
+	}
+
+	var body struct {
+		Error string `json:"error"`
+		Code  string `json:"code"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Code != "lock_timeout" || body.Error == "" {
+		t.Errorf("body = %+v", body)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"net/http"
+	"simple-ledger.itmo.ru/internal/data"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	sseWriteTimeout = 10 * time.Second
+	sseKeepAlive    = 15 * time.Second
+)
+
+type transactionEvent struct {
+	Type data.TransactionType `json:"type"`
+	*data.Transaction
+}
+
+type withdrawalEvent struct {
+	Type    data.TransactionType `json:"type"`
+	UserId  string               `json:"user_id"`
+	Amount  int                  `json:"amount"`
+	Balance int                  `json:"balance"`
+}
+
+type revertEvent struct {
+	Type          string    `json:"type"`
+	TransactionId uuid.UUID `json:"transaction_id"`
+	UserId        string    `json:"user_id"`
+	Amount        int       `json:"amount"`
+	Balance       int       `json:"balance"`
+}
+
+type balanceEvent struct {
+	UserId  string `json:"user_id"`
+	Balance int    `json:"balance"`
+}
+
+// broker fans transaction events out to SSE subscribers. Slow subscribers
+// do not block publishers, events that do not fit their buffer are dropped.
+type broker struct {
+	clients    sync.Map // chan []byte -> struct{}
+	count      atomic.Int64
+	maxClients int64
+}
+
+func newBroker(maxClients int) *broker {
+	return &broker{maxClients: int64(maxClients)}
+}
+
+// subscribe registers a new client, it fails when the limit is reached
+func (b *broker) subscribe() (chan []byte, bool) {
+	if b.count.Add(1) > b.maxClients {
+		b.count.Add(-1)
+		return nil, false
+	}
+
+	ch := make(chan []byte, 16)
+	b.clients.Store(ch, struct{}{})
+	return ch, true
+}
+
+func (b *broker) unsubscribe(ch chan []byte) {
+	if _, loaded := b.clients.LoadAndDelete(ch); loaded {
+		b.count.Add(-1)
+	}
+}
+
+func (b *broker) publish(event any) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	b.clients.Range(func(key, _ any) bool {
+		select {
+		case key.(chan []byte) <- payload:
+		default:
+		}
+		return true
+	})
+	return nil
+}
+
+func (app *application) eventsHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	// With ?user_id= only the balance changes of that user are streamed,
+	// the nil channels of the unused source never fire
+	var balances <-chan int
+	var userId string
+	if s := r.URL.Query().Get("user_id"); s != "" {
+		id, _, err := app.parseUserID(s)
+		if err != nil {
+			v := app.newValidator(r)
+			app.checkUserID(v, false)
+			return NewValidationError(v.Errors)
+		}
+		userId = id.String()
+
+		balances, err = app.models.Balances.WatchBalance(r.Context(), id)
+		if err != nil {
+			if errors.Is(err, data.ErrWatchUnavailable) {
+				return NewServiceUnavailableError("balance events are not available")
+			}
+			return NewInternalError(err)
+		}
+	}
+
+	ch, ok := app.events.subscribe()
+	if !ok {
+		return NewServiceUnavailableError("too many event subscribers")
+	}
+	defer app.events.unsubscribe(ch)
+
+	var transactions <-chan []byte = ch
+	if balances != nil {
+		transactions = nil
+	}
+
+	rc := http.NewResponseController(w)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	// write extends the deadline before every write, so a stuck client is
+	// dropped after sseWriteTimeout instead of the server WriteTimeout
+	write := func(format string, args ...any) error {
+		if err := rc.SetWriteDeadline(time.Now().Add(sseWriteTimeout)); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, format, args...); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	if err := write(": connected\n\n"); err != nil {
+		return nil
+	}
+
+	ticker := time.NewTicker(sseKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil
+		case <-ticker.C:
+			if err := write(": ping\n\n"); err != nil {
+				return nil
+			}
+		case payload := <-transactions:
+			if err := write("event: transaction\ndata: %s\n\n", payload); err != nil {
+				return nil
+			}
+		case balance, ok := <-balances:
+			if !ok {
+				return nil
+			}
+			payload, err := json.Marshal(balanceEvent{UserId: userId, Balance: balance})
+			if err != nil {
+				return NewInternalError(err)
+			}
+			if err := write("event: balance\ndata: %s\n\n", payload); err != nil {
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"simple-ledger.itmo.ru/internal/data"
+	"time"
+)
+
+const (
+	// exportFlushRows is the number of rows written between flushes
+	exportFlushRows = 100
+	// exportTimeout bounds a whole export, the server WriteTimeout is
+	// extended per flush instead
+	exportTimeout      = 5 * time.Minute
+	exportWriteTimeout = 30 * time.Second
+)
+
+// exportTransactionsHandler streams all transactions of a user as
+// newline-delimited JSON, optionally limited to ?from=DATE&to=DATE
+func (app *application) exportTransactionsHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	id, _, err := app.readUserIDParam(r)
+	if err != nil {
+		return NewNotFoundError()
+	}
+
+	qs := r.URL.Query()
+	v := app.newValidator(r)
+
+	from := app.readDate(qs, "from", v)
+	to := app.readDate(qs, "to", v)
+	if !to.IsZero() {
+		// to is inclusive
+		to = to.AddDate(0, 0, 1)
+	}
+
+	v.CheckMsg(to.IsZero() || to.After(from), "to", "must_not_be_before", "from")
+	if !v.Valid() {
+		return NewValidationError(v.Errors)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), exportTimeout)
+	defer cancel()
+
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	rows := 0
+
+	flush := func() error {
+		if err := rc.SetWriteDeadline(time.Now().Add(exportWriteTimeout)); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	err = app.models.Transactions.StreamForUser(ctx, id, from, to, func(transaction data.Transaction) error {
+		if rows == 0 {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.WriteHeader(http.StatusOK)
+		}
+
+		if err := enc.Encode(transaction); err != nil {
+			return err
+		}
+
+		rows++
+		if rows%exportFlushRows == 0 {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		if rows == 0 {
+			return NewInternalError(err)
+		}
+		// The status line is already sent, the client sees a truncated stream
+		app.logger.Error("export transactions", "error", err, "rows", rows)
+		return nil
+	}
+
+	if rows == 0 {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	if err := flush(); err != nil {
+		app.logger.Error("export transactions", "error", err, "rows", rows)
+	}
+
+	return nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"math/rand/v2"
+	"simple-ledger.itmo.ru/internal/data"
+	"simple-ledger.itmo.ru/internal/flags"
+	"time"
+)
+
+const flagsReloadInterval = 30 * time.Second
+
+// reloadFeatureFlags re-reads the feature flags file every flagsReloadInterval
+func (app *application) reloadFeatureFlags() {
+	app.background(func() {
+		ticker := time.NewTicker(flagsReloadInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := app.flags.Reload(); err != nil {
+				app.logger.Error("reload feature flags", "error", err)
+			}
+		}
+	})
+}
+
+// withdrawStrategy picks the new withdrawal strategy for the configured
+// percentage of withdrawals
+func withdrawStrategy(ff flags.FeatureFlags) data.WithdrawStrategy {
+	if rand.Float64()*100 < float64(ff.NewWithdrawalStrategyPct) {
+		return data.StrategyOldestGrant
+	}
+	return data.StrategySoonestExpiring
+}
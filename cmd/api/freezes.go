@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"simple-ledger.itmo.ru/internal/data"
+)
+
+func (app *application) freezeUserHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		return NewNotFoundError()
+	}
+
+	var input struct {
+		Reason   string `json:"reason"`
+		FrozenBy string `json:"frozen_by"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		return NewBadRequestError(err)
+	}
+
+	v := app.newValidator(r)
+	v.CheckMsg(input.Reason != "", "reason", "must_be_provided", nil)
+	v.CheckMsg(input.FrozenBy != "", "frozen_by", "must_be_provided", nil)
+	if !v.Valid() {
+		return NewValidationError(v.Errors)
+	}
+
+	err = app.models.Balances.FreezeUser(r.Context(), id, input.Reason, input.FrozenBy)
+	if err != nil {
+		return NewInternalError(err)
+	}
+
+	err = app.writeJSON(w, r, http.StatusOK, map[string]any{"user_id": id, "frozen": true}, nil)
+	if err != nil {
+		return NewInternalError(err)
+	}
+
+	return nil
+}
+
+func (app *application) unfreezeUserHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		return NewNotFoundError()
+	}
+
+	err = app.models.Balances.UnfreezeUser(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return NewNotFoundError()
+		default:
+			return NewInternalError(err)
+		}
+	}
+
+	err = app.writeJSON(w, r, http.StatusOK, map[string]any{"user_id": id, "frozen": false}, nil)
+	if err != nil {
+		return NewInternalError(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReadinessHandler(t *testing.T) {
+	app := testApp(t)
+
+	tests := []struct {
+		name        string
+		healthQuery string
+		wantStatus  int
+		wantMessage string
+	}{
+		{"default", "SELECT 1", http.StatusOK, ""},
+		{"table", "SELECT 1 FROM transactions LIMIT 1", http.StatusOK, ""},
+		{"broken", "SELECT * FROM nonexistent_table", http.StatusServiceUnavailable, `relation "nonexistent_table" does not exist`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app.config.db.healthQuery = tt.healthQuery
+
+			rr := httptest.NewRecorder()
+			app.handle(app.readinessHandler).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rr.Code, tt.wantStatus)
+			}
+			if body := rr.Body.String(); !strings.Contains(body, tt.wantMessage) {
+				t.Errorf("body %s lacks %q", body, tt.wantMessage)
+			}
+		})
+	}
+}
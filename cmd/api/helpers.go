@@ -1,33 +1,113 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/google/uuid"
-	"github.com/julienschmidt/httprouter"
 	"io"
+	"mime"
 	"net/http"
+	"net/url"
+	"regexp"
+	"simple-ledger.itmo.ru/internal/data"
+	"simple-ledger.itmo.ru/internal/validator"
+	"strconv"
 	"strings"
+	"time"
 )
 
-func (app *application) readIDParam(r *http.Request) (uuid.UUID, error) {
-	params := httprouter.ParamsFromContext(r.Context())
+// ErrInvalidPathParam is returned for a missing or malformed {id} path
+// parameter, handlers respond to it with 404
+var ErrInvalidPathParam = errors.New("invalid id param")
 
-	id, err := uuid.Parse(params.ByName("id"))
-	if err != nil {
-		return uuid.Nil, errors.New("invalid id param")
+func (app *application) readIDParam(r *http.Request) (uuid.UUID, error) {
+	id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil || id == uuid.Nil {
+		return uuid.Nil, ErrInvalidPathParam
 	}
 
 	return id, nil
 }
 
-func (app *application) writeJSON(w http.ResponseWriter, status int, data any, headers http.Header) error {
+var externalUserIdRX = regexp.MustCompile(`^[a-zA-Z0-9:@._-]+$`)
+
+const maxExternalUserIdLength = 128
+
+// parseUserID converts a user identifier from a request into the UUID used
+// for storage. In external mode any caller-defined string is accepted and
+// hashed into a deterministic UUID, the original value is returned as well.
+func (app *application) parseUserID(raw string) (uuid.UUID, string, error) {
+	if app.config.userIDMode != "external" {
+		id, err := uuid.Parse(raw)
+		return id, "", err
+	}
+
+	if raw == "" || len(raw) > maxExternalUserIdLength || !validator.IsMatch(raw, externalUserIdRX) {
+		return uuid.Nil, "", errors.New("invalid external user id")
+	}
+
+	return uuid.NewSHA1(uuid.NameSpaceOID, []byte(raw)), raw, nil
+}
+
+// userIDMessage is the message key and value for a user id rejected by parseUserID
+func (app *application) userIDMessage() (string, any) {
+	if app.config.userIDMode == "external" {
+		return "must_be_external_user_id", maxExternalUserIdLength
+	}
+	return "must_be_uuid", nil
+}
+
+// checkUserID checks the user_id field of a request. An invalid user_id
+// stops validation, other errors would only hide the real problem.
+func (app *application) checkUserID(v *validator.LocalizedValidator, ok bool) {
+	key, value := app.userIDMessage()
+	v.CheckMsgFatal(ok, "user_id", key, value)
+}
+
+// checkUserIDField checks a user id sent in any other field, e.g. one
+// entry of a bulk request
+func (app *application) checkUserIDField(v *validator.LocalizedValidator, ok bool, field string) {
+	key, value := app.userIDMessage()
+	v.CheckMsg(ok, field, key, value)
+}
+
+// newValidator returns a validator speaking the language of the request
+func (app *application) newValidator(r *http.Request) *validator.LocalizedValidator {
+	return validator.NewLocalized(validator.MatchLocale(r.Header.Get("Accept-Language")))
+}
+
+// readUserIDParam reads the user identifier from the {id} path parameter
+func (app *application) readUserIDParam(r *http.Request) (uuid.UUID, string, error) {
+	id, externalId, err := app.parseUserID(r.PathValue("id"))
+	if err != nil || id == uuid.Nil {
+		return uuid.Nil, "", ErrInvalidPathParam
+	}
+
+	return id, externalId, nil
+}
+
+func (app *application) writeJSON(w http.ResponseWriter, r *http.Request, status int, data any, headers http.Header) error {
 	js, err := json.Marshal(data)
 	if err != nil {
 		return err
 	}
 
+	if app.config.jsonNamingConvention == namingCamelCase {
+		if js, err = camelCaseJSON(js); err != nil {
+			return err
+		}
+	}
+
+	if app.wantsPrettyJSON(r) {
+		var indented bytes.Buffer
+		if err = json.Indent(&indented, js, "", "  "); err != nil {
+			return err
+		}
+		js = indented.Bytes()
+	}
+
 	js = append(js, '\n')
 
 	for header, value := range headers {
@@ -44,11 +124,125 @@ func (app *application) writeJSON(w http.ResponseWriter, status int, data any, h
 	return nil
 }
 
+// wantsPrettyJSON reports whether the response must be indented, either
+// globally or because of ?pretty=1 outside production
+func (app *application) wantsPrettyJSON(r *http.Request) bool {
+	if app.config.prettyJSON {
+		return true
+	}
+	return app.config.env != "production" && r.URL.Query().Get("pretty") == "1"
+}
+
+// amountFields are the response keys encoded as data.StringInt in strict amounts mode
+var amountFields = map[string]bool{
+	"amount":           true,
+	"remaining_amount": true,
+	"balance":          true,
+	"requested_amount": true,
+	"withdrawn_amount": true,
+	"total_forfeited":  true,
+	"total_amount":     true,
+	"total_deposited":  true,
+	"total_withdrawn":  true,
+	"current_balance":  true,
+	"deposited":        true,
+	"withdrawn":        true,
+	"net_change":       true,
+	"restored_amount":  true,
+	"forfeited_amount": true,
+	"remaining_before": true,
+	"deducted":         true,
+	"remaining_after":  true,
+	"total_in_window":  true,
+	"total_expiring":   true,
+	"old_remaining":    true,
+	"new_remaining":    true,
+}
+
+// wantsStringAmounts reports whether amounts must be encoded as strings,
+// either globally or because the client sent Accept: application/json; numbers=string
+func (app *application) wantsStringAmounts(r *http.Request) bool {
+	if app.config.strictAmounts {
+		return true
+	}
+
+	for _, value := range r.Header.Values("Accept") {
+		for _, accept := range strings.Split(value, ",") {
+			mediaType, params, err := mime.ParseMediaType(accept)
+			if err == nil && mediaType == "application/json" && params["numbers"] == "string" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeAmountsJSON is writeJSON for responses carrying amounts, which are
+// quoted when the client asked for string numbers
+func (app *application) writeAmountsJSON(w http.ResponseWriter, r *http.Request, status int, data any, headers http.Header) error {
+	if app.wantsStringAmounts(r) {
+		js, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+
+		dec := json.NewDecoder(bytes.NewReader(js))
+		dec.UseNumber()
+
+		var generic any
+		if err := dec.Decode(&generic); err != nil {
+			return err
+		}
+		data = stringifyAmounts(generic)
+	}
+
+	return app.writeJSON(w, r, status, data, headers)
+}
+
+// stringifyAmounts walks a decoded JSON value and replaces amount numbers with data.StringInt
+func stringifyAmounts(value any) any {
+	switch value := value.(type) {
+	case map[string]any:
+		for key, v := range value {
+			if n, ok := v.(json.Number); ok && amountFields[key] {
+				if i, err := n.Int64(); err == nil {
+					value[key] = data.StringInt(i)
+					continue
+				}
+			}
+			value[key] = stringifyAmounts(v)
+		}
+	case []any:
+		for i, v := range value {
+			value[i] = stringifyAmounts(v)
+		}
+	}
+	return value
+}
+
 func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any) error {
 	maxBytes := 10 * 1024 // 10 Kb
 	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
 
-	dec := json.NewDecoder(r.Body)
+	var body io.Reader = r.Body
+	if app.config.jsonNamingConvention == namingCamelCase {
+		js, err := io.ReadAll(r.Body)
+		if err != nil {
+			var maxBytesError *http.MaxBytesError
+			if errors.As(err, &maxBytesError) {
+				return fmt.Errorf("body must not be larger than %d bytes", maxBytesError.Limit)
+			}
+			return err
+		}
+
+		// Malformed bodies are decoded as sent to report the usual errors
+		if converted, err := snakeCaseJSON(js); err == nil {
+			js = converted
+		}
+		body = bytes.NewReader(js)
+	}
+
+	dec := json.NewDecoder(body)
 	dec.DisallowUnknownFields()
 
 	if err := dec.Decode(dst); err != nil {
@@ -86,3 +280,108 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any
 	}
 	return nil
 }
+
+// MissingFieldsError lists required JSON keys absent from a request body
+type MissingFieldsError struct {
+	Fields []string
+}
+
+func (e *MissingFieldsError) Error() string {
+	return fmt.Sprintf("body is missing required fields: %s", strings.Join(e.Fields, ", "))
+}
+
+// readJSONRequired is readJSON that also reports, as a *MissingFieldsError,
+// every key in required that is absent from the body. Unlike the validator
+// this tells an omitted field apart from one sent with its zero value.
+func (app *application) readJSONRequired(w http.ResponseWriter, r *http.Request, dst any, required ...string) error {
+	var body bytes.Buffer
+	r.Body = io.NopCloser(io.TeeReader(r.Body, &body))
+
+	if err := app.readJSON(w, r, dst); err != nil {
+		return err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body.Bytes(), &fields); err != nil {
+		return errors.New("body must be a JSON object")
+	}
+
+	var missing []string
+	for _, name := range required {
+		if _, ok := fields[name]; ok {
+			continue
+		}
+		if _, ok := fields[app.jsonKey(name)]; !ok {
+			missing = append(missing, app.jsonKey(name))
+		}
+	}
+	if len(missing) > 0 {
+		return &MissingFieldsError{Fields: missing}
+	}
+
+	return nil
+}
+
+// readTime parses an RFC 3339 timestamp from the query string,
+// a missing value yields the zero time
+func (app *application) readTime(qs url.Values, key string, v *validator.LocalizedValidator) time.Time {
+	s := qs.Get(key)
+	if s == "" {
+		return time.Time{}
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		v.CheckMsg(false, key, "must_be_rfc3339", nil)
+		return time.Time{}
+	}
+
+	return t
+}
+
+// readDate parses a YYYY-MM-DD date (UTC midnight) from the query string,
+// a missing value yields the zero time
+func (app *application) readDate(qs url.Values, key string, v *validator.LocalizedValidator) time.Time {
+	s := qs.Get(key)
+	if s == "" {
+		return time.Time{}
+	}
+
+	t, err := time.Parse(time.DateOnly, s)
+	if err != nil {
+		v.CheckMsg(false, key, "must_be_date", nil)
+		return time.Time{}
+	}
+
+	return t
+}
+
+// readInt reads an integer from the query string, falling back to defaultValue
+func (app *application) readInt(qs url.Values, key string, defaultValue int, v *validator.LocalizedValidator) int {
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
+
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		v.CheckMsg(false, key, "must_be_integer", nil)
+		return defaultValue
+	}
+
+	return i
+}
+
+// background runs fn in a goroutine, recovering from any panic so that a
+// failing background job does not crash the server
+func (app *application) background(fn func()) {
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				app.logger.Error(fmt.Sprintf("%v", err))
+			}
+		}()
+
+		fn()
+	}()
+}
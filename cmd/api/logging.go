@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"simple-ledger.itmo.ru/internal/logfile"
+	"syscall"
+	"time"
+)
+
+// responseRecorder captures the status and size of a response. Unwrap lets
+// http.ResponseController reach the flusher of the wrapped writer.
+type responseRecorder struct {
+	http.ResponseWriter
+	status       int
+	bytesWritten int
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytesWritten += n
+	return n, err
+}
+
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// logRequest writes an access log entry for every request but health
+// checks, at WARN for 4xx and ERROR for 5xx responses. The X-Request-ID
+// header is passed through or generated.
+func (app *application) logRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		requestID := r.Header.Get("X-Request-ID")
+		if requestID == "" {
+			requestID = uuid.NewString()
+		}
+		w.Header().Set("X-Request-ID", requestID)
+
+		start := time.Now()
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		level := slog.LevelInfo
+		switch {
+		case status >= 500:
+			level = slog.LevelError
+		case status >= 400:
+			level = slog.LevelWarn
+		}
+
+		app.logger.LogAttrs(r.Context(), level, "request",
+			slog.String("method", r.Method),
+			slog.String("url", r.URL.RequestURI()),
+			slog.Int("status", status),
+			slog.Int("bytes_written", rec.bytesWritten),
+			slog.Int64("duration_ms", time.Since(start).Milliseconds()),
+			slog.String("request_id", requestID),
+			slog.String("user_agent", r.UserAgent()),
+			slog.String("remote_addr", r.RemoteAddr),
+		)
+	})
+}
+
+// openLogOutput returns the writer for -log-output. A log file is reopened
+// on SIGHUP, so logrotate can move it away.
+func openLogOutput(output string, maxSizeMB int) (io.Writer, error) {
+	switch output {
+	case "stdout":
+		return os.Stdout, nil
+	case "stderr":
+		return os.Stderr, nil
+	}
+
+	lf, err := logfile.Open(output, int64(maxSizeMB)*1024*1024)
+	if err != nil {
+		return nil, err
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := lf.Reopen(); err != nil {
+				fmt.Fprintf(os.Stderr, "reopen log file: %v\n", err)
+			}
+		}
+	}()
+
+	return lf, nil
+}
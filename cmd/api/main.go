@@ -3,81 +3,394 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
-	"net/http"
+	"github.com/lib/pq"
+	"log/slog"
+	"math/rand/v2"
+	"net/url"
 	"os"
+	"simple-ledger.itmo.ru/internal/cache"
+	"simple-ledger.itmo.ru/internal/circuit"
 	"simple-ledger.itmo.ru/internal/data"
+	"simple-ledger.itmo.ru/internal/flags"
+	"simple-ledger.itmo.ru/internal/hooks"
+	"simple-ledger.itmo.ru/internal/metrics"
+	"simple-ledger.itmo.ru/internal/pending"
+	"simple-ledger.itmo.ru/internal/ratelimit"
+	"simple-ledger.itmo.ru/internal/webhook"
+	"strings"
 	"time"
-
-	_ "github.com/lib/pq"
 )
 
 type config struct {
-	port int
-	db   struct {
-		dsn string
+	port                     int
+	logLevel                 slog.Level
+	logOutput                string
+	logMaxSizeMB             int
+	env                      string
+	prettyJSON               bool
+	jsonNamingConvention     string
+	dryRun                   bool
+	depositMultiplier        float64
+	roundingMode             data.RoundingMode
+	allowNegativeBalance     bool
+	maxDebt                  int
+	allowPartialWithdrawal   bool
+	maxSSEClients            int
+	strictAmounts            bool
+	userIDMode               string
+	maxTransactionsPerUser   int
+	pointsLifetimeDays       int
+	expiryWarningDays        int
+	statsdAddr               string
+	notificationLeadDays     int
+	lockTimeoutMs            int
+	featureFlagsFile         string
+	adminAPIKeys             string
+	testToken                string
+	premiumAPIKeys           string
+	loadThreshold            int
+	lowPriorityDelayMs       int
+	touchExpiryOnWithdrawal  bool
+	dedupCacheSize           int
+	maxDailyWithdrawalAmount int
+	maxWithdrawPerMinute     int
+	pointsPerCurrencyUnit    float64
+	maxConversionRate        float64
+	currencyCode             string
+	dedupTTL                 time.Duration
+	requireAPIKeys           bool
+	tls                      struct {
+		certFile string
+		keyFile  string
+	}
+	webhook struct {
+		url    string
+		secret string
+	}
+	db struct {
+		dsn                  string
+		replicaDSN           string
+		replicaMaxLag        time.Duration
+		maxOpenConns         int
+		maxIdleConns         int
+		connMaxLifetime      time.Duration
+		connMaxIdleTime      time.Duration
+		slowQueryThresholdMs int
+		maxRetries           int
+		initialBackoff       time.Duration
+		maxBackoff           time.Duration
+		healthQuery          string
+	}
+	timeouts struct {
+		addBonusPoints time.Duration
+		withdraw       time.Duration
+		getBalance     time.Duration
 	}
 }
 
 type application struct {
-	config config
-	logger *log.Logger
-	models data.Models
+	config             config
+	logger             *slog.Logger
+	db                 *sql.DB
+	models             data.Models
+	replica            data.Models
+	multiplier         *multiplierOverride
+	events             *broker
+	leaderboard        *cache.Cache[int, []data.LeaderboardEntry]
+	dedup              *deduplicator
+	metrics            *metrics.Registry
+	amountMetrics      *amountMetrics
+	hooks              hooks.Hooks
+	webhook            *webhook.Sender
+	dbCircuit          *circuit.Breaker
+	notifier           Notifier
+	flags              *flags.Store
+	adminKeys          map[string]string
+	pendingWithdrawals *pending.PendingSet
+	withdrawalRate     *ratelimit.SlidingWindow
 }
 
 func main() {
 	var cfg config
 
 	flag.IntVar(&cfg.port, "port", 8080, "API server port")
+	flag.StringVar(&cfg.env, "env", "production", "Environment (development|staging|production)")
+	flag.BoolVar(&cfg.prettyJSON, "pretty-json", false, "Indent JSON responses")
+	flag.StringVar(&cfg.jsonNamingConvention, "json-naming-convention", namingSnakeCase, "Casing of JSON keys in requests and responses (snake_case|camelCase)")
 	flag.StringVar(&cfg.db.dsn, "db-dsn", os.Getenv("DB_DSN"), "PostgreSQL DSN")
+	flag.StringVar(&cfg.db.replicaDSN, "db-replica-dsn", os.Getenv("DB_REPLICA_DSN"), "PostgreSQL read replica DSN for balance reads, reads use the primary when empty")
+	flag.DurationVar(&cfg.db.replicaMaxLag, "db-replica-max-lag", 5*time.Second, "How long after a write the client's balance reads go to the primary")
+	// 25 open connections stay well below PostgreSQL's default max_connections
+	// of 100 even with a few replicas. Keeping as many idle avoids reconnecting
+	// under bursty load, and recycling connections after 5 minutes lets the
+	// pool follow failovers and DNS changes.
+	flag.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "PostgreSQL max open connections")
+	flag.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "PostgreSQL max idle connections")
+	flag.DurationVar(&cfg.db.connMaxLifetime, "db-conn-max-lifetime", 5*time.Minute, "PostgreSQL max connection lifetime")
+	flag.DurationVar(&cfg.db.connMaxIdleTime, "db-conn-max-idle-time", 5*time.Minute, "PostgreSQL max connection idle time")
+	flag.IntVar(&cfg.db.maxRetries, "db-max-retries", 5, "PostgreSQL connection attempts on startup")
+	flag.DurationVar(&cfg.db.initialBackoff, "db-initial-backoff", 500*time.Millisecond, "Delay before the first PostgreSQL connection retry")
+	flag.DurationVar(&cfg.db.maxBackoff, "db-max-backoff", 10*time.Second, "Maximum delay between PostgreSQL connection retries")
+	flag.StringVar(&cfg.db.healthQuery, "db-health-query", "SELECT 1", "Statement run by /readyz, its result is discarded and only failure matters")
+	flag.DurationVar(&cfg.timeouts.addBonusPoints, "timeout-add-bonus-points", data.DefaultTimeouts.AddBonusPoints, "Database timeout of a deposit")
+	flag.DurationVar(&cfg.timeouts.withdraw, "timeout-withdraw", data.DefaultTimeouts.Withdraw, "Database timeout of a withdrawal, including lock waits")
+	flag.DurationVar(&cfg.timeouts.getBalance, "timeout-get-balance", data.DefaultTimeouts.GetBalance, "Database timeout of a balance read")
+	flag.IntVar(&cfg.db.slowQueryThresholdMs, "slow-query-threshold-ms", 100, "Log queries slower than this at DEBUG level")
+	flag.BoolVar(&cfg.dryRun, "dry-run", false, "Validate transactions without persisting them")
+	flag.Float64Var(&cfg.depositMultiplier, "deposit-multiplier", 1.0, "Multiplier applied to deposited points")
+	flag.StringVar((*string)(&cfg.roundingMode), "rounding-mode", string(data.RoundNearest), "Rounding of multiplied deposits (floor|ceil|round)")
+	flag.BoolVar(&cfg.allowNegativeBalance, "allow-negative-balance", false, "Allow withdrawals to push the balance below zero")
+	flag.IntVar(&cfg.maxDebt, "max-debt", 0, "Maximum debt when negative balance is allowed")
+	flag.BoolVar(&cfg.allowPartialWithdrawal, "allow-partial-withdrawal", false, "Allow best-effort withdrawals with \"partial\": true")
+	flag.IntVar(&cfg.maxSSEClients, "max-sse-clients", 100, "Maximum number of concurrent event stream subscribers")
+	flag.BoolVar(&cfg.strictAmounts, "strict-amounts", false, "Encode amounts in responses as strings")
+	flag.StringVar(&cfg.userIDMode, "user-id-mode", "uuid", "How user_id is interpreted (uuid|external)")
+	flag.IntVar(&cfg.pointsLifetimeDays, "points-lifetime-days", 365, "Lifetime of deposited points when lifetime_days is omitted")
+	flag.IntVar(&cfg.expiryWarningDays, "expiry-warning-days", 7, "Warn about points expiring within this many days, 0 disables the warning")
+	flag.BoolVar(&cfg.touchExpiryOnWithdrawal, "touch-expiry-on-withdrawal", false, "Extend the user's active grants to points-lifetime-days from now after each withdrawal")
+	flag.Float64Var(&cfg.maxConversionRate, "max-conversion-rate", 0.5, "Highest conversion_rate accepted when expired points are rebalanced into a new grant")
+	flag.Float64Var(&cfg.pointsPerCurrencyUnit, "points-per-currency-unit", 100.0, "Points worth one unit of currency-code, for ?currency= on balances")
+	flag.StringVar(&cfg.currencyCode, "currency-code", "USD", "Currency points are valued in")
+	flag.IntVar(&cfg.dedupCacheSize, "dedup-cache-size", 10000, "Responses kept for replaying requests with a repeated idempotency_key, 0 disables deduplication")
+	flag.DurationVar(&cfg.dedupTTL, "dedup-ttl", 24*time.Hour, "How long a response is replayed for a repeated idempotency_key")
+	flag.IntVar(&cfg.maxDailyWithdrawalAmount, "max-daily-withdrawal-amount", 0, "Maximum points a user can withdraw per calendar day, 0 disables the limit")
+	flag.IntVar(&cfg.maxWithdrawPerMinute, "max-withdraw-per-minute", 0, "Maximum withdrawals per user within any 60 seconds, 0 disables the limit")
+	flag.IntVar(&cfg.maxTransactionsPerUser, "max-transactions-per-user", 0, "Maximum active grants per user, 0 disables the limit")
+	flag.StringVar(&cfg.statsdAddr, "statsd-addr", "", "StatsD server (host:port) receiving ledger gauges, disabled when empty")
+	flag.StringVar(&cfg.tls.certFile, "tls-cert-file", "", "TLS certificate file, enables HTTPS together with tls-key-file")
+	flag.StringVar(&cfg.tls.keyFile, "tls-key-file", "", "TLS private key file")
+	flag.IntVar(&cfg.lockTimeoutMs, "lock-timeout-ms", 5000, "Maximum wait for row locks held by concurrent withdrawals, 0 waits indefinitely")
+	flag.StringVar(&cfg.featureFlagsFile, "feature-flags-file", "", "JSON file with feature flags, re-read every 30s, FEATURE_FLAGS_JSON is used when empty")
+	flag.StringVar(&cfg.adminAPIKeys, "admin-api-keys", os.Getenv("ADMIN_API_KEYS"), "Comma separated id=key pairs accepted in X-Admin-API-Key")
+	flag.StringVar(&cfg.testToken, "test-token", os.Getenv("TEST_TOKEN"), "Token required in X-Test-Token by the test endpoints outside production")
+	flag.BoolVar(&cfg.requireAPIKeys, "require-api-keys", false, "Require a user API key on user routes and an admin key on routes acting on several users")
+	flag.StringVar(&cfg.premiumAPIKeys, "premium-api-keys", os.Getenv("PREMIUM_API_KEYS"), "Comma separated API keys allowed to send X-Priority: high")
+	flag.IntVar(&cfg.loadThreshold, "load-threshold", 0, "Goroutine count above which low priority requests are delayed, 0 disables the delay")
+	flag.IntVar(&cfg.lowPriorityDelayMs, "low-priority-delay-ms", 50, "Delay of low priority requests under load")
+	flag.IntVar(&cfg.notificationLeadDays, "notification-lead-days", 3, "Notify users about points expiring within this many days")
+	flag.StringVar(&cfg.webhook.url, "webhook-url", "", "URL receiving webhook notifications")
+	flag.StringVar(&cfg.webhook.secret, "webhook-secret", os.Getenv("WEBHOOK_SECRET"), "HMAC-SHA256 key used to sign webhook payloads")
+	flag.TextVar(&cfg.logLevel, "log-level", slog.LevelInfo, "Minimum log level (DEBUG, INFO, WARN, ERROR)")
+	flag.StringVar(&cfg.logOutput, "log-output", "stdout", "Log destination (stdout|stderr|file path), a log file is reopened on SIGHUP")
+	flag.IntVar(&cfg.logMaxSizeMB, "log-max-size-mb", 0, "Roll the log file over to <path>.1 when it would exceed this size, 0 disables rolling")
 	flag.Parse()
 
-	logger := log.New(os.Stdout, "", log.Ldate|log.Ltime)
+	logOutput, err := openLogOutput(cfg.logOutput, cfg.logMaxSizeMB)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "open log output: %v\n", err)
+		os.Exit(1)
+	}
+
+	logger := slog.New(slog.NewTextHandler(logOutput, &slog.HandlerOptions{Level: cfg.logLevel}))
 
-	db, err := openDB(cfg)
+	// Exit code 2 tells configuration errors apart from startup failures
+	if err := validateConfig(cfg); err != nil {
+		errs := []error{err}
+		if joined, ok := err.(interface{ Unwrap() []error }); ok {
+			errs = joined.Unwrap()
+		}
+		for _, e := range errs {
+			logger.Error("invalid configuration", "error", e)
+		}
+		os.Exit(2)
+	}
+
+	db, err := openDB(cfg, logger)
 	if err != nil {
-		logger.Fatal(err, nil)
+		logger.Error(err.Error())
+		os.Exit(1)
 	}
 	defer db.Close()
 
+	slowQueryThreshold := time.Duration(cfg.db.slowQueryThresholdMs) * time.Millisecond
+
+	// 5 consecutive failures within 10s open the circuit for 30s
+	dbCircuit := circuit.New(5, 10*time.Second, 30*time.Second)
+	querier := newCircuitQuerier(newQueryLogger(db, logger, slowQueryThreshold), dbCircuit)
+
+	// Already validated by validateConfig
+	adminKeys, _ := parseAdminKeys(cfg.adminAPIKeys)
+
+	featureFlags, err := flags.NewStore(cfg.featureFlagsFile)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	// Balance notifications need their own connection outside the pool,
+	// opened once a client watches a balance
+	watcher := data.NewBalanceWatcher(cfg.db.dsn)
+	defer watcher.Close()
+
+	registry := metrics.NewRegistry()
+
 	app := &application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db),
+		config:             cfg,
+		logger:             logger,
+		db:                 db,
+		models:             data.NewModels(querier),
+		replica:            data.NewModels(querier),
+		multiplier:         &multiplierOverride{},
+		events:             newBroker(cfg.maxSSEClients),
+		leaderboard:        cache.New[int, []data.LeaderboardEntry](time.Minute),
+		metrics:            registry,
+		amountMetrics:      newAmountMetrics(registry),
+		hooks:              hooks.Hooks{},
+		webhook:            webhook.NewSender(cfg.webhook.url, cfg.webhook.secret),
+		dbCircuit:          dbCircuit,
+		flags:              featureFlags,
+		adminKeys:          adminKeys,
+		pendingWithdrawals: pending.New(),
+		withdrawalRate:     ratelimit.New(cfg.maxWithdrawPerMinute, time.Minute),
+	}
+
+	if cfg.db.replicaDSN != "" {
+		replicaCfg := cfg
+		replicaCfg.db.dsn = cfg.db.replicaDSN
+
+		replica, err := openDB(replicaCfg, logger)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		defer replica.Close()
+
+		app.replica = data.NewModels(newCircuitQuerier(newQueryLogger(replica, logger, slowQueryThreshold), circuit.New(5, 10*time.Second, 30*time.Second)))
 	}
 
-	srv := &http.Server{
-		Addr:         fmt.Sprintf(":%d", cfg.port),
-		Handler:      app.routes(),
-		IdleTimeout:  time.Minute,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 30 * time.Second,
+	timeouts := data.DefaultTimeouts
+	timeouts.AddBonusPoints = cfg.timeouts.addBonusPoints
+	timeouts.Withdraw = cfg.timeouts.withdraw
+	timeouts.GetBalance = cfg.timeouts.getBalance
+	app.models.Balances.Timeouts = timeouts
+	app.replica.Balances.Timeouts = timeouts
+	app.models.Balances.Watcher = watcher
+
+	if cfg.dedupCacheSize > 0 {
+		app.dedup = newDeduplicator(cfg.dedupCacheSize, cfg.dedupTTL)
+	}
+
+	app.collectDBStats(db)
+
+	if cfg.featureFlagsFile != "" {
+		app.reloadFeatureFlags()
 	}
 
-	logger.Printf("starting server on %s", srv.Addr)
-	err = srv.ListenAndServe()
-	logger.Fatal(err)
+	// Expiry notifications are delivered through the webhook
+	if cfg.webhook.url != "" {
+		app.notifier = webhookNotifier{sender: app.webhook}
+		app.processExpiryNotifications()
+		app.processExpiryReminders()
+	}
+
+	if cfg.statsdAddr != "" {
+		statsd, err := metrics.NewStatsD(cfg.statsdAddr)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		defer statsd.Close()
+
+		app.pushStatsD(statsd)
+	}
+
+	err = app.serve()
+	logger.Error(err.Error())
+	os.Exit(1)
 }
 
-func openDB(cfg config) (*sql.DB, error) {
+func openDB(cfg config, logger *slog.Logger) (*sql.DB, error) {
+	if err := validateDSN(cfg.db.dsn); err != nil {
+		return nil, err
+	}
+
 	db, err := sql.Open("postgres", cfg.db.dsn)
 	if err != nil {
 		return nil, err
 	}
 
+	err = pingWithRetry(db.PingContext, cfg, logger)
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	db.SetMaxOpenConns(cfg.db.maxOpenConns)
+	db.SetMaxIdleConns(cfg.db.maxIdleConns)
+	db.SetConnMaxLifetime(cfg.db.connMaxLifetime)
+	db.SetConnMaxIdleTime(cfg.db.connMaxIdleTime)
+
+	return db, nil
+}
+
+// validateDSN reports an unusable connection string before the driver does,
+// sql.Open accepts anything and the failure would only surface on ping.
+// Both the URL and the key=value form of lib/pq are accepted.
+func validateDSN(dsn string) error {
+	if dsn == "" {
+		return errors.New("missing DSN, set DB_DSN or -db-dsn")
+	}
+
+	if !strings.Contains(dsn, "://") {
+		if _, err := pq.NewConnector(dsn); err != nil {
+			return fmt.Errorf("invalid DSN: %w", err)
+		}
+		return nil
+	}
 
-	err = db.PingContext(ctx)
+	u, err := url.Parse(dsn)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("invalid DSN: %w", err)
 	}
 
-	return db, nil
+	if u.Scheme != "postgres" && u.Scheme != "postgresql" {
+		return fmt.Errorf("invalid DSN scheme %q, must be postgres or postgresql", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return errors.New("missing host in DSN")
+	}
+	if strings.Trim(u.Path, "/") == "" {
+		return errors.New("missing database name in DSN")
+	}
+
+	return nil
+}
+
+// sleep waits between ping attempts, tests replace it to skip the waits
+var sleep = time.Sleep
+
+// pingWithRetry calls ping up to cfg.db.maxRetries times. The delay between
+// attempts grows exponentially from initialBackoff up to maxBackoff, with
+// full jitter so that restarted replicas do not retry in lockstep.
+func pingWithRetry(ping func(ctx context.Context) error, cfg config, logger *slog.Logger) error {
+	start := time.Now()
+	backoff := cfg.db.initialBackoff
+
+	var err error
+	for attempt := 1; attempt <= cfg.db.maxRetries; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err = ping(ctx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+
+		logger.Warn("database ping failed",
+			"attempt", attempt,
+			"elapsed", time.Since(start),
+			"error", err,
+		)
+
+		if attempt == cfg.db.maxRetries {
+			break
+		}
+
+		sleep(rand.N(backoff + 1))
+		backoff = min(backoff*2, cfg.db.maxBackoff)
+	}
+
+	return err
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"simple-ledger.itmo.ru/internal/data"
+	"simple-ledger.itmo.ru/internal/metrics"
+	"time"
+)
+
+const dbStatsInterval = 15 * time.Second
+
+type dbMetrics struct {
+	maxOpen           *metrics.Gauge
+	open              *metrics.Gauge
+	inUse             *metrics.Gauge
+	idle              *metrics.Gauge
+	waitCount         *metrics.Counter
+	waitDuration      *metrics.Counter
+	maxIdleClosed     *metrics.Counter
+	maxLifetimeClosed *metrics.Counter
+}
+
+func newDBMetrics(registry *metrics.Registry) *dbMetrics {
+	return &dbMetrics{
+		maxOpen:           registry.NewGauge("ledger_db_connections_max_open", "Maximum number of open connections to the database."),
+		open:              registry.NewGauge("ledger_db_connections_open", "The number of established connections both in use and idle."),
+		inUse:             registry.NewGauge("ledger_db_connections_in_use", "The number of connections currently in use."),
+		idle:              registry.NewGauge("ledger_db_connections_idle", "The number of idle connections."),
+		waitCount:         registry.NewCounter("ledger_db_wait_count_total", "The total number of connections waited for."),
+		waitDuration:      registry.NewCounter("ledger_db_wait_duration_seconds_total", "The total time blocked waiting for a new connection."),
+		maxIdleClosed:     registry.NewCounter("ledger_db_max_idle_closed_total", "The total number of connections closed due to SetMaxIdleConns."),
+		maxLifetimeClosed: registry.NewCounter("ledger_db_max_lifetime_closed_total", "The total number of connections closed due to SetConnMaxLifetime."),
+	}
+}
+
+func (m *dbMetrics) update(stats sql.DBStats) {
+	m.maxOpen.Set(float64(stats.MaxOpenConnections))
+	m.open.Set(float64(stats.OpenConnections))
+	m.inUse.Set(float64(stats.InUse))
+	m.idle.Set(float64(stats.Idle))
+	m.waitCount.Set(float64(stats.WaitCount))
+	m.waitDuration.Set(stats.WaitDuration.Seconds())
+	m.maxIdleClosed.Set(float64(stats.MaxIdleClosed))
+	m.maxLifetimeClosed.Set(float64(stats.MaxLifetimeClosed))
+}
+
+var amountBuckets = []float64{10, 50, 100, 500, 1000, 5000, 10000}
+
+// amountMetrics tracks the distribution of transaction amounts
+type amountMetrics struct {
+	deposit    *metrics.Histogram
+	withdrawal *metrics.Histogram
+}
+
+func newAmountMetrics(registry *metrics.Registry) *amountMetrics {
+	return &amountMetrics{
+		deposit:    registry.NewHistogram("ledger_deposit_amount_histogram", "Points added by successful deposits.", amountBuckets),
+		withdrawal: registry.NewHistogram("ledger_withdrawal_amount_histogram", "Points removed by successful withdrawals.", amountBuckets),
+	}
+}
+
+const statsdInterval = 30 * time.Second
+
+// pushStatsD sends the system totals as gauges to the StatsD server every
+// statsdInterval
+func (app *application) pushStatsD(client *metrics.StatsD) {
+	app.background(func() {
+		ticker := time.NewTicker(statsdInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			totals, err := app.models.Transactions.GetSystemTotals(context.Background())
+			if err != nil {
+				app.logger.Error("get system totals", "error", err)
+				continue
+			}
+			app.pushTotals(client, totals)
+		}
+	})
+}
+
+// pushTotals sends totals as StatsD gauges, failed sends are only logged
+func (app *application) pushTotals(client *metrics.StatsD, totals *data.SystemTotals) {
+	gauges := map[string]int{
+		"ledger.balance.total":        totals.Balance,
+		"ledger.users.active":         totals.ActiveUsers,
+		"ledger.points.expiring_soon": totals.ExpiringSoon,
+	}
+	for name, value := range gauges {
+		if err := client.Gauge(name, float64(value)); err != nil {
+			app.logger.Warn("push statsd gauge", "name", name, "error", err)
+		}
+	}
+}
+
+// collectDBStats refreshes the connection pool metrics every dbStatsInterval
+func (app *application) collectDBStats(db *sql.DB) {
+	m := newDBMetrics(app.metrics)
+	m.update(db.Stats())
+
+	app.background(func() {
+		ticker := time.NewTicker(dbStatsInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			m.update(db.Stats())
+		}
+	})
+}
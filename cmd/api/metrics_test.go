@@ -0,0 +1,49 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"simple-ledger.itmo.ru/internal/data"
+	"simple-ledger.itmo.ru/internal/metrics"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPushTotals(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := metrics.NewStatsD(server.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	app := &application{logger: slog.New(slog.DiscardHandler)}
+	app.pushTotals(client, &data.SystemTotals{Balance: 15230, ActiveUsers: 42, ExpiringSoon: 700})
+
+	var got []string
+	buf := make([]byte, 512)
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for range 3 {
+		n, _, err := server.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(buf[:n]))
+	}
+	slices.Sort(got)
+
+	want := []string{
+		"ledger.balance.total:15230|g",
+		"ledger.points.expiring_soon:700|g",
+		"ledger.users.active:42|g",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("received %q, want %q", got, want)
+	}
+}
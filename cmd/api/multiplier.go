@@ -0,0 +1,90 @@
+package main
+
+import (
+	"github.com/google/uuid"
+	"net/http"
+	"simple-ledger.itmo.ru/internal/data"
+	"sync"
+	"time"
+)
+
+// multiplierOverride is a time-limited deposit multiplier set through the
+// admin API, it takes precedence over config.depositMultiplier until it expires
+type multiplierOverride struct {
+	mu        sync.RWMutex
+	value     float64
+	expiresAt time.Time
+}
+
+func (m *multiplierOverride) set(value float64, expiresAt time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.value = value
+	m.expiresAt = expiresAt
+}
+
+// get returns the override and whether it is still active
+func (m *multiplierOverride) get() (float64, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if time.Now().Before(m.expiresAt) {
+		return m.value, true
+	}
+	return 0, false
+}
+
+// depositMultiplier returns the multiplier applied to deposits right now
+func (app *application) depositMultiplier() float64 {
+	if value, ok := app.multiplier.get(); ok {
+		return value
+	}
+	return app.config.depositMultiplier
+}
+
+// multiplyDeposit applies multiplier to a deposit of amount for userId
+func (app *application) multiplyDeposit(userId uuid.UUID, amount int, multiplier float64) int {
+	multiplied := app.applyMultiplier(amount, multiplier)
+	app.logger.Debug("deposit multiplier applied",
+		"user_id", userId,
+		"original_amount", amount,
+		"multiplier", multiplier,
+		"rounding_mode", app.config.roundingMode,
+		"amount", multiplied,
+	)
+	return multiplied
+}
+
+// applyMultiplier returns amount multiplied and rounded with the configured rounding mode
+func (app *application) applyMultiplier(amount int, multiplier float64) int {
+	return data.RoundAmount(amount, multiplier, app.config.roundingMode)
+}
+
+func (app *application) setMultiplierHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	var input struct {
+		Multiplier float64   `json:"multiplier"`
+		ExpiresAt  time.Time `json:"expires_at"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		return NewBadRequestError(err)
+	}
+
+	v := app.newValidator(r)
+	v.CheckMsg(input.Multiplier > 0, "multiplier", "must_be_positive", nil)
+	v.CheckMsg(!input.ExpiresAt.IsZero(), "expires_at", "must_be_provided", nil)
+	v.CheckMsg(input.ExpiresAt.After(time.Now()), "expires_at", "must_be_in_future", nil)
+	if !v.Valid() {
+		return NewValidationError(v.Errors)
+	}
+
+	app.multiplier.set(input.Multiplier, input.ExpiresAt)
+
+	err = app.writeJSON(w, r, http.StatusOK, input, nil)
+	if err != nil {
+		return NewInternalError(err)
+	}
+
+	return nil
+}
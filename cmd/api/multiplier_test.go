@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"github.com/google/uuid"
+	"log/slog"
+	"simple-ledger.itmo.ru/internal/data"
+	"strings"
+	"testing"
+)
+
+func TestMultiplyDeposit(t *testing.T) {
+	tests := []struct {
+		mode data.RoundingMode
+		want int
+	}{
+		{data.RoundFloor, 148},
+		{data.RoundCeil, 149},
+		{data.RoundNearest, 149},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			var logs bytes.Buffer
+			app := &application{
+				config: config{roundingMode: tt.mode},
+				logger: slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})),
+			}
+
+			if got := app.multiplyDeposit(uuid.New(), 99, 1.5); got != tt.want {
+				t.Errorf("99 points at 1.5x = %d, want %d", got, tt.want)
+			}
+			if !strings.Contains(logs.String(), "rounding_mode="+string(tt.mode)) {
+				t.Errorf("rounding mode not logged: %s", logs.String())
+			}
+		})
+	}
+}
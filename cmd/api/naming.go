@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"unicode"
+)
+
+const (
+	namingSnakeCase = "snake_case"
+	namingCamelCase = "camelCase"
+)
+
+// camelCaseJSON re-encodes js with every object key in camelCase. Keys
+// that are data rather than field names (e.g. category names) are
+// converted as well.
+func camelCaseJSON(js []byte) ([]byte, error) {
+	return renameJSONKeys(js, snakeToCamel)
+}
+
+// snakeCaseJSON re-encodes js with every object key in snake_case, keys
+// already in snake_case stay as they are
+func snakeCaseJSON(js []byte) ([]byte, error) {
+	return renameJSONKeys(js, camelToSnake)
+}
+
+func renameJSONKeys(js []byte, rename func(string) string) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+
+	var generic any
+	if err := dec.Decode(&generic); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(renameKeys(generic, rename))
+}
+
+// renameKeys walks a decoded JSON value and renames the keys of its objects
+func renameKeys(value any, rename func(string) string) any {
+	switch value := value.(type) {
+	case map[string]any:
+		renamed := make(map[string]any, len(value))
+		for key, v := range value {
+			renamed[rename(key)] = renameKeys(v, rename)
+		}
+		return renamed
+	case []any:
+		for i, v := range value {
+			value[i] = renameKeys(v, rename)
+		}
+	}
+	return value
+}
+
+// snakeToCamel converts user_id to userId
+func snakeToCamel(s string) string {
+	parts := strings.Split(s, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+// camelToSnake converts userId to user_id
+func camelToSnake(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// jsonKey returns the snake_case key name in the configured convention
+func (app *application) jsonKey(name string) string {
+	if app.config.jsonNamingConvention == namingCamelCase {
+		return snakeToCamel(name)
+	}
+	return name
+}
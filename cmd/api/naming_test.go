@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestKeyConversion(t *testing.T) {
+	tests := []struct {
+		snake string
+		camel string
+	}{
+		{"balance", "balance"},
+		{"user_id", "userId"},
+		{"remaining_amount", "remainingAmount"},
+		{"external_user_id", "externalUserId"},
+	}
+
+	for _, tt := range tests {
+		if got := snakeToCamel(tt.snake); got != tt.camel {
+			t.Errorf("snakeToCamel(%q) = %q, want %q", tt.snake, got, tt.camel)
+		}
+		if got := camelToSnake(tt.camel); got != tt.snake {
+			t.Errorf("camelToSnake(%q) = %q, want %q", tt.camel, got, tt.snake)
+		}
+		if got := camelToSnake(tt.snake); got != tt.snake {
+			t.Errorf("camelToSnake(%q) = %q, want it unchanged", tt.snake, got)
+		}
+	}
+}
+
+func TestWriteJSONNamingConvention(t *testing.T) {
+	balance := map[string]any{
+		"user_id": "4f0c6a1e-8f3b-4a57-9c55-0c4b3c2b9b1e",
+		"balance": 100,
+		"expirations": []map[string]any{
+			{"amount": 100, "expires_at": "2025-07-01T00:00:00Z"},
+		},
+	}
+
+	tests := []struct {
+		convention string
+		want       []string
+		notWant    []string
+	}{
+		{namingSnakeCase, []string{`"user_id"`, `"expires_at"`}, []string{`"userId"`, `"expiresAt"`}},
+		{namingCamelCase, []string{`"userId"`, `"expiresAt"`}, []string{`"user_id"`, `"expires_at"`}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.convention, func(t *testing.T) {
+			app := &application{config: config{jsonNamingConvention: tt.convention}}
+
+			rr := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/v1/users/1/balance", nil)
+			if err := app.writeJSON(rr, r, http.StatusOK, balance, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			body := rr.Body.String()
+			for _, key := range tt.want {
+				if !strings.Contains(body, key) {
+					t.Errorf("body %s lacks %s", body, key)
+				}
+			}
+			for _, key := range tt.notWant {
+				if strings.Contains(body, key) {
+					t.Errorf("body %s contains %s", body, key)
+				}
+			}
+		})
+	}
+}
+
+func TestReadJSONNamingConvention(t *testing.T) {
+	tests := []struct {
+		convention string
+		body       string
+		wantErr    bool
+	}{
+		{namingSnakeCase, `{"user_id": "a", "lifetime_days": 7}`, false},
+		{namingSnakeCase, `{"userId": "a", "lifetimeDays": 7}`, true},
+		{namingCamelCase, `{"userId": "a", "lifetimeDays": 7}`, false},
+		{namingCamelCase, `{"user_id": "a", "lifetime_days": 7}`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.convention+" "+tt.body, func(t *testing.T) {
+			app := &application{config: config{jsonNamingConvention: tt.convention}}
+
+			var dst struct {
+				UserId       string `json:"user_id"`
+				LifetimeDays int    `json:"lifetime_days"`
+			}
+			r := httptest.NewRequest(http.MethodPost, "/v1/transactions", strings.NewReader(tt.body))
+			err := app.readJSON(httptest.NewRecorder(), r, &dst)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readJSON = %v, want error %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && (dst.UserId != "a" || dst.LifetimeDays != 7) {
+				t.Errorf("decoded %+v", dst)
+			}
+		})
+	}
+}
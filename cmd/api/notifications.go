@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"simple-ledger.itmo.ru/internal/data"
+	"simple-ledger.itmo.ru/internal/webhook"
+	"time"
+)
+
+const (
+	notificationInterval = 24 * time.Hour
+	reminderInterval     = time.Hour
+)
+
+// Notifier delivers a message to a user through some external channel
+type Notifier interface {
+	Notify(userID, message string) error
+}
+
+// webhookNotifier delivers notifications by posting them to the webhook URL
+type webhookNotifier struct {
+	sender *webhook.Sender
+}
+
+func (n webhookNotifier) Notify(userID, message string) error {
+	payload, err := json.Marshal(map[string]string{"user_id": userID, "message": message})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	return n.sender.Send(ctx, payload)
+}
+
+// processExpiryNotifications warns users about points expiring within
+// notificationLeadDays days, once at startup and then daily
+func (app *application) processExpiryNotifications() {
+	app.background(func() {
+		ticker := time.NewTicker(notificationInterval)
+		defer ticker.Stop()
+
+		for {
+			if err := app.sendExpiryWarnings(context.Background()); err != nil {
+				app.logger.Error("send expiry warnings", "error", err)
+			}
+			<-ticker.C
+		}
+	})
+}
+
+func (app *application) sendExpiryWarnings(ctx context.Context) error {
+	expiring, err := app.models.Notifications.ListUnnotifiedExpiring(ctx, app.config.notificationLeadDays)
+	if err != nil {
+		return err
+	}
+
+	for _, points := range expiring {
+		notification, err := app.models.Notifications.CreatePending(ctx, points.UserId, data.NotificationExpiryWarning, points.Points, points.ExpiresOn)
+		if err != nil {
+			if errors.Is(err, data.ErrRecordNotFound) {
+				// Created by a concurrent run
+				continue
+			}
+			return err
+		}
+
+		message := fmt.Sprintf("%d points expire on %s", points.Points, points.ExpiresOn.Format(time.DateOnly))
+
+		status := "sent"
+		if err := app.notifier.Notify(points.UserId.String(), message); err != nil {
+			app.logger.Warn("deliver notification", "id", notification.Id, "error", err)
+			status = "failed"
+		}
+
+		if err := app.models.Notifications.SetDeliveryStatus(ctx, notification.Id, status); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// processExpiryReminders warns users about each grant the day before it
+// expires, checking every hour
+func (app *application) processExpiryReminders() {
+	app.background(func() {
+		ticker := time.NewTicker(reminderInterval)
+		defer ticker.Stop()
+
+		for {
+			if err := app.sendExpiryReminders(context.Background()); err != nil {
+				app.logger.Error("send expiry reminders", "error", err)
+			}
+			<-ticker.C
+		}
+	})
+}
+
+func (app *application) sendExpiryReminders(ctx context.Context) error {
+	grants, err := app.models.Transactions.GetGrantsExpiringTomorrow(ctx)
+	if err != nil {
+		return err
+	}
+
+	var warned []uuid.UUID
+	for _, grant := range grants {
+		message := fmt.Sprintf("%d points expire at %s", grant.Amount, grant.ExpiresAt.UTC().Format(time.RFC3339))
+
+		// Undelivered reminders are retried on the next run
+		if err := app.notifier.Notify(grant.UserId.String(), message); err != nil {
+			app.logger.Warn("deliver expiry reminder", "transaction_id", grant.Id, "error", err)
+			continue
+		}
+		warned = append(warned, grant.Id)
+	}
+
+	if len(warned) == 0 {
+		return nil
+	}
+
+	return app.models.Transactions.MarkWarned(ctx, warned)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// deprioritize delays requests of regular clients by lowPriorityDelayMs
+// while the server is under load, measured as more than loadThreshold
+// goroutines. Requests with X-Priority: high and a premium key in X-API-Key
+// are never delayed. A zero loadThreshold disables the delay.
+func (app *application) deprioritize(next http.Handler) http.Handler {
+	delay := time.Duration(app.config.lowPriorityDelayMs) * time.Millisecond
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.config.loadThreshold > 0 && !app.isHighPriority(r) && runtime.NumGoroutine() > app.config.loadThreshold {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (app *application) isHighPriority(r *http.Request) bool {
+	if r.Header.Get("X-Priority") != "high" {
+		return false
+	}
+
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		return false
+	}
+
+	given := sha256.Sum256([]byte(key))
+	for premium := range strings.SplitSeq(app.config.premiumAPIKeys, ",") {
+		expected := sha256.Sum256([]byte(strings.TrimSpace(premium)))
+		if premium != "" && subtle.ConstantTimeCompare(given[:], expected[:]) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,17 +1,107 @@
 package main
 
 import (
-	"github.com/julienschmidt/httprouter"
 	"net/http"
+	"simple-ledger.itmo.ru/internal/data"
 )
 
-func (app *application) routes() *httprouter.Router {
-	router := httprouter.New()
+func (app *application) routes() http.Handler {
+	mux := http.NewServeMux()
 
-	router.NotFound = http.HandlerFunc(app.notFoundResponse)
-	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
-	router.HandlerFunc(http.MethodPost, "/v1/transactions", app.createTransactionHandler)
-	router.HandlerFunc(http.MethodGet, "/v1/users/:id/balance", app.showUserBalanceHandler)
+	mux.Handle("POST /v1/transactions", app.handle(app.requireUserKey(data.ScopeWrite, app.createTransactionHandler)))
+	mux.Handle("POST /v1/transactions/bulk", app.handle(app.requireServiceKey(app.createBulkTransactionsHandler)))
+	mux.Handle("POST /v1/transactions/{id}/revert", app.handle(app.requireServiceKey(app.revertWithdrawalHandler)))
+	mux.Handle("GET /v1/users/{id}/balance", app.handle(app.requireUserKey(data.ScopeRead, app.showUserBalanceHandler)))
+	mux.Handle("POST /v1/users/balances", app.handle(app.requireServiceKey(app.showUserBalancesHandler)))
+	mux.Handle("GET /v1/users/{id}/balance-history", app.handle(app.requireUserKey(data.ScopeRead, app.showBalanceHistoryHandler)))
+	mux.Handle("GET /v1/users/{id}/transactions", app.handle(app.requireUserKey(data.ScopeRead, app.listUserTransactionsHandler)))
+	mux.Handle("POST /v1/users/{id}/simulate-withdrawal", app.handle(app.requireUserKey(data.ScopeRead, app.simulateWithdrawalHandler)))
+	mux.Handle("POST /v1/users/{id}/rebalance-expired", app.handle(app.requireServiceKey(app.rebalanceExpiredHandler)))
+	mux.Handle("GET /v1/users/{id}/retention", app.handle(app.requireUserKey(data.ScopeRead, app.showRetentionScoreHandler)))
+	mux.Handle("GET /v1/users/{id}/velocity", app.handle(app.requireUserKey(data.ScopeRead, app.showEarningVelocityHandler)))
+	mux.Handle("GET /v1/users/{id}/summary", app.handle(app.requireUserKey(data.ScopeRead, app.showTransactionSummaryHandler)))
+	mux.Handle("GET /v1/users/{id}/transactions.ndjson", app.handle(app.requireUserKey(data.ScopeRead, app.exportTransactionsHandler)))
+	mux.Handle("POST /v1/users/{id}/snapshots", app.handle(app.requireUserKey(data.ScopeWrite, app.createSnapshotHandler)))
+	mux.Handle("GET /v1/users/{id}/snapshots", app.handle(app.requireUserKey(data.ScopeRead, app.listSnapshotsHandler)))
+	mux.Handle("GET /v1/events", app.handle(app.requireEventsKey(app.eventsHandler)))
+	mux.Handle("GET /healthz", app.handle(app.healthcheckHandler))
+	mux.Handle("GET /readyz", app.handle(app.readinessHandler))
+	mux.Handle("GET /metrics", app.metrics.Handler())
 
-	return router
+	mux.Handle("POST /v1/admin/users/{id}/api-keys", app.handle(app.requireAdminKey(app.createAPIKeyHandler)))
+	mux.Handle("POST /v1/admin/users/{id}/freeze", app.handle(app.requireAdminKey(app.freezeUserHandler)))
+	mux.Handle("POST /v1/admin/users/{id}/unfreeze", app.handle(app.requireAdminKey(app.unfreezeUserHandler)))
+	mux.Handle("GET /v1/admin/users/{id}/active-transactions", app.handle(app.requireAdminKey(app.listActiveTransactionsHandler)))
+	mux.Handle("POST /v1/admin/users/{id}/expire-all", app.handle(app.requireAdminKey(app.expireAllHandler)))
+	mux.Handle("GET /v1/admin/analytics/gini", app.handle(app.requireAdminKey(app.showGiniHandler)))
+	mux.Handle("POST /v1/admin/bulk-withdrawals", app.handle(app.requireAdminKey(app.bulkWithdrawalsHandler)))
+	mux.Handle("POST /v1/admin/categories/{category}/expire", app.handle(app.requireAdminKey(app.expireCategoryHandler)))
+	mux.Handle("POST /v1/admin/multiplier", app.handle(app.requireAdminKey(app.setMultiplierHandler)))
+	mux.Handle("GET /v1/admin/leaderboard", app.handle(app.requireAdminKey(app.showLeaderboardHandler)))
+	mux.Handle("GET /v1/admin/top-spenders", app.handle(app.requireAdminKey(app.showTopSpendersHandler)))
+	mux.Handle("GET /v1/admin/transactions", app.handle(app.requireAdminKey(app.listTransactionsHandler)))
+	mux.Handle("POST /v1/admin/transactions/reassign", app.handle(app.requireAdminKey(app.reassignTransactionsHandler)))
+	mux.Handle("POST /v1/admin/transactions/cancel-range", app.handle(app.requireAdminKey(app.cancelDateRangeHandler)))
+	mux.Handle("GET /v1/admin/transactions/expired", app.handle(app.requireAdminKey(app.listExpiredTransactionsHandler)))
+	mux.Handle("GET /v1/admin/transactions/{id}/audit-log", app.handle(app.requireAdminKey(app.showAuditLogHandler)))
+	mux.Handle("GET /v1/admin/expiring-users", app.handle(app.requireAdminKey(app.listExpiringUsersHandler)))
+	mux.Handle("GET /v1/admin/expiry-forecast", app.handle(app.requireAdminKey(app.showExpiryForecastHandler)))
+	mux.Handle("GET /v1/admin/reports/summary", app.handle(app.requireAdminKey(app.showReportSummaryHandler)))
+	mux.Handle("GET /v1/admin/tags", app.handle(app.requireAdminKey(app.showTagSummaryHandler)))
+	mux.Handle("POST /v1/admin/users/migrate", app.handle(app.requireAdminKey(app.migrateUserHandler)))
+	mux.Handle("GET /v1/admin/users/{id}/impersonate/balance", app.handle(app.requireAdminKey(app.impersonate(app.showUserBalanceHandler))))
+	mux.Handle("GET /v1/admin/users/{id}/impersonate/transactions", app.handle(app.requireAdminKey(app.impersonate(app.exportTransactionsHandler))))
+
+	mux.Handle("DELETE /v1/test/users/{id}", app.handle(app.deleteTestUserHandler))
+
+	return app.logRequest(app.deprioritize(app.jsonRouteErrors(mux)))
+}
+
+// jsonRouteErrors replaces the plain text 404 and 405 responses of the mux
+// with the JSON error responses used by the handlers
+func (app *application) jsonRouteErrors(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h, pattern := mux.Handler(r)
+		if pattern != "" {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		// Without a pattern the mux answers itself, run it against a
+		// discarding writer to find out with which status
+		capture := &statusCapture{header: make(http.Header)}
+		h.ServeHTTP(capture, r)
+
+		switch capture.status {
+		case http.StatusNotFound:
+			app.errorResponse(w, r, NewNotFoundError())
+		case http.StatusMethodNotAllowed:
+			w.Header().Set("Allow", capture.header.Get("Allow"))
+			app.errorResponse(w, r, NewMethodNotAllowedError(r.Method))
+		default:
+			mux.ServeHTTP(w, r)
+		}
+	})
+}
+
+type statusCapture struct {
+	header http.Header
+	status int
+}
+
+func (c *statusCapture) Header() http.Header {
+	return c.header
+}
+
+func (c *statusCapture) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	return len(b), nil
+}
+
+func (c *statusCapture) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
 }
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// serve runs the API server until it fails. With TLS configured the API is
+// served over HTTPS (HTTP/2 is negotiated automatically) and a second plain
+// HTTP server on port+1 redirects clients to it.
+func (app *application) serve() error {
+	srv := &http.Server{
+		Addr:         fmt.Sprintf(":%d", app.config.port),
+		Handler:      app.routes(),
+		IdleTimeout:  time.Minute,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+
+	if !app.tlsEnabled() {
+		app.logger.Info("starting server", "addr", srv.Addr)
+		return srv.ListenAndServe()
+	}
+
+	srv.TLSConfig = &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		// Only AEAD suites with forward secrecy, TLS 1.3 suites are not configurable
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+	}
+
+	redirect := &http.Server{
+		Addr:         fmt.Sprintf(":%d", app.config.port+1),
+		Handler:      app.redirectToHTTPS(),
+		IdleTimeout:  time.Minute,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+
+	app.background(func() {
+		app.logger.Info("starting redirect server", "addr", redirect.Addr)
+		if err := redirect.ListenAndServe(); err != nil {
+			app.logger.Error("redirect server", "error", err)
+		}
+	})
+
+	app.logger.Info("starting server", "addr", srv.Addr, "tls", true)
+	return srv.ListenAndServeTLS(app.config.tls.certFile, app.config.tls.keyFile)
+}
+
+func (app *application) tlsEnabled() bool {
+	return app.config.tls.certFile != "" && app.config.tls.keyFile != ""
+}
+
+// redirectToHTTPS sends every request to the same host and path on the TLS port
+func (app *application) redirectToHTTPS() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+
+		target := "https://" + net.JoinHostPort(host, strconv.Itoa(app.config.port)) + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"unicode/utf8"
+)
+
+func (app *application) createSnapshotHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	id, _, err := app.readUserIDParam(r)
+	if err != nil {
+		return NewNotFoundError()
+	}
+
+	var input struct {
+		Label string `json:"label"`
+	}
+	// The body is optional, a snapshot without a label is fine
+	if r.ContentLength != 0 {
+		err = app.readJSON(w, r, &input)
+		if err != nil {
+			return NewBadRequestError(err)
+		}
+	}
+
+	v := app.newValidator(r)
+	v.CheckMsg(utf8.RuneCountInString(input.Label) <= 100, "label", "must_not_be_longer_than", 100)
+	if !v.Valid() {
+		return NewValidationError(v.Errors)
+	}
+
+	snapshot, err := app.models.Transactions.CreateSnapshot(r.Context(), id, input.Label)
+	if err != nil {
+		return NewInternalError(err)
+	}
+
+	err = app.writeAmountsJSON(w, r, http.StatusCreated, snapshot, nil)
+	if err != nil {
+		return NewInternalError(err)
+	}
+
+	return nil
+}
+
+func (app *application) listSnapshotsHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	id, _, err := app.readUserIDParam(r)
+	if err != nil {
+		return NewNotFoundError()
+	}
+
+	snapshots, err := app.models.Transactions.ListSnapshots(r.Context(), id)
+	if err != nil {
+		return NewInternalError(err)
+	}
+
+	err = app.writeAmountsJSON(w, r, http.StatusOK, map[string]any{"snapshots": snapshots}, nil)
+	if err != nil {
+		return NewInternalError(err)
+	}
+
+	return nil
+}
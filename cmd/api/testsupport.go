@@ -0,0 +1,35 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// deleteTestUserHandler wipes a user so that integration tests in staging
+// start from a clean state. It is refused in production and requires the
+// X-Test-Token header to match -test-token.
+func (app *application) deleteTestUserHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	if app.config.env == "production" {
+		return NewForbiddenError("test endpoints are disabled in production")
+	}
+
+	token := r.Header.Get("X-Test-Token")
+	if app.config.testToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(app.config.testToken)) != 1 {
+		return NewForbiddenError("invalid or missing X-Test-Token")
+	}
+
+	id, err := app.readIDParam(r)
+	if err != nil {
+		return NewNotFoundError()
+	}
+
+	if err := app.models.Transactions.DeleteAllForUser(r.Context(), id); err != nil {
+		return NewInternalError(err)
+	}
+
+	app.logger.Warn("test user deleted", "user_id", id)
+	app.setReadAfter(w)
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
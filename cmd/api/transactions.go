@@ -1,73 +1,287 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/google/uuid"
+	"hash/fnv"
+	"math"
 	"net/http"
 	"simple-ledger.itmo.ru/internal/data"
+	"simple-ledger.itmo.ru/internal/ratelimit"
 	"simple-ledger.itmo.ru/internal/validator"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type transactionIn struct {
-	UserId       string `json:"user_id"`
-	Amount       int    `json:"amount"`
-	Type         string `json:"type"`
-	LifetimeDays int    `json:"lifetime_days,omitempty"`
+	UserId       string               `json:"user_id"`
+	Amount       int                  `json:"amount"`
+	Type         data.TransactionType `json:"type"`
+	LifetimeDays int                  `json:"lifetime_days,omitempty"`
+	Category     string               `json:"category,omitempty"`
+	Tags         []string             `json:"tags,omitempty"`
+	Partial      bool                 `json:"partial,omitempty"`
+	// ConditionalMaxBalance makes a deposit only succeed while the balance
+	// is below it
+	ConditionalMaxBalance *int `json:"conditional_max_balance,omitempty"`
+	// IdempotencyKey makes retries of the same request return the
+	// response of the first one
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
 }
 
-func (app *application) createTransactionHandler(w http.ResponseWriter, r *http.Request) {
+var (
+	ErrInvalidAmount       = errors.New("amount must be a whole number")
+	ErrInvalidLifetimeDays = errors.New("lifetime_days must be a whole number")
+)
+
+// UnmarshalJSON decodes amount and lifetime_days as numbers first, so that
+// fractional values are reported as such instead of as a JSON type error
+func (t *transactionIn) UnmarshalJSON(b []byte) error {
+	type plain transactionIn
+	var in struct {
+		plain
+		Amount       json.Number `json:"amount"`
+		LifetimeDays json.Number `json:"lifetime_days,omitempty"`
+	}
+
+	// The decoder options of readJSON do not carry over to UnmarshalJSON
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	dec.UseNumber()
+	if err := dec.Decode(&in); err != nil {
+		return err
+	}
+
+	amount, err := wholeNumber(in.Amount)
+	if err != nil {
+		return ErrInvalidAmount
+	}
+	lifetimeDays, err := wholeNumber(in.LifetimeDays)
+	if err != nil {
+		return ErrInvalidLifetimeDays
+	}
+
+	*t = transactionIn(in.plain)
+	t.Amount = amount
+	t.LifetimeDays = lifetimeDays
+	return nil
+}
+
+// wholeNumber converts n to int, rejecting fractions. An empty n is zero.
+func wholeNumber(n json.Number) (int, error) {
+	if n == "" {
+		return 0, nil
+	}
+
+	f, err := n.Float64()
+	if err != nil || math.Trunc(f) != f || f > math.MaxInt32 || f < math.MinInt32 {
+		return 0, strconv.ErrSyntax
+	}
+	return int(f), nil
+}
+
+func (app *application) createTransactionHandler(w http.ResponseWriter, r *http.Request) *AppError {
 	var trxIn transactionIn
-	err := app.readJSON(w, r, &trxIn)
+	err := app.readJSONRequired(w, r, &trxIn, "user_id", "amount", "type")
 	if err != nil {
-		app.badRequestResponse(w, r, err)
-		return
+		var missingErr *MissingFieldsError
+		if errors.As(err, &missingErr) {
+			v := app.newValidator(r)
+			for _, field := range missingErr.Fields {
+				v.CheckMsg(false, field, "must_be_provided", nil)
+			}
+			return NewValidationError(v.Errors)
+		}
+		if errors.Is(err, ErrInvalidAmount) || errors.Is(err, ErrInvalidLifetimeDays) {
+			field := "amount"
+			if errors.Is(err, ErrInvalidLifetimeDays) {
+				field = "lifetime_days"
+			}
+			v := app.newValidator(r)
+			v.CheckMsg(false, field, "must_be_whole_number", nil)
+			return NewValidationError(v.Errors)
+		}
+		return NewBadRequestError(err)
 	}
 
-	id, err := uuid.Parse(trxIn.UserId)
+	// Dry runs write nothing, so they are neither replayed nor recorded
+	if trxIn.IdempotencyKey != "" && !app.isDryRun(r) {
+		dedupKey := trxIn.UserId + ":" + trxIn.IdempotencyKey
+		rec, done, replayed, err := app.deduplicate(w, dedupKey)
+		if err != nil {
+			return NewConflictError(err)
+		}
+		if replayed {
+			return nil
+		}
+		w = rec
+		defer done()
+	}
 
-	v := validator.New()
-	v.Check(err == nil, "user_id", "must be uuid")
-	v.Check(trxIn.Amount > 0, "amount", "must be positive")
-	v.Check(validator.IsPermitted(trxIn.Type, "deposit", "withdrawal"), "type", "must be deposit or withdrawal")
+	id, externalId, err := app.parseUserID(trxIn.UserId)
 
-	if trxIn.Type == "deposit" {
+	v := app.newValidator(r)
+	app.checkUserID(v, err == nil)
+	v.CheckMsg(trxIn.Amount > 0, "amount", "must_be_positive", nil)
+	v.CheckMsg(trxIn.Type.IsValid(), "type", "must_be_transaction_type", nil)
+
+	originalAmount := trxIn.Amount
+	multiplier := app.depositMultiplier()
+
+	if trxIn.Type == data.TransactionTypeDeposit {
 		if trxIn.LifetimeDays == 0 {
-			trxIn.LifetimeDays = 365 // Default to 1 year
+			trxIn.LifetimeDays = app.config.pointsLifetimeDays
 		}
-		v.Check(trxIn.LifetimeDays > 0, "lifetime_days", "must be positive")
+		if trxIn.Category == "" {
+			trxIn.Category = data.DefaultCategory
+		}
+		v.CheckMsg(trxIn.LifetimeDays > 0, "lifetime_days", "must_be_positive", nil)
+		data.ValidateCategory(v, trxIn.Category)
+		data.ValidateTags(v, trxIn.Tags)
+
+		if multiplier != 1.0 && trxIn.Amount > 0 {
+			trxIn.Amount = app.multiplyDeposit(id, trxIn.Amount, multiplier)
+			v.CheckMsg(trxIn.Amount > 0, "amount", "must_be_positive_after_multiplier", nil)
+		}
+	} else {
+		v.CheckMsg(trxIn.Category == "", "category", "must_only_be_set_for_deposits", nil)
+		v.CheckMsg(len(trxIn.Tags) == 0, "tags", "must_only_be_set_for_deposits", nil)
+		v.CheckMsg(trxIn.ConditionalMaxBalance == nil, "conditional_max_balance", "must_only_be_set_for_deposits", nil)
+		v.CheckMsg(!trxIn.Partial || app.config.allowPartialWithdrawal, "partial", "partial_withdrawals_disabled", nil)
 	}
+	v.CheckMsg(!trxIn.Partial || trxIn.Type == data.TransactionTypeWithdrawal, "partial", "must_only_be_set_for_withdrawals", nil)
 
 	if !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
-		return
+		return NewValidationError(v.Errors)
 	}
 
-	if trxIn.Type == "deposit" {
-		transaction, err := app.models.Balances.AddBonusPoints(id, trxIn.Amount, trxIn.LifetimeDays)
+	if apiKey := contextAPIKey(r); apiKey != nil && apiKey.UserId != id {
+		return NewForbiddenError("the API key does not belong to this user")
+	}
+
+	frozen, err := app.models.Transactions.IsUserFrozen(r.Context(), id)
+	if err != nil {
+		return NewInternalError(err)
+	}
+	if frozen {
+		return NewAccountFrozenError()
+	}
+
+	dryRun := app.isDryRun(r)
+
+	if trxIn.Type == data.TransactionTypeDeposit {
+		grant := data.Grant{
+			UserId:         id,
+			ExternalUserId: externalId,
+			Amount:         trxIn.Amount,
+			LifetimeDays:   trxIn.LifetimeDays,
+			Category:       trxIn.Category,
+			Tags:           trxIn.Tags,
+		}
+
+		opts := data.DepositOptions{
+			DryRun:          dryRun,
+			MaxTransactions: app.config.maxTransactionsPerUser,
+			MaxBalance:      trxIn.ConditionalMaxBalance,
+		}
+
+		transaction, err := app.models.Balances.AddBonusPoints(r.Context(), grant, opts)
 		if err != nil {
-			app.serverErrorResponse(w, r, err)
-			return
+			if errors.Is(err, data.ErrTransactionLimitExceeded) {
+				return NewTransactionLimitError(err)
+			}
+			if errors.Is(err, data.ErrConditionNotMet) {
+				return NewConflictError(err)
+			}
+			return NewInternalError(err)
+		}
+
+		status := http.StatusCreated
+		if dryRun {
+			status = http.StatusOK
+		}
+		if !dryRun {
+			if err := app.events.publish(transactionEvent{Type: data.TransactionTypeDeposit, Transaction: transaction}); err != nil {
+				app.logger.Error("publish event", "error", err)
+			}
+			app.onDeposit(*transaction)
+			app.amountMetrics.deposit.Observe(float64(transaction.Amount))
+			app.setReadAfter(w)
+		}
+
+		out := transactionOut{Transaction: transaction, DryRun: dryRun}
+		if multiplier != 1.0 {
+			out.BonusApplied = true
+			out.OriginalAmount = originalAmount
 		}
-		err = app.writeJSON(w, http.StatusCreated, transaction, nil)
+
+		err = app.writeAmountsJSON(w, r, status, out, nil)
 		if err != nil {
-			app.serverErrorResponse(w, r, err)
+			return NewInternalError(err)
 		}
 	} else {
-		err := app.models.Balances.WithdrawBonusPoints(id, trxIn.Amount)
+		// Bursts of withdrawals from one user are likely fraud. Only
+		// successful withdrawals are counted, the reservation keeps
+		// concurrent ones from passing the limit before they are.
+		var rateLimit *ratelimit.Reservation
+		if app.config.maxWithdrawPerMinute > 0 && !dryRun {
+			var retryAfter time.Duration
+			rateLimit, retryAfter = app.withdrawalRate.Reserve(id)
+			if rateLimit == nil {
+				return NewWithdrawalRateLimitError(retryAfter)
+			}
+			defer rateLimit.Cancel()
+		}
+
+		// Fail fast on double submits instead of queueing on the row locks
+		if !app.pendingWithdrawals.TryAcquire(id) {
+			return NewWithdrawalInProgressError()
+		}
+		defer app.pendingWithdrawals.Release(id)
+
+		opts := app.withdrawOptions(dryRun)
+
+		var withdrawal data.Withdrawal
+		var err error
+		if trxIn.Partial {
+			withdrawal, err = app.models.Balances.WithdrawBonusPointsPartial(r.Context(), id, trxIn.Amount, opts)
+		} else {
+			withdrawal, err = app.models.Balances.WithdrawBonusPoints(r.Context(), id, trxIn.Amount, opts)
+		}
 		if err != nil {
-			if errors.Is(err, data.ErrInsufficientFunds) {
-				app.badRequestResponse(w, r, err)
-			} else {
-				app.serverErrorResponse(w, r, err)
+			if errors.Is(err, data.ErrInsufficientFunds) || errors.Is(err, data.ErrDebtLimitExceeded) {
+				return NewInsufficientFundsError(err)
+			}
+			if errors.Is(err, data.ErrLockTimeout) {
+				return NewLockTimeoutError(err)
+			}
+			if errors.Is(err, data.ErrDailyWithdrawalLimitExceeded) {
+				return NewDailyWithdrawalLimitError(err)
+			}
+			return NewInternalError(err)
+		}
+
+		withdrawn := withdrawal.Amount
+		if rateLimit != nil {
+			rateLimit.Commit()
+		}
+
+		// Before reading the balance, so that the response shows the new expirations
+		if app.config.touchExpiryOnWithdrawal && !dryRun && withdrawn > 0 {
+			if _, err := app.models.Transactions.TouchExpiry(r.Context(), id, app.config.pointsLifetimeDays); err != nil {
+				app.logger.Error("touch expiry", "user_id", id, "error", err)
 			}
-			return
 		}
 
 		// Return the new balance
-		balance, expirations, err := app.models.Balances.GetBalanceWithExpiration(id)
+		balance, expirations, err := app.models.Balances.GetBalanceWithExpiration(r.Context(), id, 0, 0)
 		if err != nil {
-			app.serverErrorResponse(w, r, err)
-			return
+			return NewInternalError(err)
 		}
 
 		response := map[string]any{
@@ -75,33 +289,857 @@ func (app *application) createTransactionHandler(w http.ResponseWriter, r *http.
 			"balance":     balance,
 			"expirations": expirations,
 		}
-		err = app.writeJSON(w, http.StatusOK, response, nil)
+		if externalId != "" {
+			response["external_user_id"] = externalId
+		}
+		if withdrawal.Id != uuid.Nil {
+			response["transaction_id"] = withdrawal.Id
+		}
+		if trxIn.Partial {
+			response["requested_amount"] = trxIn.Amount
+			response["withdrawn_amount"] = withdrawn
+		}
+
+		if !dryRun && withdrawn > 0 {
+			event := withdrawalEvent{Type: data.TransactionTypeWithdrawal, UserId: id.String(), Amount: withdrawn, Balance: balance}
+			if err := app.events.publish(event); err != nil {
+				app.logger.Error("publish event", "error", err)
+			}
+			app.onWithdrawal(data.Transaction{UserId: id, ExternalUserId: externalId, Amount: withdrawn}, balance)
+			app.amountMetrics.withdrawal.Observe(float64(withdrawn))
+			app.setReadAfter(w)
+		}
+
+		if dryRun {
+			// Nothing was written, so apply the withdrawal to the fetched balance
+			response["balance"] = balance - withdrawn
+			response["expirations"] = deductExpirations(expirations, withdrawn)
+			response["dry_run"] = true
+		}
+
+		err = app.writeAmountsJSON(w, r, http.StatusOK, response, nil)
 		if err != nil {
-			app.serverErrorResponse(w, r, err)
+			return NewInternalError(err)
 		}
 	}
+
+	return nil
+}
+
+// withdrawOptions are the settings every withdrawal runs with
+func (app *application) withdrawOptions(dryRun bool) data.WithdrawOptions {
+	ff := app.flags.Get()
+	return data.WithdrawOptions{
+		DryRun:         dryRun,
+		AllowDebt:      app.config.allowNegativeBalance || ff.EnableNegativeBalance,
+		MaxDebt:        app.config.maxDebt,
+		Strategy:       withdrawStrategy(ff),
+		LockTimeout:    time.Duration(app.config.lockTimeoutMs) * time.Millisecond,
+		MaxDailyAmount: app.config.maxDailyWithdrawalAmount,
+	}
 }
 
-func (app *application) showUserBalanceHandler(w http.ResponseWriter, r *http.Request) {
-	id, err := app.readIDParam(r)
-	if err != nil || id == uuid.Nil {
-		app.notFoundResponse(w, r)
-		return
+// onDeposit runs the OnDeposit hook in the background, the hook gets its own
+// copy of the transaction
+func (app *application) onDeposit(transaction data.Transaction) {
+	if app.hooks.OnDeposit != nil {
+		app.background(func() { app.hooks.OnDeposit(&transaction) })
+	}
+}
+
+func (app *application) onWithdrawal(transaction data.Transaction, balance int) {
+	if app.hooks.OnWithdrawal != nil {
+		app.background(func() { app.hooks.OnWithdrawal(&transaction, balance) })
 	}
+}
+
+func (app *application) onRevert(transaction data.Transaction, balance int) {
+	if app.hooks.OnRevert != nil {
+		app.background(func() { app.hooks.OnRevert(&transaction, balance) })
+	}
+}
+
+type transactionOut struct {
+	*data.Transaction
+	DryRun         bool `json:"dry_run,omitempty"`
+	BonusApplied   bool `json:"bonus_applied,omitempty"`
+	OriginalAmount int  `json:"original_amount,omitempty"`
+}
 
-	balance, expirations, err := app.models.Balances.GetBalanceWithExpiration(id)
+// isDryRun reports whether the request must not persist anything
+func (app *application) isDryRun(r *http.Request) bool {
+	return app.config.dryRun || r.Header.Get("X-Dry-Run") == "true"
+}
+
+// deductExpirations mirrors the FIFO withdrawal on the date ordered
+// expirations: points expiring first are consumed first
+func deductExpirations(expirations []data.Expiration, amount int) []data.Expiration {
+	result := []data.Expiration{}
+	for _, e := range expirations {
+		deduct := min(amount, e.Amount)
+		amount -= deduct
+		if left := e.Amount - deduct; left > 0 {
+			result = append(result, data.Expiration{Date: e.Date, Amount: left})
+		}
+	}
+	return result
+}
+
+const maxBulkGrants = 100
+
+type grantIn struct {
+	UserId       string   `json:"user_id"`
+	Amount       int      `json:"amount"`
+	LifetimeDays int      `json:"lifetime_days,omitempty"`
+	Category     string   `json:"category,omitempty"`
+	Tags         []string `json:"tags,omitempty"`
+}
+
+func (app *application) createBulkTransactionsHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	var input struct {
+		Grants []grantIn `json:"grants"`
+	}
+	err := app.readJSON(w, r, &input)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
+		return NewBadRequestError(err)
+	}
+
+	v := app.newValidator(r)
+	v.CheckMsg(len(input.Grants) > 0, "grants", "must_contain_at_least_one", "grant")
+	v.CheckMsg(len(input.Grants) <= maxBulkGrants, "grants", "must_not_contain_more_than", map[string]any{"max": maxBulkGrants, "noun": "grants"})
+	if !v.Valid() {
+		return NewValidationError(v.Errors)
+	}
+
+	result := data.BulkGrantResult{
+		Succeeded: []data.Transaction{},
+		Failed:    []data.BulkGrantError{},
+	}
+
+	multiplier := app.depositMultiplier()
+
+	// Each grant is validated on its own so one bad entry does not reject
+	// the rest, indices maps grants back to their input position
+	var grants []data.Grant
+	var indices []int
+	for i, in := range input.Grants {
+		id, externalId, err := app.parseUserID(in.UserId)
+
+		v := app.newValidator(r)
+		app.checkUserIDField(v, err == nil, "user_id")
+		v.CheckMsg(in.Amount > 0, "amount", "must_be_positive", nil)
+		if in.LifetimeDays == 0 {
+			in.LifetimeDays = app.config.pointsLifetimeDays
+		}
+		if in.Category == "" {
+			in.Category = data.DefaultCategory
+		}
+		v.CheckMsg(in.LifetimeDays > 0, "lifetime_days", "must_be_positive", nil)
+		data.ValidateCategory(v, in.Category)
+		data.ValidateTags(v, in.Tags)
+
+		if multiplier != 1.0 && in.Amount > 0 {
+			in.Amount = app.multiplyDeposit(id, in.Amount, multiplier)
+			v.CheckMsg(in.Amount > 0, "amount", "must_be_positive_after_multiplier", nil)
+		}
+
+		if !v.Valid() {
+			result.Failed = append(result.Failed, data.BulkGrantError{Index: i, Error: validationSummary(v.Errors)})
+			continue
+		}
+
+		frozen, err := app.models.Transactions.IsUserFrozen(r.Context(), id)
+		if err != nil {
+			return NewInternalError(err)
+		}
+		if frozen {
+			result.Failed = append(result.Failed, data.BulkGrantError{Index: i, Error: "account frozen"})
+			continue
+		}
+
+		grants = append(grants, data.Grant{
+			UserId:         id,
+			ExternalUserId: externalId,
+			Amount:         in.Amount,
+			LifetimeDays:   in.LifetimeDays,
+			Category:       in.Category,
+			Tags:           in.Tags,
+		})
+		indices = append(indices, i)
+	}
+
+	if len(grants) == 0 {
+		err = app.writeJSON(w, r, http.StatusUnprocessableEntity, result, nil)
+		if err != nil {
+			return NewInternalError(err)
+		}
+		return nil
+	}
+
+	transactions, failed, err := app.models.Balances.BulkAddBonusPoints(r.Context(), grants, app.config.maxTransactionsPerUser)
+	if err != nil {
+		return NewInternalError(err)
+	}
+	result.Succeeded = transactions
+	for _, f := range failed {
+		result.Failed = append(result.Failed, data.BulkGrantError{Index: indices[f.Index], Error: f.Error})
+	}
+	slices.SortFunc(result.Failed, func(a, b data.BulkGrantError) int { return a.Index - b.Index })
+
+	if len(transactions) > 0 {
+		app.setReadAfter(w)
+	}
+
+	for i := range transactions {
+		if err := app.events.publish(transactionEvent{Type: data.TransactionTypeDeposit, Transaction: &transactions[i]}); err != nil {
+			app.logger.Error("publish event", "error", err)
+		}
+		app.onDeposit(transactions[i])
+		app.amountMetrics.deposit.Observe(float64(transactions[i].Amount))
+	}
+
+	status := http.StatusCreated
+	if len(transactions) == 0 {
+		status = http.StatusUnprocessableEntity
+	} else if len(result.Failed) > 0 {
+		status = http.StatusMultiStatus
+	}
+
+	err = app.writeAmountsJSON(w, r, status, result, nil)
+	if err != nil {
+		return NewInternalError(err)
+	}
+
+	return nil
+}
+
+// validationSummary flattens validator errors into a single stable string
+func validationSummary(errors map[string]string) string {
+	keys := make([]string, 0, len(errors))
+	for key := range errors {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts = append(parts, key+": "+errors[key])
+	}
+	return strings.Join(parts, "; ")
+}
+
+func (app *application) showUserBalanceHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	id, externalId, err := app.readUserIDParam(r)
+	if err != nil {
+		return NewNotFoundError()
+	}
+
+	qs := r.URL.Query()
+	if qs.Has("as_of") {
+		return app.showUserBalanceAtHandler(w, r, id)
+	}
+
+	v := app.newValidator(r)
+
+	breakdown := qs.Get("breakdown")
+	expiryPage := app.readInt(qs, "expiry_page", 1, v)
+	expiryPageSize := app.readInt(qs, "expiry_page_size", maxExpiryPageSize, v)
+
+	v.CheckMsg(!qs.Has("breakdown") || validator.IsPermitted(breakdown, "category"), "breakdown", "must_be_category_breakdown", nil)
+	v.CheckMsg(expiryPage > 0, "expiry_page", "must_be_greater_than_zero", nil)
+	v.CheckMsg(expiryPageSize > 0, "expiry_page_size", "must_be_greater_than_zero", nil)
+	v.CheckMsg(expiryPageSize <= maxExpiryPageSize, "expiry_page_size", "must_be_maximum", maxExpiryPageSize)
+	if !v.Valid() {
+		return NewValidationError(v.Errors)
+	}
+
+	currency := qs.Get("currency")
+	if currency != "" && !strings.EqualFold(currency, app.config.currencyCode) {
+		return NewBadRequestError(fmt.Errorf("currency %q is not supported, use %s", currency, app.config.currencyCode))
+	}
+
+	models := app.readModels(r)
+
+	// Read before the balance, a change in between makes the client
+	// refetch rather than keep a stale balance
+	version, updatedAt, err := models.Balances.GetBalanceVersion(r.Context(), id)
+	if err != nil {
+		return NewInternalError(err)
+	}
+
+	// The same balance has a different version in every representation
+	version += "." + app.balanceRepresentation(r, externalId != "", breakdown, expiryPage, expiryPageSize, currency != "")
+	etag := `"` + version + `"`
+	w.Header().Set("Vary", "Accept")
+	if qs.Get("version") == version || r.Header.Get("If-None-Match") == etag {
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	offset := (expiryPage - 1) * expiryPageSize
+	balance, expirations, err := models.Balances.GetBalanceWithExpiration(r.Context(), id, offset, expiryPageSize)
+	if err != nil {
+		return NewInternalError(err)
 	}
 
 	response := map[string]any{
 		"user_id":     id,
 		"balance":     balance,
 		"expirations": expirations,
+		"version":     version,
+	}
+	if externalId != "" {
+		response["external_user_id"] = externalId
+	}
+
+	if breakdown == "category" {
+		categories, err := models.Transactions.GetBalanceByCategory(r.Context(), id)
+		if err != nil {
+			return NewInternalError(err)
+		}
+		response["breakdown"] = categories
+	}
+
+	if currency != "" {
+		response["monetary_value"] = app.monetaryValue(balance)
+	}
+
+	// Only the first page starts with the nearest expiration
+	var headers http.Header
+	if offset == 0 {
+		headers, err = app.expiryWarningHeaders(expirations)
+		if err != nil {
+			return NewInternalError(err)
+		}
+	}
+	if headers == nil {
+		headers = make(http.Header)
+	}
+	headers.Set("ETag", etag)
+
+	// For proxies reading the balance without parsing the body, these
+	// headers are part of the stable API
+	headers.Set("X-Balance", strconv.Itoa(balance))
+	if !updatedAt.IsZero() {
+		headers.Set("X-Balance-Updated-At", updatedAt.UTC().Format(time.RFC3339))
+	}
+
+	if err = app.writeAmountsJSON(w, r, http.StatusOK, response, headers); err != nil {
+		return NewInternalError(err)
+	}
+
+	return nil
+}
+
+// balanceRepresentation identifies the options shaping a balance response:
+// its query parameters and the encoding of its JSON
+func (app *application) balanceRepresentation(r *http.Request, external bool, breakdown string, expiryPage, expiryPageSize int, currency bool) string {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%t|%s|%d|%d|%t|%t|%t|%s", external, breakdown, expiryPage, expiryPageSize, currency,
+		app.wantsStringAmounts(r), app.wantsPrettyJSON(r), app.config.jsonNamingConvention)
+	return strconv.FormatUint(uint64(h.Sum32()), 36)
+}
+
+// monetaryValue converts points to the configured currency, the amount is a
+// string so that clients do not round it through floats
+func (app *application) monetaryValue(points int) map[string]string {
+	return map[string]string{
+		"amount":   strconv.FormatFloat(float64(points)/app.config.pointsPerCurrencyUnit, 'f', 2, 64),
+		"currency": app.config.currencyCode,
+	}
+}
+
+// maxExpiryPageSize covers every day of the 30 day expiration window, so by
+// default the balance lists all expirations
+const maxExpiryPageSize = 31
+
+// maxHistoryDays bounds balance history requests, the query gets expensive
+// for longer ranges
+const maxHistoryDays = 90
+
+func (app *application) showBalanceHistoryHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	id, externalId, err := app.readUserIDParam(r)
+	if err != nil {
+		return NewNotFoundError()
+	}
+
+	qs := r.URL.Query()
+	v := app.newValidator(r)
+
+	from := app.readDate(qs, "from", v)
+	to := app.readDate(qs, "to", v)
+
+	v.CheckMsg(qs.Get("from") != "", "from", "must_be_provided", nil)
+	v.CheckMsg(qs.Get("to") != "", "to", "must_be_provided", nil)
+	v.CheckMsg(!to.Before(from), "to", "must_not_be_before", "from")
+	v.CheckMsg(to.Sub(from) < maxHistoryDays*24*time.Hour, "to", "must_be_less_than_days_after", map[string]any{"days": maxHistoryDays, "field": "from"})
+	if !v.Valid() {
+		return NewValidationError(v.Errors)
+	}
+
+	history, err := app.models.Transactions.GetBalanceHistory(r.Context(), id, from, to)
+	if err != nil {
+		return NewInternalError(err)
 	}
 
-	if err = app.writeJSON(w, http.StatusOK, response, nil); err != nil {
-		app.serverErrorResponse(w, r, err)
+	response := map[string]any{
+		"user_id": id,
+		"history": history,
+	}
+	if externalId != "" {
+		response["external_user_id"] = externalId
+	}
+
+	if err = app.writeAmountsJSON(w, r, http.StatusOK, response, nil); err != nil {
+		return NewInternalError(err)
+	}
+
+	return nil
+}
+
+func (app *application) showTransactionSummaryHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	id, externalId, err := app.readUserIDParam(r)
+	if err != nil {
+		return NewNotFoundError()
+	}
+
+	summary, err := app.models.Transactions.GetTransactionSummary(r.Context(), id)
+	if err != nil {
+		return NewInternalError(err)
+	}
+
+	response := map[string]any{
+		"user_id": id,
+		"summary": summary,
 	}
+	if externalId != "" {
+		response["external_user_id"] = externalId
+	}
+
+	if err = app.writeAmountsJSON(w, r, http.StatusOK, response, nil); err != nil {
+		return NewInternalError(err)
+	}
+
+	return nil
+}
+
+// maxRetentionLookbackDays bounds the transactions scanned for a retention score
+const maxRetentionLookbackDays = 365
+
+func (app *application) showRetentionScoreHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	id, externalId, err := app.readUserIDParam(r)
+	if err != nil {
+		return NewNotFoundError()
+	}
+
+	qs := r.URL.Query()
+	v := app.newValidator(r)
+
+	lookbackDays := app.readInt(qs, "lookback_days", 30, v)
+
+	v.CheckMsg(lookbackDays > 0, "lookback_days", "must_be_greater_than_zero", nil)
+	v.CheckMsg(lookbackDays <= maxRetentionLookbackDays, "lookback_days", "must_be_maximum", maxRetentionLookbackDays)
+	if !v.Valid() {
+		return NewValidationError(v.Errors)
+	}
+
+	score, err := app.readModels(r).Transactions.GetUserRetentionScore(r.Context(), id, lookbackDays)
+	if err != nil {
+		return NewInternalError(err)
+	}
+
+	response := map[string]any{
+		"user_id":       id,
+		"lookback_days": lookbackDays,
+		"retention":     score,
+	}
+	if externalId != "" {
+		response["external_user_id"] = externalId
+	}
+
+	if err = app.writeJSON(w, r, http.StatusOK, response, nil); err != nil {
+		return NewInternalError(err)
+	}
+
+	return nil
+}
+
+// maxVelocityWindowDays bounds the deposits scanned for an earning velocity
+const maxVelocityWindowDays = 365
+
+func (app *application) showEarningVelocityHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	id, externalId, err := app.readUserIDParam(r)
+	if err != nil {
+		return NewNotFoundError()
+	}
+
+	qs := r.URL.Query()
+	v := app.newValidator(r)
+
+	windowDays := app.readInt(qs, "window_days", 30, v)
+
+	v.CheckMsg(windowDays > 0, "window_days", "must_be_greater_than_zero", nil)
+	v.CheckMsg(windowDays <= maxVelocityWindowDays, "window_days", "must_be_maximum", maxVelocityWindowDays)
+	if !v.Valid() {
+		return NewValidationError(v.Errors)
+	}
+
+	velocity, err := app.readModels(r).Transactions.GetEarningVelocity(r.Context(), id, windowDays)
+	if err != nil {
+		return NewInternalError(err)
+	}
+
+	response := map[string]any{
+		"user_id":     id,
+		"window_days": windowDays,
+		"velocity":    velocity,
+	}
+	if externalId != "" {
+		response["external_user_id"] = externalId
+	}
+
+	if err = app.writeAmountsJSON(w, r, http.StatusOK, response, nil); err != nil {
+		return NewInternalError(err)
+	}
+
+	return nil
+}
+
+// simulateWithdrawalHandler shows which grants a withdrawal would consume,
+// nothing is written
+func (app *application) simulateWithdrawalHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	id, externalId, err := app.readUserIDParam(r)
+	if err != nil {
+		return NewNotFoundError()
+	}
+
+	var input struct {
+		Amount int `json:"amount"`
+	}
+	if err = app.readJSON(w, r, &input); err != nil {
+		return NewBadRequestError(err)
+	}
+
+	v := app.newValidator(r)
+	v.CheckMsg(input.Amount > 0, "amount", "must_be_positive", nil)
+	if !v.Valid() {
+		return NewValidationError(v.Errors)
+	}
+
+	simulation, err := app.models.Transactions.SimulateWithdraw(r.Context(), id, input.Amount, app.withdrawOptions(false))
+	if err != nil {
+		return NewInternalError(err)
+	}
+
+	response := map[string]any{
+		"user_id":    id,
+		"amount":     input.Amount,
+		"simulation": simulation,
+	}
+	if externalId != "" {
+		response["external_user_id"] = externalId
+	}
+
+	if err = app.writeAmountsJSON(w, r, http.StatusOK, response, nil); err != nil {
+		return NewInternalError(err)
+	}
+
+	return nil
+}
+
+func (app *application) rebalanceExpiredHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	id, externalId, err := app.readUserIDParam(r)
+	if err != nil {
+		return NewNotFoundError()
+	}
+
+	var input struct {
+		ConversionRate  float64 `json:"conversion_rate"`
+		NewLifetimeDays int     `json:"new_lifetime_days"`
+	}
+	if err = app.readJSON(w, r, &input); err != nil {
+		return NewBadRequestError(err)
+	}
+
+	v := app.newValidator(r)
+	v.CheckMsg(input.ConversionRate > 0, "conversion_rate", "must_be_positive", nil)
+	v.CheckMsg(input.ConversionRate <= app.config.maxConversionRate, "conversion_rate", "must_be_maximum", app.config.maxConversionRate)
+	v.CheckMsg(input.NewLifetimeDays > 0, "new_lifetime_days", "must_be_positive", nil)
+	if !v.Valid() {
+		return NewValidationError(v.Errors)
+	}
+
+	frozen, err := app.models.Transactions.IsUserFrozen(r.Context(), id)
+	if err != nil {
+		return NewInternalError(err)
+	}
+	if frozen {
+		return NewAccountFrozenError()
+	}
+
+	transaction, err := app.models.Transactions.RebalanceExpiredToNewGrant(r.Context(), id, input.ConversionRate, input.NewLifetimeDays)
+	if err != nil {
+		return NewInternalError(err)
+	}
+	if transaction != nil {
+		app.setReadAfter(w)
+	}
+
+	response := map[string]any{
+		"user_id":     id,
+		"transaction": transaction,
+	}
+	if externalId != "" {
+		response["external_user_id"] = externalId
+	}
+
+	if err = app.writeAmountsJSON(w, r, http.StatusOK, response, nil); err != nil {
+		return NewInternalError(err)
+	}
+
+	return nil
+}
+
+func (app *application) revertWithdrawalHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		return NewNotFoundError()
+	}
+
+	revert, err := app.models.Balances.RevertWithdrawal(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return NewNotFoundError()
+		case errors.Is(err, data.ErrAlreadyReverted):
+			return NewConflictError(err)
+		case errors.Is(err, data.ErrNotRevertible):
+			return NewUnprocessableError(err)
+		case errors.Is(err, data.ErrUserFrozen):
+			return NewAccountFrozenError()
+		default:
+			return NewInternalError(err)
+		}
+	}
+	app.setReadAfter(w)
+
+	balance, _, err := app.models.Balances.GetBalanceWithExpiration(r.Context(), revert.UserId, 0, 0)
+	if err != nil {
+		return NewInternalError(err)
+	}
+
+	event := revertEvent{Type: "revert", TransactionId: id, UserId: revert.UserId.String(), Amount: revert.Restored, Balance: balance}
+	if err := app.events.publish(event); err != nil {
+		app.logger.Error("publish event", "error", err)
+	}
+	app.onRevert(data.Transaction{Id: id, UserId: revert.UserId, Amount: revert.Restored}, balance)
+
+	response := map[string]any{
+		"transaction_id":   id,
+		"user_id":          revert.UserId,
+		"restored_amount":  revert.Restored,
+		"forfeited_amount": revert.Forfeited,
+		"balance":          balance,
+	}
+
+	if err = app.writeAmountsJSON(w, r, http.StatusOK, response, nil); err != nil {
+		return NewInternalError(err)
+	}
+
+	return nil
+}
+
+// publicTransaction is a transaction as shown to its owner, without the
+// bookkeeping of how much of a grant is left
+type publicTransaction struct {
+	Id          uuid.UUID            `json:"id"`
+	Amount      int                  `json:"amount"`
+	Type        data.TransactionType `json:"type"`
+	CreatedAt   time.Time            `json:"created_at"`
+	ExpiresAt   time.Time            `json:"expires_at"`
+	Status      string               `json:"status"`
+	Category    string               `json:"category"`
+	Tags        []string             `json:"tags"`
+	DisplayName string               `json:"display_name"`
+	Reference   string               `json:"reference"`
+}
+
+func newPublicTransaction(t data.Transaction, now time.Time) publicTransaction {
+	pt := publicTransaction{
+		Id:          t.Id,
+		Amount:      t.Amount,
+		Type:        data.TransactionTypeDeposit,
+		CreatedAt:   t.CreatedAt,
+		ExpiresAt:   t.ExpiresAt,
+		Status:      "active",
+		Category:    t.Category,
+		Tags:        t.Tags,
+		DisplayName: t.DisplayName,
+		Reference:   t.Reference,
+	}
+
+	switch {
+	case t.Amount < 0:
+		pt.Type = data.TransactionTypeWithdrawal
+		pt.Amount = -t.Amount
+		pt.Status = "completed"
+		if t.CancelledAt != nil {
+			pt.Status = "reverted"
+		}
+	case t.CancelledAt != nil:
+		pt.Status = "cancelled"
+	case t.RemainingAmount == 0:
+		pt.Status = "spent"
+	case !t.ExpiresAt.After(now):
+		pt.Status = "expired"
+	}
+
+	return pt
+}
+
+// listUserTransactionsHandler serves a user's own transaction history
+func (app *application) listUserTransactionsHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	id, externalId, err := app.readUserIDParam(r)
+	if err != nil {
+		return NewNotFoundError()
+	}
+
+	qs := r.URL.Query()
+	v := app.newValidator(r)
+
+	page := data.Pagination{
+		Page:     app.readInt(qs, "page", 1, v),
+		PageSize: app.readInt(qs, "page_size", 20, v),
+	}
+
+	data.ValidatePagination(v, page)
+	if !v.Valid() {
+		return NewValidationError(v.Errors)
+	}
+
+	transactions, metadata, err := app.readModels(r).Transactions.List(r.Context(), data.TransactionFilter{UserId: id}, page)
+	if err != nil {
+		return NewInternalError(err)
+	}
+
+	now := time.Now()
+	public := make([]publicTransaction, len(transactions))
+	for i, t := range transactions {
+		public[i] = newPublicTransaction(t, now)
+	}
+
+	response := map[string]any{
+		"user_id":      id,
+		"transactions": public,
+		"metadata":     metadata,
+	}
+	if externalId != "" {
+		response["external_user_id"] = externalId
+	}
+
+	if err = app.writeAmountsJSON(w, r, http.StatusOK, response, nil); err != nil {
+		return NewInternalError(err)
+	}
+
+	return nil
+}
+
+const maxBatchBalances = 100
+
+func (app *application) showUserBalancesHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	var input struct {
+		UserIds []string `json:"user_ids"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		return NewBadRequestError(err)
+	}
+
+	v := app.newValidator(r)
+	v.CheckMsg(len(input.UserIds) > 0, "user_ids", "must_contain_at_least_one", "user id")
+	v.CheckMsg(len(input.UserIds) <= maxBatchBalances, "user_ids", "must_not_contain_more_than", map[string]any{"max": maxBatchBalances, "noun": "user ids"})
+	v.CheckMsg(validator.IsUnique(input.UserIds), "user_ids", "must_not_contain_duplicates", nil)
+
+	ids := make([]uuid.UUID, len(input.UserIds))
+	externalIds := make([]string, len(input.UserIds))
+	for i, raw := range input.UserIds {
+		ids[i], externalIds[i], err = app.parseUserID(raw)
+		app.checkUserIDField(v, err == nil, "user_ids")
+	}
+
+	if !v.Valid() {
+		return NewValidationError(v.Errors)
+	}
+
+	balances, err := app.readModels(r).Transactions.GetBalancesForUsers(r.Context(), ids)
+	if err != nil {
+		return NewInternalError(err)
+	}
+
+	// Keep the order of the request
+	response := make([]data.UserBalance, len(ids))
+	for i, id := range ids {
+		response[i] = balances[id]
+		response[i].ExternalUserId = externalIds[i]
+	}
+
+	err = app.writeAmountsJSON(w, r, http.StatusOK, map[string]any{"balances": response}, nil)
+	if err != nil {
+		return NewInternalError(err)
+	}
+
+	return nil
+}
+
+// expiryWarningHeaders sets X-Points-Expiring-Soon when the nearest entry of
+// the balance expirations falls within the configured warning window
+func (app *application) expiryWarningHeaders(expirations []data.Expiration) (http.Header, error) {
+	if app.config.expiryWarningDays == 0 || len(expirations) == 0 {
+		return nil, nil
+	}
+
+	// Dates are formatted as YYYY-MM-DD, so they compare chronologically as strings
+	nearest := expirations[0]
+	if nearest.Date > time.Now().AddDate(0, 0, app.config.expiryWarningDays).Format("2006-01-02") {
+		return nil, nil
+	}
+
+	js, err := json.Marshal(map[string]any{"amount": nearest.Amount, "expires_at": nearest.Date})
+	if err != nil {
+		return nil, err
+	}
+
+	headers := make(http.Header)
+	headers.Set("X-Points-Expiring-Soon", string(js))
+	return headers, nil
+}
+
+// showUserBalanceAtHandler serves the point-in-time balance for ?as_of=
+func (app *application) showUserBalanceAtHandler(w http.ResponseWriter, r *http.Request, id uuid.UUID) *AppError {
+	v := app.newValidator(r)
+	asOf := app.readTime(r.URL.Query(), "as_of", v)
+	v.CheckMsg(!asOf.IsZero(), "as_of", "must_be_provided", nil)
+	v.CheckMsg(!asOf.After(time.Now()), "as_of", "must_not_be_in_future", nil)
+
+	if !v.Valid() {
+		return NewValidationError(v.Errors)
+	}
+
+	balance, err := app.models.Transactions.GetBalanceAt(r.Context(), id, asOf)
+	if err != nil {
+		return NewInternalError(err)
+	}
+
+	response := map[string]any{
+		"user_id": id,
+		"balance": balance,
+		"as_of":   asOf,
+	}
+
+	if err = app.writeAmountsJSON(w, r, http.StatusOK, response, nil); err != nil {
+		return NewInternalError(err)
+	}
+
+	return nil
 }
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"github.com/google/uuid"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"simple-ledger.itmo.ru/internal/data"
+	"simple-ledger.itmo.ru/internal/flags"
+	"simple-ledger.itmo.ru/internal/pending"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testApp returns an application backed by the database in LEDGER_TEST_DSN
+// and skips the test when it is not set
+func testApp(t *testing.T) *application {
+	t.Helper()
+
+	dsn := os.Getenv("LEDGER_TEST_DSN")
+	if dsn == "" {
+		t.Skip("LEDGER_TEST_DSN is not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	featureFlags, err := flags.NewStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &application{
+		config:             config{jsonNamingConvention: namingSnakeCase, userIDMode: "uuid", depositMultiplier: 1, pointsPerCurrencyUnit: 100, currencyCode: "USD"},
+		logger:             slog.New(slog.NewTextHandler(io.Discard, nil)),
+		db:                 db,
+		flags:              featureFlags,
+		models:             data.NewModels(db),
+		replica:            data.NewModels(db),
+		multiplier:         &multiplierOverride{},
+		pendingWithdrawals: pending.New(),
+	}
+}
+
+// getBalance runs showUserBalanceHandler for userId with the query string
+func getBalance(app *application, userId, query string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/v1/users/"+userId+"/balance?"+query, nil)
+	r.SetPathValue("id", userId)
+
+	rr := httptest.NewRecorder()
+	app.handle(app.showUserBalanceHandler).ServeHTTP(rr, r)
+	return rr
+}
+
+// postTransaction runs createTransactionHandler on body, the cases using it
+// fail validation before any database access
+func postTransaction(app *application, body string) *AppError {
+	r := httptest.NewRequest(http.MethodPost, "/v1/transactions", strings.NewReader(body))
+	return app.createTransactionHandler(httptest.NewRecorder(), r)
+}
+
+func TestCreateTransactionMissingFields(t *testing.T) {
+	app := &application{config: config{jsonNamingConvention: namingSnakeCase}}
+
+	tests := []struct {
+		name string
+		body string
+		want map[string]string
+	}{
+		{"user_id", `{"amount": 10, "type": "deposit"}`, map[string]string{"user_id": "must be provided"}},
+		{"amount", `{"user_id": "4f0c6a1e-8f3b-4a57-9c55-0c4b3c2b9b1e", "type": "deposit"}`, map[string]string{"amount": "must be provided"}},
+		{"type", `{"user_id": "4f0c6a1e-8f3b-4a57-9c55-0c4b3c2b9b1e", "amount": 10}`, map[string]string{"type": "must be provided"}},
+		{"all", `{}`, map[string]string{"user_id": "must be provided", "amount": "must be provided", "type": "must be provided"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			appErr := postTransaction(app, tt.body)
+			if appErr == nil || appErr.StatusCode != http.StatusUnprocessableEntity {
+				t.Fatalf("got %v, want a validation error", appErr)
+			}
+			if !reflect.DeepEqual(appErr.Message, tt.want) {
+				t.Errorf("errors = %v, want %v", appErr.Message, tt.want)
+			}
+		})
+	}
+}
+
+func TestBalanceRepresentation(t *testing.T) {
+	app := &application{config: config{env: "development", jsonNamingConvention: namingSnakeCase}}
+
+	plain := httptest.NewRequest(http.MethodGet, "/v1/users/1/balance", nil)
+	base := app.balanceRepresentation(plain, false, "", 1, maxExpiryPageSize, false)
+
+	if again := app.balanceRepresentation(plain, false, "", 1, maxExpiryPageSize, false); again != base {
+		t.Errorf("same options yield %q and %q", base, again)
+	}
+
+	stringAmounts := httptest.NewRequest(http.MethodGet, "/v1/users/1/balance", nil)
+	stringAmounts.Header.Set("Accept", "application/json; numbers=string")
+	pretty := httptest.NewRequest(http.MethodGet, "/v1/users/1/balance?pretty=1", nil)
+
+	variants := map[string]string{
+		"external user id":   app.balanceRepresentation(plain, true, "", 1, maxExpiryPageSize, false),
+		"category breakdown": app.balanceRepresentation(plain, false, "category", 1, maxExpiryPageSize, false),
+		"second page":        app.balanceRepresentation(plain, false, "", 2, maxExpiryPageSize, false),
+		"page size":          app.balanceRepresentation(plain, false, "", 1, 5, false),
+		"currency":           app.balanceRepresentation(plain, false, "", 1, maxExpiryPageSize, true),
+		"string amounts":     app.balanceRepresentation(stringAmounts, false, "", 1, maxExpiryPageSize, false),
+		"pretty":             app.balanceRepresentation(pretty, false, "", 1, maxExpiryPageSize, false),
+	}
+
+	camelCase := &application{config: config{env: "development", jsonNamingConvention: namingCamelCase}}
+	variants["camelCase"] = camelCase.balanceRepresentation(plain, false, "", 1, maxExpiryPageSize, false)
+
+	seen := map[string]string{base: "no options"}
+	for name, tag := range variants {
+		if other, ok := seen[tag]; ok {
+			t.Errorf("%s has the same representation %q as %q", name, tag, other)
+		}
+		seen[tag] = name
+	}
+}
+
+func TestNewPublicTransactionStatus(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	cancelled := now.Add(-time.Hour)
+
+	tests := []struct {
+		name        string
+		transaction data.Transaction
+		wantType    data.TransactionType
+		wantStatus  string
+	}{
+		{"active grant", data.Transaction{Amount: 100, RemainingAmount: 40, ExpiresAt: now.AddDate(0, 0, 1)}, data.TransactionTypeDeposit, "active"},
+		{"spent grant", data.Transaction{Amount: 100, ExpiresAt: now.AddDate(0, 0, 1)}, data.TransactionTypeDeposit, "spent"},
+		{"expired grant", data.Transaction{Amount: 100, RemainingAmount: 40, ExpiresAt: now}, data.TransactionTypeDeposit, "expired"},
+		{"cancelled grant", data.Transaction{Amount: 100, ExpiresAt: now.AddDate(0, 0, 1), CancelledAt: &cancelled}, data.TransactionTypeDeposit, "cancelled"},
+		{"withdrawal", data.Transaction{Amount: -30}, data.TransactionTypeWithdrawal, "completed"},
+		{"reverted withdrawal", data.Transaction{Amount: -30, CancelledAt: &cancelled}, data.TransactionTypeWithdrawal, "reverted"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pt := newPublicTransaction(tt.transaction, now)
+			if pt.Type != tt.wantType || pt.Status != tt.wantStatus {
+				t.Errorf("got %s %s, want %s %s", pt.Type, pt.Status, tt.wantType, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestValidationErrors(t *testing.T) {
+	app := &application{
+		config:     config{jsonNamingConvention: namingSnakeCase, userIDMode: "uuid", pointsLifetimeDays: 365, depositMultiplier: 1},
+		multiplier: &multiplierOverride{},
+	}
+
+	tests := []struct {
+		name string
+		body string
+		want map[string]string
+	}{
+		{"fractional lifetime_days", `{"user_id": "4f0c6a1e-8f3b-4a57-9c55-0c4b3c2b9b1e", "amount": 10, "type": "deposit", "lifetime_days": 1.5}`, map[string]string{"lifetime_days": "must be a whole number"}},
+		{"fractional amount", `{"user_id": "4f0c6a1e-8f3b-4a57-9c55-0c4b3c2b9b1e", "amount": 10.5, "type": "deposit"}`, map[string]string{"amount": "must be a whole number"}},
+		{"negative amount", `{"user_id": "4f0c6a1e-8f3b-4a57-9c55-0c4b3c2b9b1e", "amount": -1, "type": "withdrawal"}`, map[string]string{"amount": "must be positive"}},
+		{"invalid user_id", `{"user_id": "nope", "amount": -1, "type": "deposit"}`, map[string]string{"user_id": "must be uuid"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			appErr := postTransaction(app, tt.body)
+			if appErr == nil || appErr.StatusCode != http.StatusUnprocessableEntity {
+				t.Fatalf("got %v, want a validation error", appErr)
+			}
+			if !reflect.DeepEqual(appErr.Message, tt.want) {
+				t.Errorf("errors = %v, want %v", appErr.Message, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateTransactionRejectsConcurrentWithdrawal(t *testing.T) {
+	app := testApp(t)
+	userId := uuid.New()
+
+	// The first request still holds the user while the second arrives
+	app.pendingWithdrawals.TryAcquire(userId)
+
+	appErr := postTransaction(app, `{"user_id": "`+userId.String()+`", "amount": 10, "type": "withdrawal"}`)
+	if appErr == nil || appErr.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("got %v, want 429", appErr)
+	}
+	if appErr.Message != "withdrawal in progress" {
+		t.Errorf("message = %v", appErr.Message)
+	}
+
+	app.pendingWithdrawals.Release(userId)
+
+	appErr = postTransaction(app, `{"user_id": "`+userId.String()+`", "amount": 10, "type": "withdrawal"}`)
+	if appErr != nil && appErr.StatusCode == http.StatusTooManyRequests {
+		t.Errorf("withdrawal after release got %v", appErr)
+	}
+}
+
+func TestMonetaryValue(t *testing.T) {
+	app := &application{config: config{pointsPerCurrencyUnit: 100, currencyCode: "USD"}}
+
+	tests := []struct {
+		points int
+		want   string
+	}{
+		{0, "0.00"},
+		{1, "0.01"},
+		{99, "0.99"},
+		{1523, "15.23"},
+		{100000, "1000.00"},
+		{-250, "-2.50"},
+	}
+
+	for _, tt := range tests {
+		got := app.monetaryValue(tt.points)
+		if got["amount"] != tt.want || got["currency"] != "USD" {
+			t.Errorf("monetaryValue(%d) = %v, want %s USD", tt.points, got, tt.want)
+		}
+	}
+
+	app.config.pointsPerCurrencyUnit = 3
+	if got := app.monetaryValue(10)["amount"]; got != "3.33" {
+		t.Errorf("10 points at 3 per unit = %s, want 3.33", got)
+	}
+}
+
+func TestShowUserBalanceUnsupportedCurrency(t *testing.T) {
+	app := &application{config: config{userIDMode: "uuid", currencyCode: "USD"}}
+
+	rr := getBalance(app, uuid.NewString(), "currency=EUR")
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestShowUserBalanceMonetaryValueAfterDeposit(t *testing.T) {
+	app := testApp(t)
+	ctx := context.Background()
+
+	userId := uuid.New()
+	t.Cleanup(func() { app.models.Transactions.DeleteAllForUser(ctx, userId) })
+
+	monetaryValue := func() string {
+		t.Helper()
+
+		rr := getBalance(app, userId.String(), "currency=usd")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", rr.Code, rr.Body)
+		}
+
+		var body struct {
+			MonetaryValue map[string]string `json:"monetary_value"`
+		}
+		if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		return body.MonetaryValue["amount"]
+	}
+
+	if got := monetaryValue(); got != "0.00" {
+		t.Errorf("monetary value of a new user = %s, want 0.00", got)
+	}
+
+	if _, err := app.models.Balances.AddBonusPoints(ctx, data.Grant{UserId: userId, Amount: 1523, LifetimeDays: 30, Category: data.DefaultCategory}, data.DepositOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := monetaryValue(); got != "15.23" {
+		t.Errorf("monetary value after deposit = %s, want 15.23", got)
+	}
+}
+
+func TestShowUserBalanceHeaders(t *testing.T) {
+	app := testApp(t)
+	ctx := context.Background()
+
+	userId := uuid.New()
+	t.Cleanup(func() { app.models.Transactions.DeleteAllForUser(ctx, userId) })
+
+	// A zero balance is reported, not left out
+	rr := getBalance(app, userId.String(), "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rr.Code, rr.Body)
+	}
+	if got := rr.Header().Get("X-Balance"); got != "0" {
+		t.Errorf("X-Balance of a new user = %q, want 0", got)
+	}
+
+	if _, err := app.models.Balances.AddBonusPoints(ctx, data.Grant{UserId: userId, Amount: 250, LifetimeDays: 30, Category: data.DefaultCategory}, data.DepositOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	rr = getBalance(app, userId.String(), "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rr.Code, rr.Body)
+	}
+
+	var balanceResp map[string]any
+	if err := json.NewDecoder(rr.Body).Decode(&balanceResp); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := rr.Header().Get("X-Balance"), strconv.Itoa(int(balanceResp["balance"].(float64))); got != want {
+		t.Errorf("X-Balance = %q, body balance = %s", got, want)
+	}
+
+	updatedAt, err := time.Parse(time.RFC3339, rr.Header().Get("X-Balance-Updated-At"))
+	if err != nil {
+		t.Fatalf("X-Balance-Updated-At: %v", err)
+	}
+	if time.Since(updatedAt) > time.Minute {
+		t.Errorf("X-Balance-Updated-At = %s, want the deposit time", updatedAt)
+	}
+}
@@ -4,6 +4,5 @@ go 1.25.4
 
 require (
 	github.com/google/uuid v1.6.0
-	github.com/julienschmidt/httprouter v1.3.0
 	github.com/lib/pq v1.10.9
 )
@@ -0,0 +1,46 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRUEvictsLeastRecentlyUsed(t *testing.T) {
+	c := NewLRU[string, int](2, time.Hour)
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Get("a")
+	c.Set("c", 3)
+
+	if _, ok := c.Get("b"); ok {
+		t.Error("b was not evicted")
+	}
+	if v, ok := c.Get("a"); !ok || v != 1 {
+		t.Errorf("a = %d, %t; want 1, true", v, ok)
+	}
+	if v, ok := c.Get("c"); !ok || v != 3 {
+		t.Errorf("c = %d, %t; want 3, true", v, ok)
+	}
+}
+
+func TestLRUExpiresEntries(t *testing.T) {
+	c := NewLRU[string, int](2, time.Millisecond)
+	c.Set("a", 1)
+	time.Sleep(5 * time.Millisecond)
+
+	if _, ok := c.Get("a"); ok {
+		t.Error("a did not expire")
+	}
+}
+
+func BenchmarkLRUGet(b *testing.B) {
+	c := NewLRU[int, int](10000, time.Hour)
+	for i := range 10000 {
+		c.Set(i, i)
+	}
+
+	b.ResetTimer()
+	for i := range b.N {
+		c.Get(i % 10000)
+	}
+}
@@ -0,0 +1,139 @@
+// Package circuit implements a circuit breaker that makes callers fail fast
+// while a dependency is down instead of waiting for every call to time out.
+package circuit
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrCircuitOpen = errors.New("circuit open")
+
+type State int
+
+const (
+	// Closed lets every call through and counts consecutive failures
+	Closed State = iota
+	// Open rejects every call until the cooldown has passed
+	Open
+	// HalfOpen lets a single probe through, its outcome closes or reopens the circuit
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// Breaker opens after threshold consecutive failures within window and
+// allows a probe once cooldown has passed since it opened
+type Breaker struct {
+	mu           sync.Mutex
+	state        State
+	failures     int
+	firstFailure time.Time
+	openedAt     time.Time
+	probing      bool
+
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+	now       func() time.Time
+}
+
+func New(threshold int, window, cooldown time.Duration) *Breaker {
+	return &Breaker{
+		threshold: threshold,
+		window:    window,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// Allow reports whether a call may proceed, ErrCircuitOpen means it must
+// not. Every allowed call must be followed by Success or Failure.
+func (b *Breaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.advance()
+
+	switch b.state {
+	case Open:
+		return ErrCircuitOpen
+	case HalfOpen:
+		if b.probing {
+			return ErrCircuitOpen
+		}
+		b.probing = true
+	}
+
+	return nil
+}
+
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Calls started before the circuit opened must not close it
+	if b.state == Open {
+		return
+	}
+
+	b.state = Closed
+	b.failures = 0
+	b.probing = false
+}
+
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+
+	switch b.state {
+	case HalfOpen:
+		b.open(now)
+	case Closed:
+		if b.failures == 0 || now.Sub(b.firstFailure) > b.window {
+			b.failures = 0
+			b.firstFailure = now
+		}
+		b.failures++
+		if b.failures >= b.threshold {
+			b.open(now)
+		}
+	}
+}
+
+// State returns the current state, an open circuit whose cooldown has
+// passed is reported as half-open
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.advance()
+	return b.state
+}
+
+func (b *Breaker) open(now time.Time) {
+	b.state = Open
+	b.openedAt = now
+	b.failures = 0
+	b.probing = false
+}
+
+// advance moves an open circuit to half-open once the cooldown has passed
+func (b *Breaker) advance() {
+	if b.state == Open && b.now().Sub(b.openedAt) >= b.cooldown {
+		b.state = HalfOpen
+		b.probing = false
+	}
+}
@@ -0,0 +1,129 @@
+package circuit
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// newTestBreaker returns a breaker with the production thresholds whose
+// clock is moved with the returned function
+func newTestBreaker() (*Breaker, func(time.Duration)) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	b := New(5, 10*time.Second, 30*time.Second)
+	b.now = func() time.Time { return now }
+	return b, func(d time.Duration) { now = now.Add(d) }
+}
+
+func fail(b *Breaker, n int) {
+	for range n {
+		if b.Allow() == nil {
+			b.Failure()
+		}
+	}
+}
+
+func assertState(t *testing.T, b *Breaker, want State) {
+	t.Helper()
+	if got := b.State(); got != want {
+		t.Fatalf("state %s, want %s", got, want)
+	}
+}
+
+func TestBreakerOpensAfterThreshold(t *testing.T) {
+	b, _ := newTestBreaker()
+
+	fail(b, 4)
+	assertState(t, b, Closed)
+
+	fail(b, 1)
+	assertState(t, b, Open)
+
+	if err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Allow on open circuit = %v, want ErrCircuitOpen", err)
+	}
+}
+
+func TestBreakerCountsFailuresWithinWindow(t *testing.T) {
+	b, advance := newTestBreaker()
+
+	fail(b, 4)
+	advance(11 * time.Second)
+	fail(b, 1)
+	assertState(t, b, Closed)
+}
+
+func TestBreakerSuccessResetsFailures(t *testing.T) {
+	b, _ := newTestBreaker()
+
+	fail(b, 4)
+	b.Allow()
+	b.Success()
+	fail(b, 4)
+	assertState(t, b, Closed)
+}
+
+func TestBreakerHalfOpenAfterCooldown(t *testing.T) {
+	b, advance := newTestBreaker()
+
+	fail(b, 5)
+	advance(29 * time.Second)
+	assertState(t, b, Open)
+
+	advance(time.Second)
+	assertState(t, b, HalfOpen)
+
+	if err := b.Allow(); err != nil {
+		t.Fatalf("probe rejected: %v", err)
+	}
+	if err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("second call during probe = %v, want ErrCircuitOpen", err)
+	}
+}
+
+func TestBreakerProbeSuccessCloses(t *testing.T) {
+	b, advance := newTestBreaker()
+
+	fail(b, 5)
+	advance(30 * time.Second)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("probe rejected: %v", err)
+	}
+	b.Success()
+
+	assertState(t, b, Closed)
+	if err := b.Allow(); err != nil {
+		t.Errorf("Allow on closed circuit = %v", err)
+	}
+}
+
+func TestBreakerProbeFailureReopens(t *testing.T) {
+	b, advance := newTestBreaker()
+
+	fail(b, 5)
+	advance(30 * time.Second)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("probe rejected: %v", err)
+	}
+	b.Failure()
+	assertState(t, b, Open)
+
+	// The cooldown starts over
+	advance(29 * time.Second)
+	assertState(t, b, Open)
+	advance(time.Second)
+	assertState(t, b, HalfOpen)
+}
+
+func TestBreakerIgnoresSuccessWhileOpen(t *testing.T) {
+	b, _ := newTestBreaker()
+
+	// A call allowed before the circuit opened finishes afterwards
+	if err := b.Allow(); err != nil {
+		t.Fatal(err)
+	}
+	fail(b, 5)
+	b.Success()
+
+	assertState(t, b, Open)
+}
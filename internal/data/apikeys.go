@@ -0,0 +1,105 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"simple-ledger.itmo.ru/internal/validator"
+	"slices"
+	"time"
+)
+
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+)
+
+// ApiKey lets a user access their own account. Only the SHA-256 hash of the
+// key is stored, keys are random enough that a slow hash adds nothing.
+type ApiKey struct {
+	Id         uuid.UUID  `json:"id"`
+	UserId     uuid.UUID  `json:"user_id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	Scopes     []string   `json:"scopes"`
+}
+
+func (k *ApiKey) HasScope(scope string) bool {
+	return slices.Contains(k.Scopes, scope)
+}
+
+func ValidateScopes(v *validator.LocalizedValidator, scopes []string) {
+	v.CheckMsg(len(scopes) > 0, "scopes", "must_contain_at_least_one", "scope")
+	v.CheckMsg(validator.IsUnique(scopes), "scopes", "must_not_contain_duplicates", nil)
+	for _, scope := range scopes {
+		v.CheckMsg(validator.IsPermitted(scope, ScopeRead, ScopeWrite), "scopes", "must_only_contain_scopes", nil)
+	}
+}
+
+type ApiKeyModel struct {
+	DB Querier
+}
+
+func hashKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// Create stores a new key of the user and returns it in plain text, it
+// cannot be recovered afterwards
+func (m ApiKeyModel) Create(ctx context.Context, userId uuid.UUID, scopes []string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	key := base64.RawURLEncoding.EncodeToString(b)
+
+	query := `
+		INSERT INTO api_keys (user_id, key_hash, scopes)
+		VALUES ($1, $2, $3)`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	if _, err := m.DB.ExecContext(ctx, query, userId, hashKey(key), pq.Array(scopes)); err != nil {
+		return "", err
+	}
+
+	return key, nil
+}
+
+// Verify looks the key up by its hash and records its use. An unknown key
+// yields ErrRecordNotFound.
+func (m ApiKeyModel) Verify(ctx context.Context, key string) (*ApiKey, error) {
+	query := `
+		UPDATE api_keys
+		SET last_used_at = NOW()
+		WHERE key_hash = $1
+		RETURNING id, user_id, created_at, last_used_at, scopes`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var apiKey ApiKey
+	err := m.DB.QueryRowContext(ctx, query, hashKey(key)).Scan(
+		&apiKey.Id,
+		&apiKey.UserId,
+		&apiKey.CreatedAt,
+		&apiKey.LastUsedAt,
+		pq.Array(&apiKey.Scopes),
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRecordNotFound
+		}
+		return nil, err
+	}
+
+	return &apiKey, nil
+}
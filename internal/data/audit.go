@@ -0,0 +1,68 @@
+package data
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"time"
+)
+
+// AuditLogEntry is a change to a transaction row recorded by the
+// transactions_audit trigger. Old values are nil for INSERT, new values
+// for DELETE.
+type AuditLogEntry struct {
+	Operation     string     `json:"operation"`
+	TransactionId uuid.UUID  `json:"transaction_id"`
+	OldRemaining  *int       `json:"old_remaining"`
+	NewRemaining  *int       `json:"new_remaining"`
+	OldExpiresAt  *time.Time `json:"old_expires_at"`
+	NewExpiresAt  *time.Time `json:"new_expires_at"`
+	ChangedAt     time.Time  `json:"changed_at"`
+}
+
+// GetAuditLog returns the recorded changes of a transaction, oldest first.
+// Entries outlive the transaction, ErrRecordNotFound means none exist.
+func (m TransactionModel) GetAuditLog(ctx context.Context, txID uuid.UUID) ([]AuditLogEntry, error) {
+	query := `
+		SELECT operation, transaction_id, old_remaining, new_remaining,
+			old_expires_at, new_expires_at, changed_at
+		FROM transaction_audit_log
+		WHERE transaction_id = $1
+		ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, txID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []AuditLogEntry{}
+	for rows.Next() {
+		var entry AuditLogEntry
+		err := rows.Scan(
+			&entry.Operation,
+			&entry.TransactionId,
+			&entry.OldRemaining,
+			&entry.NewRemaining,
+			&entry.OldExpiresAt,
+			&entry.NewExpiresAt,
+			&entry.ChangedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(entries) == 0 {
+		return nil, ErrRecordNotFound
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,59 @@
+package data
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"time"
+)
+
+// FreezeUser blocks all deposits and withdrawals of a user, freezing an
+// already frozen user updates the reason
+func (m BalanceModel) FreezeUser(ctx context.Context, userId uuid.UUID, reason, by string) error {
+	query := `
+		INSERT INTO frozen_users (user_id, reason, frozen_by)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE
+		SET reason = EXCLUDED.reason, frozen_by = EXCLUDED.frozen_by, frozen_at = NOW()`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userId, reason, by)
+	return err
+}
+
+func (m BalanceModel) UnfreezeUser(ctx context.Context, userId uuid.UUID) error {
+	query := `
+		DELETE FROM frozen_users
+		WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userId)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (m TransactionModel) IsUserFrozen(ctx context.Context, userId uuid.UUID) (bool, error) {
+	query := `SELECT EXISTS (SELECT 1 FROM frozen_users WHERE user_id = $1)`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var frozen bool
+	err := m.DB.QueryRowContext(ctx, query, userId).Scan(&frozen)
+	return frozen, err
+}
@@ -1,21 +1,64 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"time"
 )
 
 var (
-	ErrRecordNotFound   = errors.New("record not found")
+	ErrRecordNotFound    = errors.New("record not found")
 	ErrInsufficientFunds = errors.New("insufficient funds")
+	ErrDebtLimitExceeded = errors.New("debt limit exceeded")
+
+	ErrTransactionLimitExceeded = errors.New("too many active transactions")
+	ErrLockTimeout              = errors.New("lock timeout")
+	ErrAlreadyReverted          = errors.New("withdrawal already reverted")
+	ErrNotRevertible            = errors.New("withdrawals into debt cannot be reverted")
+	ErrUserFrozen               = errors.New("account is frozen")
+	ErrConditionNotMet          = errors.New("balance is not below conditional_max_balance")
+
+	ErrDailyWithdrawalLimitExceeded = errors.New("daily withdrawal limit exceeded")
 )
 
+// Querier is the part of *sql.DB used by the models, it allows wrapping
+// the connection pool (e.g. for query logging)
+type Querier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// Timeouts bound the database work of the balance model methods, on top of
+// any deadline of the context they are given
+type Timeouts struct {
+	AddBonusPoints     time.Duration
+	BulkAddBonusPoints time.Duration
+	Withdraw           time.Duration
+	GetBalance         time.Duration
+}
+
+var DefaultTimeouts = Timeouts{
+	AddBonusPoints:     3 * time.Second,
+	BulkAddBonusPoints: 5 * time.Second,
+	Withdraw:           5 * time.Second,
+	GetBalance:         3 * time.Second,
+}
+
 type Models struct {
-	Balances BalanceModel
+	Balances      BalanceModel
+	Transactions  TransactionModel
+	Notifications NotificationModel
+	ApiKeys       ApiKeyModel
 }
 
-func NewModels(db *sql.DB) Models {
+func NewModels(db Querier) Models {
 	return Models{
-		Balances: BalanceModel{DB: db},
+		Balances:      BalanceModel{DB: db, Timeouts: DefaultTimeouts},
+		Transactions:  TransactionModel{DB: db},
+		Notifications: NotificationModel{DB: db},
+		ApiKeys:       ApiKeyModel{DB: db},
 	}
 }
@@ -0,0 +1,68 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/google/uuid"
+	_ "github.com/lib/pq"
+	"testing"
+	"time"
+)
+
+// TestCancelledContext checks that model methods give up on a cancelled
+// request context instead of waiting for their own timeout. The DSN points
+// at a closed port, database/sql checks the context before dialing.
+func TestCancelledContext(t *testing.T) {
+	db, err := sql.Open("postgres", "postgres://ledger@127.0.0.1:1/ledger?connect_timeout=10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	models := NewModels(db)
+	userId := uuid.New()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	calls := map[string]func() error{
+		"AddBonusPoints": func() error {
+			_, err := models.Balances.AddBonusPoints(ctx, Grant{UserId: userId, Amount: 10, LifetimeDays: 30}, DepositOptions{})
+			return err
+		},
+		"WithdrawBonusPoints": func() error {
+			_, err := models.Balances.WithdrawBonusPoints(ctx, userId, 10, WithdrawOptions{})
+			return err
+		},
+		"GetBalanceWithExpiration": func() error {
+			_, _, err := models.Balances.GetBalanceWithExpiration(ctx, userId, 0, 0)
+			return err
+		},
+		"RevertWithdrawal": func() error {
+			_, err := models.Balances.RevertWithdrawal(ctx, uuid.New())
+			return err
+		},
+		"GetTopSpenders": func() error {
+			_, err := models.Transactions.GetTopSpenders(ctx, 10, time.Now().AddDate(0, -1, 0))
+			return err
+		},
+		"ExpireByCategory": func() error {
+			_, err := models.Transactions.ExpireByCategory(ctx, DefaultCategory, "test")
+			return err
+		},
+	}
+
+	for name, call := range calls {
+		t.Run(name, func(t *testing.T) {
+			start := time.Now()
+			err := call()
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("got error %v, want context.Canceled", err)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("returned after %s", elapsed)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/google/uuid"
+	"time"
+)
+
+const (
+	NotificationExpiryWarning  = "expiry_warning"
+	NotificationExpiryOccurred = "expiry_occurred"
+)
+
+type Notification struct {
+	Id             int64      `json:"id"`
+	UserId         uuid.UUID  `json:"user_id"`
+	Type           string     `json:"type"`
+	Points         int        `json:"points"`
+	ExpiresOn      time.Time  `json:"expires_on"`
+	SentAt         *time.Time `json:"sent_at,omitempty"`
+	DeliveryStatus string     `json:"delivery_status"`
+}
+
+// ExpiringPoints are the points of a user expiring on one day
+type ExpiringPoints struct {
+	UserId    uuid.UUID
+	ExpiresOn time.Time
+	Points    int
+}
+
+type NotificationModel struct {
+	DB Querier
+}
+
+// CreatePending stores a notification waiting for delivery. A notification
+// of the same type for the same user and expiry date is only stored once,
+// for a duplicate ErrRecordNotFound is returned.
+func (m NotificationModel) CreatePending(ctx context.Context, userId uuid.UUID, nType string, points int, expiresOn time.Time) (*Notification, error) {
+	query := `
+		INSERT INTO notifications (user_id, type, points, expires_on)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, type, expires_on) DO NOTHING
+		RETURNING id, delivery_status`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	notification := &Notification{
+		UserId:    userId,
+		Type:      nType,
+		Points:    points,
+		ExpiresOn: expiresOn,
+	}
+
+	err := m.DB.QueryRowContext(ctx, query, userId, nType, points, expiresOn).Scan(
+		&notification.Id,
+		&notification.DeliveryStatus,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return notification, nil
+}
+
+// SetDeliveryStatus records the outcome of a delivery attempt
+func (m NotificationModel) SetDeliveryStatus(ctx context.Context, id int64, status string) error {
+	query := `
+		UPDATE notifications
+		SET delivery_status = $2, sent_at = CASE WHEN $2 = 'sent' THEN NOW() ELSE sent_at END
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id, status)
+	return err
+}
+
+// ListUnnotifiedExpiring returns the points expiring within leadDays days,
+// grouped by user and day, for which no expiry warning was created yet
+func (m NotificationModel) ListUnnotifiedExpiring(ctx context.Context, leadDays int) ([]ExpiringPoints, error) {
+	query := `
+		SELECT t.user_id, DATE(t.expires_at) AS expires_on, SUM(t.remaining_amount)
+		FROM transactions t
+		WHERE t.remaining_amount > 0
+			AND t.expires_at > get_now()
+			AND t.expires_at <= get_now() + $1 * INTERVAL '1 day'
+			AND NOT EXISTS (
+				SELECT 1
+				FROM notifications n
+				WHERE n.user_id = t.user_id
+					AND n.type = 'expiry_warning'
+					AND n.expires_on = DATE(t.expires_at)
+			)
+		GROUP BY t.user_id, DATE(t.expires_at)
+		ORDER BY expires_on, t.user_id`
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, leadDays)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var expiring []ExpiringPoints
+	for rows.Next() {
+		var points ExpiringPoints
+		if err := rows.Scan(&points.UserId, &points.ExpiresOn, &points.Points); err != nil {
+			return nil, err
+		}
+		expiring = append(expiring, points)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return expiring, nil
+}
@@ -0,0 +1,48 @@
+package data
+
+import (
+	"math"
+	"simple-ledger.itmo.ru/internal/validator"
+)
+
+type Pagination struct {
+	Page     int
+	PageSize int
+}
+
+func (p Pagination) limit() int {
+	return p.PageSize
+}
+
+func (p Pagination) offset() int {
+	return (p.Page - 1) * p.PageSize
+}
+
+func ValidatePagination(v *validator.LocalizedValidator, p Pagination) {
+	v.CheckMsg(p.Page > 0, "page", "must_be_greater_than_zero", nil)
+	v.CheckMsg(p.Page <= 10_000_000, "page", "must_be_maximum", 10_000_000)
+	v.CheckMsg(p.PageSize > 0, "page_size", "must_be_greater_than_zero", nil)
+	v.CheckMsg(p.PageSize <= 100, "page_size", "must_be_maximum", 100)
+}
+
+type ListMetadata struct {
+	CurrentPage  int `json:"current_page,omitempty"`
+	PageSize     int `json:"page_size,omitempty"`
+	FirstPage    int `json:"first_page,omitempty"`
+	LastPage     int `json:"last_page,omitempty"`
+	TotalRecords int `json:"total_records,omitempty"`
+}
+
+func calculateMetadata(totalRecords, page, pageSize int) ListMetadata {
+	if totalRecords == 0 {
+		return ListMetadata{}
+	}
+
+	return ListMetadata{
+		CurrentPage:  page,
+		PageSize:     pageSize,
+		FirstPage:    1,
+		LastPage:     int(math.Ceil(float64(totalRecords) / float64(pageSize))),
+		TotalRecords: totalRecords,
+	}
+}
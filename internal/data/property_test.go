@@ -0,0 +1,195 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// operation is a deposit or a withdrawal of a property test
+type operation struct {
+	deposit      bool
+	amount       int
+	lifetimeDays int
+}
+
+func (op operation) String() string {
+	if op.deposit {
+		return fmt.Sprintf("deposit %d for %d days", op.amount, op.lifetimeDays)
+	}
+	return fmt.Sprintf("withdraw %d", op.amount)
+}
+
+// decodeOperations turns fuzz input into deposits of 1-10000 points living
+// 1-365 days and withdrawals of 1 up to the total deposited so far
+func decodeOperations(input []byte) []operation {
+	var ops []operation
+	total := 0
+	for len(input) >= 4 {
+		kind, amount, lifetime := input[0], int(input[1])<<8|int(input[2]), int(input[3])
+		input = input[4:]
+
+		if kind%2 == 0 || total == 0 {
+			op := operation{deposit: true, amount: amount%10000 + 1, lifetimeDays: lifetime%365 + 1}
+			total += op.amount
+			ops = append(ops, op)
+		} else {
+			ops = append(ops, operation{amount: amount%total + 1})
+		}
+	}
+	return ops
+}
+
+// runOperations applies ops to a new user, checking after every step that
+// the balance matches the accepted operations and never goes negative, and
+// that every withdrawal consumed the soonest expiring grants first
+func runOperations(t *testing.T, models Models, ops []operation) {
+	ctx := context.Background()
+	userId := uuid.New()
+	t.Cleanup(func() { models.Transactions.DeleteAllForUser(ctx, userId) })
+
+	var done []string
+	fail := func(format string, args ...any) {
+		t.Fatalf("%s after:\n\t%s", fmt.Sprintf(format, args...), strings.Join(done, "\n\t"))
+	}
+
+	want := 0
+	for _, op := range ops {
+		done = append(done, op.String())
+
+		if op.deposit {
+			grant := Grant{UserId: userId, Amount: op.amount, LifetimeDays: op.lifetimeDays, Category: DefaultCategory}
+			if _, err := models.Balances.AddBonusPoints(ctx, grant, DepositOptions{}); err != nil {
+				fail("deposit failed: %v", err)
+			}
+			want += op.amount
+		} else {
+			withdrawal, err := models.Balances.WithdrawBonusPoints(ctx, userId, op.amount, WithdrawOptions{})
+			switch {
+			case op.amount > want && !errors.Is(err, ErrInsufficientFunds):
+				fail("withdrawal over the balance of %d: %v", want, err)
+			case op.amount <= want && err != nil:
+				fail("withdrawal within the balance of %d failed: %v", want, err)
+			case err == nil:
+				want -= op.amount
+				checkSoonestExpiringConsumed(t, models, withdrawal.Id, fail)
+			}
+		}
+
+		balance, _, err := models.Balances.GetBalanceWithExpiration(ctx, userId, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if balance < 0 {
+			fail("negative balance %d", balance)
+		}
+		if balance != want {
+			fail("balance %d, want %d", balance, want)
+		}
+	}
+}
+
+// checkSoonestExpiringConsumed fails when a live grant expiring before the
+// last grant a withdrawal took from still has points left
+func checkSoonestExpiringConsumed(t *testing.T, models Models, withdrawalId uuid.UUID, fail func(string, ...any)) {
+	query := fmt.Sprintf(`
+		WITH ordered AS (
+			SELECT t.id, t.remaining_amount, ROW_NUMBER() OVER (ORDER BY %s) AS position
+			FROM transactions t
+			WHERE t.user_id = (SELECT user_id FROM transactions WHERE id = $1)
+				AND t.expires_at > get_now()
+				AND t.amount > 0
+		)
+		SELECT COUNT(*)
+		FROM ordered
+		WHERE remaining_amount > 0
+			AND position < (
+				SELECT MAX(o.position)
+				FROM ordered o
+				JOIN withdrawal_events e ON e.transaction_id = o.id
+				WHERE e.withdrawal_id = $1
+			)`, withdrawOrder[StrategySoonestExpiring])
+
+	var skipped int
+	if err := models.Transactions.DB.QueryRowContext(context.Background(), query, withdrawalId).Scan(&skipped); err != nil {
+		t.Fatal(err)
+	}
+	if skipped > 0 {
+		fail("withdrawal skipped %d grants expiring sooner", skipped)
+	}
+}
+
+// FuzzBalanceInvariants covers TestPropertyBalanceNeverNegative and
+// TestPropertyFIFOAlwaysConsumesEarliest of the request, with Go's native
+// fuzzing instead of rapid: go test runs the seeds, go test -fuzz explores
+func FuzzBalanceInvariants(f *testing.F) {
+	f.Add([]byte{0, 0, 100, 30, 1, 0, 50, 0})
+	f.Add([]byte{0, 1, 0, 200, 0, 0, 10, 1, 1, 1, 0, 0, 1, 0, 20, 0})
+	f.Add([]byte{1, 39, 15, 0, 0, 39, 15, 200, 1, 255, 255, 0})
+
+	f.Fuzz(func(t *testing.T, input []byte) {
+		ops := decodeOperations(input)
+		if len(ops) == 0 || len(ops) > 50 {
+			t.Skip()
+		}
+		runOperations(t, NewModels(testDB(t)), ops)
+	})
+}
+
+func TestPropertyConcurrentWithdrawalsNeverOverdraw(t *testing.T) {
+	models := NewModels(testDB(t))
+	ctx := context.Background()
+
+	for run := range 10 {
+		rng := rand.New(rand.NewPCG(uint64(run), 0))
+		userId := uuid.New()
+		t.Cleanup(func() { models.Transactions.DeleteAllForUser(ctx, userId) })
+
+		deposited := 0
+		for range rng.IntN(5) + 1 {
+			amount := rng.IntN(10000) + 1
+			grant := Grant{UserId: userId, Amount: amount, LifetimeDays: rng.IntN(365) + 1, Category: DefaultCategory}
+			if _, err := models.Balances.AddBonusPoints(ctx, grant, DepositOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			deposited += amount
+		}
+
+		amounts := make([]int, 20)
+		for i := range amounts {
+			amounts[i] = rng.IntN(deposited) + 1
+		}
+
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		withdrawn := 0
+		for _, amount := range amounts {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := models.Balances.WithdrawBonusPoints(ctx, userId, amount, WithdrawOptions{})
+				if err == nil {
+					mu.Lock()
+					withdrawn += amount
+					mu.Unlock()
+				} else if !errors.Is(err, ErrInsufficientFunds) && !isSerializationFailure(err) {
+					t.Errorf("withdraw %d: %v", amount, err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		balance, _, err := models.Balances.GetBalanceWithExpiration(ctx, userId, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if withdrawn > deposited || balance != deposited-withdrawn {
+			t.Fatalf("deposited %d, concurrent withdrawals %v took %d, balance %d", deposited, amounts, withdrawn, balance)
+		}
+	}
+}
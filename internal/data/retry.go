@@ -0,0 +1,53 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/lib/pq"
+	"math/rand/v2"
+	"time"
+)
+
+// serializationFailure is the SQLSTATE PostgreSQL returns when a transaction
+// could not be serialized with concurrent ones, retrying it is safe
+const serializationFailure = "40001"
+
+// lockNotAvailable is the SQLSTATE of a statement cancelled by lock_timeout
+const lockNotAvailable = "55P03"
+
+// serializable is the isolation level of the transactions run by withRetry,
+// PostgreSQL only reports serialization failures at this level
+var serializable = &sql.TxOptions{Isolation: sql.LevelSerializable}
+
+// withRetry runs fn up to n times while it fails with a serialization
+// failure, sleeping a random 0-100ms between attempts. It gives up with the
+// error of ctx when ctx ends during the sleep.
+func withRetry(ctx context.Context, n int, fn func() error) error {
+	var err error
+	for attempt := 1; attempt <= n; attempt++ {
+		err = fn()
+		if !isSerializationFailure(err) || attempt == n {
+			break
+		}
+
+		timer := time.NewTimer(rand.N(100 * time.Millisecond))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return err
+}
+
+func isSerializationFailure(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == serializationFailure
+}
+
+func isLockNotAvailable(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == lockNotAvailable
+}
@@ -0,0 +1,75 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"github.com/lib/pq"
+	"testing"
+	"time"
+)
+
+// failing returns a fn failing with err for the first failures calls, and
+// the number of calls made so far
+func failing(failures int, err error) (func() error, *int) {
+	calls := 0
+	return func() error {
+		calls++
+		if calls <= failures {
+			return err
+		}
+		return nil
+	}, &calls
+}
+
+func TestWithRetry(t *testing.T) {
+	serialization := &pq.Error{Code: serializationFailure}
+	lockTimeout := &pq.Error{Code: lockNotAvailable}
+	other := errors.New("connection refused")
+
+	tests := []struct {
+		name      string
+		failures  int
+		err       error
+		wantCalls int
+		wantErr   error
+	}{
+		{"success", 0, nil, 1, nil},
+		{"retried serialization failure", 2, serialization, 3, nil},
+		{"serialization failure on every attempt", 5, serialization, 3, serialization},
+		{"other error", 5, other, 1, other},
+		{"lock timeout", 5, lockTimeout, 1, lockTimeout},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fn, calls := failing(tt.failures, tt.err)
+
+			err := withRetry(context.Background(), 3, fn)
+			if *calls != tt.wantCalls {
+				t.Errorf("fn called %d times, want %d", *calls, tt.wantCalls)
+			}
+			if err != tt.wantErr {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWithRetryStopsOnCancelledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	fn, calls := failing(5, &pq.Error{Code: serializationFailure})
+
+	start := time.Now()
+	err := withRetry(ctx, 1000, fn)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want context.Canceled", err)
+	}
+	if *calls != 1 {
+		t.Errorf("fn called %d times after cancellation, want 1", *calls)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("returned after %s", elapsed)
+	}
+}
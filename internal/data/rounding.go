@@ -0,0 +1,36 @@
+package data
+
+import (
+	"math"
+)
+
+// RoundingMode decides how fractional points produced by a deposit
+// multiplier are turned into whole points
+type RoundingMode string
+
+const (
+	RoundFloor   RoundingMode = "floor"
+	RoundCeil    RoundingMode = "ceil"
+	RoundNearest RoundingMode = "round"
+)
+
+func (m RoundingMode) Valid() bool {
+	return m == RoundFloor || m == RoundCeil || m == RoundNearest
+}
+
+// RoundAmount returns amount multiplied by multiplier and rounded with mode,
+// halves are rounded away from zero in RoundNearest mode
+func RoundAmount(amount int, multiplier float64, mode RoundingMode) int {
+	// Drop float noise first, otherwise 100 * 1.1 = 110.00000000000001
+	// would be rounded up to 111 in ceil mode
+	value := math.Round(float64(amount)*multiplier*1e6) / 1e6
+
+	switch mode {
+	case RoundFloor:
+		return int(math.Floor(value))
+	case RoundCeil:
+		return int(math.Ceil(value))
+	default:
+		return int(math.Round(value))
+	}
+}
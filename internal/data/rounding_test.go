@@ -0,0 +1,53 @@
+package data
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRoundAmount(t *testing.T) {
+	tests := []struct {
+		name       string
+		amount     int
+		multiplier float64
+		mode       RoundingMode
+		want       int
+	}{
+		{"floor half", 99, 1.5, RoundFloor, 148},
+		{"ceil half", 99, 1.5, RoundCeil, 149},
+		{"round half", 99, 1.5, RoundNearest, 149},
+		{"round below half", 101, 1.2, RoundNearest, 121},
+		{"exact", 100, 1.5, RoundCeil, 150},
+		{"float noise", 100, 1.1, RoundCeil, 110},
+		{"zero floor", 0, 1.5, RoundFloor, 0},
+		{"zero ceil", 0, 1.5, RoundCeil, 0},
+		{"one floor", 1, 1.5, RoundFloor, 1},
+		{"one ceil", 1, 1.5, RoundCeil, 2},
+		{"one round", 1, 1.5, RoundNearest, 2},
+		{"below one floor", 3, 0.5, RoundFloor, 1},
+		{"below one ceil", 3, 0.5, RoundCeil, 2},
+		{"below one round", 3, 0.5, RoundNearest, 2},
+		{"below one to zero", 1, 0.3, RoundFloor, 0},
+		{"large", math.MaxInt32, 2, RoundNearest, 2 * math.MaxInt32},
+		{"large fraction", 1_000_000_001, 1.5, RoundFloor, 1_500_000_001},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := RoundAmount(tt.amount, tt.multiplier, tt.mode); got != tt.want {
+				t.Errorf("RoundAmount(%d, %v, %s) = %d, want %d", tt.amount, tt.multiplier, tt.mode, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoundingModeValid(t *testing.T) {
+	for _, mode := range []RoundingMode{RoundFloor, RoundCeil, RoundNearest} {
+		if !mode.Valid() {
+			t.Errorf("%q is not valid", mode)
+		}
+	}
+	if RoundingMode("up").Valid() {
+		t.Error(`"up" is valid`)
+	}
+}
@@ -0,0 +1,140 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	"time"
+)
+
+// BalanceSnapshot is an immutable copy of a user's balance at SnapshotAt
+type BalanceSnapshot struct {
+	Id          uuid.UUID      `json:"id"`
+	UserId      uuid.UUID      `json:"user_id"`
+	Balance     int            `json:"balance"`
+	Expirations map[string]int `json:"expirations"`
+	SnapshotAt  time.Time      `json:"snapshot_at"`
+	Label       string         `json:"label,omitempty"`
+}
+
+// CreateSnapshot persists the current balance and expirations of a user
+func (m TransactionModel) CreateSnapshot(ctx context.Context, userId uuid.UUID, label string) (*BalanceSnapshot, error) {
+	balance, list, err := BalanceModel{DB: m.DB, Timeouts: DefaultTimeouts}.GetBalanceWithExpiration(ctx, userId, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// Snapshots keep the date -> amount object they were stored with
+	expirations := make(map[string]int, len(list))
+	for _, e := range list {
+		expirations[e.Date] = e.Amount
+	}
+
+	raw, err := json.Marshal(expirations)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &BalanceSnapshot{
+		UserId:      userId,
+		Balance:     balance,
+		Expirations: expirations,
+		Label:       label,
+	}
+
+	query := `
+		INSERT INTO balance_snapshots (user_id, balance, expirations, label)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, snapshot_at`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, query, userId, balance, raw, label).Scan(&snapshot.Id, &snapshot.SnapshotAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return snapshot, nil
+}
+
+func (m TransactionModel) GetSnapshot(ctx context.Context, id uuid.UUID) (*BalanceSnapshot, error) {
+	query := `
+		SELECT id, user_id, balance, expirations, snapshot_at, label
+		FROM balance_snapshots
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	snapshot, err := scanSnapshot(m.DB.QueryRowContext(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return snapshot, nil
+}
+
+// ListSnapshots returns all snapshots of a user, newest first
+func (m TransactionModel) ListSnapshots(ctx context.Context, userId uuid.UUID) ([]BalanceSnapshot, error) {
+	query := `
+		SELECT id, user_id, balance, expirations, snapshot_at, label
+		FROM balance_snapshots
+		WHERE user_id = $1
+		ORDER BY snapshot_at DESC, id`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	snapshots := []BalanceSnapshot{}
+	for rows.Next() {
+		snapshot, err := scanSnapshot(rows)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, *snapshot)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return snapshots, nil
+}
+
+// scanSnapshot decodes a balance_snapshots row from *sql.Row or *sql.Rows
+func scanSnapshot(row interface{ Scan(...any) error }) (*BalanceSnapshot, error) {
+	var snapshot BalanceSnapshot
+	var raw []byte
+
+	err := row.Scan(
+		&snapshot.Id,
+		&snapshot.UserId,
+		&snapshot.Balance,
+		&raw,
+		&snapshot.SnapshotAt,
+		&snapshot.Label,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(raw, &snapshot.Expirations); err != nil {
+		return nil, err
+	}
+
+	return &snapshot, nil
+}
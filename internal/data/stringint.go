@@ -0,0 +1,30 @@
+package data
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// StringInt is an integer encoded as a quoted decimal string, so that values
+// above 2^53 survive clients which parse JSON numbers as float64. It decodes
+// from both a string and a plain number.
+type StringInt int64
+
+func (i StringInt) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(strconv.FormatInt(int64(i), 10))), nil
+}
+
+func (i *StringInt) UnmarshalJSON(b []byte) error {
+	s := string(b)
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid integer %s", b)
+	}
+
+	*i = StringInt(v)
+	return nil
+}
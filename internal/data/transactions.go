@@ -4,7 +4,14 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"math"
+	"regexp"
+	"simple-ledger.itmo.ru/internal/sqlbuilder"
+	"simple-ledger.itmo.ru/internal/validator"
+	"strings"
 	"time"
 )
 
@@ -15,67 +22,444 @@ type Balance struct {
 }
 
 type Transaction struct {
-	Id              uuid.UUID `json:"id"`
-	UserId          uuid.UUID `json:"user_id"`
-	Amount          int       `json:"amount"`
-	CreatedAt       time.Time `json:"created_at"`
-	ExpiresAt       time.Time `json:"expires_at"`
-	RemainingAmount int       `json:"remaining_amount"`
+	Id              uuid.UUID  `json:"id"`
+	UserId          uuid.UUID  `json:"user_id"`
+	ExternalUserId  string     `json:"external_user_id,omitempty"`
+	Amount          int        `json:"amount"`
+	CreatedAt       time.Time  `json:"created_at"`
+	ExpiresAt       time.Time  `json:"expires_at"`
+	RemainingAmount int        `json:"remaining_amount"`
+	Category        string     `json:"category"`
+	Tags            []string   `json:"tags"`
+	DisplayName     string     `json:"display_name"`
+	Reference       string     `json:"reference,omitempty"`
+	CancelledAt     *time.Time `json:"cancelled_at,omitempty"`
+}
+
+// Grant describes a single deposit of bonus points
+type Grant struct {
+	UserId         uuid.UUID
+	ExternalUserId string
+	Amount         int
+	LifetimeDays   int
+	Category       string
+	Tags           []string
+}
+
+// TransactionType is the kind of a transaction request
+type TransactionType string
+
+const (
+	TransactionTypeDeposit    TransactionType = "deposit"
+	TransactionTypeWithdrawal TransactionType = "withdrawal"
+)
+
+func (t TransactionType) IsValid() bool {
+	return validator.IsPermitted(t, TransactionTypeDeposit, TransactionTypeWithdrawal)
+}
+
+// DefaultCategory is stored for grants deposited without a category
+const DefaultCategory = "default"
+
+// displayNameTagPrefix marks a tag holding the display name of a grant
+const displayNameTagPrefix = "display_name:"
+
+// displayName is the UI description of a transaction: the value of a
+// display_name:<text> tag, otherwise "<category> bonus"
+func displayName(category string, tags []string) string {
+	for _, tag := range tags {
+		if name, ok := strings.CutPrefix(tag, displayNameTagPrefix); ok && name != "" {
+			return name
+		}
+	}
+	return category + " bonus"
+}
+
+// referenceTagPrefix marks a tag holding an external reference of a
+// transaction, e.g. an order id
+const referenceTagPrefix = "reference:"
+
+// reference is the value of a reference:<text> tag, empty if there is none
+func reference(tags []string) string {
+	for _, tag := range tags {
+		if ref, ok := strings.CutPrefix(tag, referenceTagPrefix); ok {
+			return ref
+		}
+	}
+	return ""
+}
+
+var categoryRX = regexp.MustCompile(`^[a-z0-9_-]{1,64}$`)
+
+func ValidateCategory(v *validator.LocalizedValidator, category string) {
+	v.CheckMsg(validator.IsMatch(category, categoryRX), "category", "must_be_category_name", 64)
+}
+
+func ValidateTags(v *validator.LocalizedValidator, tags []string) {
+	v.CheckMsg(len(tags) <= 20, "tags", "must_not_contain_more_than", map[string]any{"max": 20, "noun": "tags"})
+	v.CheckMsg(validator.IsUnique(tags), "tags", "must_not_contain_duplicates", nil)
+	for _, tag := range tags {
+		v.CheckMsg(tag != "", "tags", "must_not_contain_empty_values", nil)
+		v.CheckMsg(len(tag) <= 64, "tags", "must_not_contain_values_longer_than", 64)
+	}
+}
+
+type BulkGrantError struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+// BulkGrantResult reports the outcome of every grant in a bulk request
+type BulkGrantResult struct {
+	Succeeded []Transaction    `json:"succeeded"`
+	Failed    []BulkGrantError `json:"failed"`
 }
 
 type BalanceModel struct {
-	DB *sql.DB
+	DB       Querier
+	Timeouts Timeouts
+	// Watcher serves WatchBalance, which fails without it
+	Watcher *BalanceWatcher
+}
+
+type TransactionModel struct {
+	DB Querier
+}
+
+// debtExpiresAt is used as expires_at of withdrawal rows, debt never expires
+var debtExpiresAt = time.Date(9999, time.December, 31, 0, 0, 0, 0, time.UTC)
+
+type DepositOptions struct {
+	// DryRun computes the resulting transaction and writes nothing
+	DryRun bool
+	// MaxTransactions limits the number of active grants per user, zero means unlimited
+	MaxTransactions int
+	// MaxBalance makes the deposit fail with ErrConditionNotMet unless the
+	// balance is below it, nil deposits unconditionally
+	MaxBalance *int
+}
+
+// AddBonusPoints adds bonus points for a user with an expiration date.
+// Outstanding debt is repaid first, so the grant may start partially consumed.
+func (m BalanceModel) AddBonusPoints(ctx context.Context, grant Grant, opts DepositOptions) (*Transaction, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.AddBonusPoints)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if opts.MaxTransactions > 0 {
+		err := checkTransactionLimit(ctx, tx, grant.UserId, opts.MaxTransactions)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.MaxBalance != nil {
+		err := checkMaxBalance(ctx, tx, grant.UserId, *opts.MaxBalance)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.DryRun {
+		transaction := &Transaction{
+			UserId:         grant.UserId,
+			ExternalUserId: grant.ExternalUserId,
+			Amount:         grant.Amount,
+			Category:       grant.Category,
+			Tags:           grant.Tags,
+		}
+		if transaction.Tags == nil {
+			transaction.Tags = []string{}
+		}
+		transaction.DisplayName = displayName(transaction.Category, transaction.Tags)
+		transaction.Reference = reference(transaction.Tags)
+
+		query := `
+			SELECT get_now()::timestamp(0) with time zone,
+				(get_now() + $2 * INTERVAL '1 day')::timestamp(0) with time zone,
+				GREATEST($3 + COALESCE(SUM(remaining_amount), 0), 0)
+			FROM transactions
+			WHERE user_id = $1 AND remaining_amount < 0`
+
+		err := tx.QueryRowContext(ctx, query, grant.UserId, grant.LifetimeDays, grant.Amount).Scan(
+			&transaction.CreatedAt,
+			&transaction.ExpiresAt,
+			&transaction.RemainingAmount,
+		)
+		return transaction, err
+	}
+
+	transaction, err := insertGrant(ctx, tx, grant)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return transaction, nil
 }
 
-// AddBonusPoints adds bonus points for a user with an expiration date
-func (m BalanceModel) AddBonusPoints(userId uuid.UUID, amount int, lifetimeDays int) (*Transaction, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// checkTransactionLimit returns ErrTransactionLimitExceeded when the user
+// already has limit active grants
+func checkTransactionLimit(ctx context.Context, tx *sql.Tx, userId uuid.UUID, limit int) error {
+	// Concurrent deposits could both pass the count, so serialize them per user
+	_, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1::text))`, userId)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		SELECT COUNT(*)
+		FROM transactions
+		WHERE user_id = $1 AND remaining_amount > 0 AND expires_at > get_now()`
+
+	var count int
+	err = tx.QueryRowContext(ctx, query, userId).Scan(&count)
+	if err != nil {
+		return err
+	}
+
+	if count >= limit {
+		return ErrTransactionLimitExceeded
+	}
+
+	return nil
+}
+
+// checkMaxBalance returns ErrConditionNotMet unless the user's balance, debt
+// included, is below maxBalance. Conditional deposits of a user are
+// serialized, so concurrent ones cannot all pass on the same balance.
+func checkMaxBalance(ctx context.Context, tx *sql.Tx, userId uuid.UUID, maxBalance int) error {
+	_, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1::text))`, userId)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		SELECT COALESCE(SUM(remaining_amount), 0)
+		FROM transactions
+		WHERE user_id = $1 AND expires_at > get_now() AND remaining_amount <> 0`
+
+	var balance int
+	if err = tx.QueryRowContext(ctx, query, userId).Scan(&balance); err != nil {
+		return err
+	}
+
+	if balance >= maxBalance {
+		return ErrConditionNotMet
+	}
+
+	return nil
+}
+
+// BulkAddBonusPoints inserts the grants in a single database transaction.
+// With maxTransactions > 0 a grant of a user who already has that many
+// active grants is skipped and reported with its index in grants. Any
+// other error stores none of them.
+func (m BalanceModel) BulkAddBonusPoints(ctx context.Context, grants []Grant, maxTransactions int) ([]Transaction, []BulkGrantError, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.BulkAddBonusPoints)
 	defer cancel()
 
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	transactions := make([]Transaction, 0, len(grants))
+	var failed []BulkGrantError
+	for i, grant := range grants {
+		if maxTransactions > 0 {
+			// Counts the grants inserted before in the batch as well
+			err := checkTransactionLimit(ctx, tx, grant.UserId, maxTransactions)
+			if errors.Is(err, ErrTransactionLimitExceeded) {
+				failed = append(failed, BulkGrantError{Index: i, Error: err.Error()})
+				continue
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+
+		transaction, err := insertGrant(ctx, tx, grant)
+		if err != nil {
+			return nil, nil, err
+		}
+		transactions = append(transactions, *transaction)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+
+	return transactions, failed, nil
+}
+
+// insertGrant repays the user's debt rows (oldest first) from the grant and
+// stores what is left of it as a new transaction
+func insertGrant(ctx context.Context, tx *sql.Tx, grant Grant) (*Transaction, error) {
+	debtQuery := `
+		SELECT id, remaining_amount
+		FROM transactions
+		WHERE user_id = $1 AND remaining_amount < 0
+		ORDER BY created_at ASC
+		FOR UPDATE`
+
+	rows, err := tx.QueryContext(ctx, debtQuery, grant.UserId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type debtRow struct {
+		id              uuid.UUID
+		remainingAmount int
+	}
+
+	var debts []debtRow
+	for rows.Next() {
+		var debt debtRow
+		if err := rows.Scan(&debt.id, &debt.remainingAmount); err != nil {
+			return nil, err
+		}
+		debts = append(debts, debt)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	remaining := grant.Amount
+	repayQuery := `
+		UPDATE transactions
+		SET remaining_amount = remaining_amount + $1
+		WHERE id = $2`
+
+	for _, debt := range debts {
+		if remaining == 0 {
+			break
+		}
+
+		repay := min(remaining, -debt.remainingAmount)
+		if _, err := tx.ExecContext(ctx, repayQuery, repay, debt.id); err != nil {
+			return nil, err
+		}
+		remaining -= repay
+	}
+
 	transaction := &Transaction{
-		UserId:          userId,
-		Amount:          amount,
-		RemainingAmount: amount,
+		UserId:          grant.UserId,
+		ExternalUserId:  grant.ExternalUserId,
+		Amount:          grant.Amount,
+		RemainingAmount: remaining,
+		Category:        grant.Category,
+		Tags:            grant.Tags,
 	}
+	if transaction.Tags == nil {
+		transaction.Tags = []string{}
+	}
+	transaction.DisplayName = displayName(transaction.Category, transaction.Tags)
+	transaction.Reference = reference(transaction.Tags)
 
 	query := `
-		INSERT INTO transactions (user_id, amount, expires_at, remaining_amount)
-		VALUES ($1, $2, NOW() + $3 * INTERVAL '1 day', $4)
+		INSERT INTO transactions (user_id, amount, expires_at, remaining_amount, tags, external_user_id, category)
+		VALUES ($1, $2, get_now() + $3 * INTERVAL '1 day', $4, $5, NULLIF($6, ''), $7)
 		RETURNING id, created_at, expires_at`
 
-	err := m.DB.QueryRowContext(ctx, query, userId, amount, lifetimeDays, amount).Scan(
+	args := []any{
+		grant.UserId,
+		grant.Amount,
+		grant.LifetimeDays,
+		remaining,
+		pq.Array(transaction.Tags),
+		grant.ExternalUserId,
+		grant.Category,
+	}
+	err = tx.QueryRowContext(ctx, query, args...).Scan(
 		&transaction.Id,
 		&transaction.CreatedAt,
 		&transaction.ExpiresAt,
 	)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = notifyBalance(ctx, tx, grant.UserId); err != nil {
+		return nil, err
+	}
 
-	return transaction, err
+	return transaction, nil
 }
 
-func (m BalanceModel) Insert(balance *Balance) error {
+func (m BalanceModel) Insert(ctx context.Context, balance *Balance) error {
 	query := `
 		INSERT INTO balances (id, amount)
 		VALUES ($1, $2)
 		RETURNING id, updated_at, amount`
 	args := []any{balance.Id, balance.Amount}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	return m.DB.QueryRowContext(ctx, query, args...).Scan(&balance.Id, &balance.UpdatedAt, &balance.Amount)
 }
 
-// GetBalanceWithExpiration returns the current balance and upcoming expirations
-func (m BalanceModel) GetBalanceWithExpiration(userId uuid.UUID) (int, map[string]int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// GetBalanceVersion returns a version identifying the current result of
+// GetBalanceWithExpiration without aggregating the user's transactions. It
+// combines the counter bumped by every change of the user's transactions
+// with the number of grants that since expired or entered the 30 day
+// expiration window, which changes the balance without any write. The
+// time of the last write is returned too, zero for users without any.
+func (m BalanceModel) GetBalanceVersion(ctx context.Context, userId uuid.UUID) (string, time.Time, error) {
+	query := `
+		SELECT COALESCE(v.version, 0), COUNT(t.id), v.updated_at
+		FROM (SELECT $1::uuid AS user_id) u
+		LEFT JOIN user_versions v ON v.user_id = u.user_id
+		LEFT JOIN transactions t ON t.user_id = u.user_id
+			AND t.remaining_amount > 0
+			AND (
+				(t.expires_at > v.updated_at AND t.expires_at <= get_now())
+				OR (t.expires_at > v.updated_at + INTERVAL '30 days' AND t.expires_at <= get_now() + INTERVAL '30 days')
+			)
+		GROUP BY v.version, v.updated_at`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.GetBalance)
+	defer cancel()
+
+	var version, crossed int64
+	var updatedAt sql.NullTime
+	if err := m.DB.QueryRowContext(ctx, query, userId).Scan(&version, &crossed, &updatedAt); err != nil {
+		return "", time.Time{}, err
+	}
+
+	return fmt.Sprintf("%d.%d", version, crossed), updatedAt.Time, nil
+}
+
+// Expiration is the amount of points expiring on a day
+type Expiration struct {
+	Date   string `json:"date"`
+	Amount int    `json:"amount"`
+}
+
+// GetBalanceWithExpiration returns the balance and, ordered by date, the
+// limit expirations after the first offset. A zero limit returns all.
+func (m BalanceModel) GetBalanceWithExpiration(ctx context.Context, userId uuid.UUID, offset, limit int) (int, []Expiration, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.GetBalance)
 	defer cancel()
 
-	// Get total balance
+	// Get total balance, debt rows have a negative remaining amount
 	var totalBalance int
 	query := `
 		SELECT COALESCE(SUM(remaining_amount), 0)
 		FROM transactions
-		WHERE user_id = $1 AND expires_at > NOW() AND remaining_amount > 0`
+		WHERE user_id = $1 AND expires_at > get_now() AND remaining_amount <> 0`
 
 	err := m.DB.QueryRowContext(ctx, query, userId).Scan(&totalBalance)
 	if err != nil {
@@ -83,18 +467,19 @@ func (m BalanceModel) GetBalanceWithExpiration(userId uuid.UUID) (int, map[strin
 	}
 
 	// Get expirations for the next 30 days grouped by date
-	expirations := make(map[string]int)
+	expirations := []Expiration{}
 	expirationQuery := `
 		SELECT DATE(expires_at) as expiry_date, SUM(remaining_amount) as expiring_amount
 		FROM transactions
 		WHERE user_id = $1 
-			AND expires_at > NOW() 
-			AND expires_at <= NOW() + INTERVAL '30 days'
+			AND expires_at > get_now() 
+			AND expires_at <= get_now() + INTERVAL '30 days'
 			AND remaining_amount > 0
 		GROUP BY DATE(expires_at)
-		ORDER BY DATE(expires_at)`
+		ORDER BY DATE(expires_at)
+		LIMIT NULLIF($3, 0) OFFSET $2`
 
-	rows, err := m.DB.QueryContext(ctx, expirationQuery, userId)
+	rows, err := m.DB.QueryContext(ctx, expirationQuery, userId, offset, limit)
 	if err != nil {
 		return totalBalance, expirations, nil // Return balance even if expiration query fails
 	}
@@ -106,16 +491,16 @@ func (m BalanceModel) GetBalanceWithExpiration(userId uuid.UUID) (int, map[strin
 		if err := rows.Scan(&expiryDate, &expiringAmount); err != nil {
 			continue
 		}
-		expirations[expiryDate.Format("2006-01-02")] = expiringAmount
+		expirations = append(expirations, Expiration{Date: expiryDate.Format("2006-01-02"), Amount: expiringAmount})
 	}
 
 	return totalBalance, expirations, nil
 }
 
-func (m BalanceModel) Get(id uuid.UUID) (*Balance, error) {
+func (m BalanceModel) Get(ctx context.Context, id uuid.UUID) (*Balance, error) {
 	balance := new(Balance)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	query := `
@@ -139,104 +524,2004 @@ func (m BalanceModel) Get(id uuid.UUID) (*Balance, error) {
 	return balance, nil
 }
 
-// WithdrawBonusPoints withdraws bonus points using FIFO (oldest first) with proper locking
-func (m BalanceModel) WithdrawBonusPoints(userId uuid.UUID, amount int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+// WithdrawStrategy decides which grants a withdrawal consumes first
+type WithdrawStrategy string
+
+const (
+	// StrategySoonestExpiring consumes the grants expiring first, it is the default
+	StrategySoonestExpiring WithdrawStrategy = ""
+	// StrategyOldestGrant consumes the grants created first
+	StrategyOldestGrant WithdrawStrategy = "oldest_grant"
+)
+
+var withdrawOrder = map[WithdrawStrategy]string{
+	StrategySoonestExpiring: "expires_at ASC, created_at ASC, id ASC",
+	StrategyOldestGrant:     "created_at ASC, expires_at ASC, id ASC",
+}
+
+type WithdrawOptions struct {
+	// DryRun performs only the sufficiency check and writes nothing
+	DryRun bool
+	// AllowDebt lets the balance go negative, down to -MaxDebt
+	AllowDebt bool
+	MaxDebt   int
+	Strategy  WithdrawStrategy
+	// LockTimeout bounds the wait for row locks held by concurrent
+	// withdrawals, zero waits indefinitely
+	LockTimeout time.Duration
+	// MaxDailyAmount caps the points withdrawn per user and calendar day,
+	// zero means unlimited
+	MaxDailyAmount int
+}
+
+// WithdrawBonusPoints withdraws bonus points in opts.Strategy order with proper locking.
+// When debt is allowed the missing amount is stored as a negative transaction.
+func (m BalanceModel) WithdrawBonusPoints(ctx context.Context, userId uuid.UUID, amount int, opts WithdrawOptions) (Withdrawal, error) {
+	var withdrawal Withdrawal
+	err := withRetry(ctx, 3, func() error {
+		var err error
+		withdrawal, err = m.withdraw(ctx, userId, amount, opts, false)
+		return err
+	})
+	return withdrawal, err
+}
+
+// WithdrawBonusPointsPartial withdraws as many points as available, up to
+// requestedAmount, and returns the amount actually withdrawn. It never goes
+// into debt, so AllowDebt and MaxDebt of opts are ignored.
+func (m BalanceModel) WithdrawBonusPointsPartial(ctx context.Context, userId uuid.UUID, requestedAmount int, opts WithdrawOptions) (Withdrawal, error) {
+	opts.AllowDebt = false
+
+	var withdrawal Withdrawal
+	err := withRetry(ctx, 3, func() error {
+		var err error
+		withdrawal, err = m.withdraw(ctx, userId, requestedAmount, opts, true)
+		return err
+	})
+	return withdrawal, err
+}
+
+// checkDailyWithdrawalLimit adds amount to the user's withdrawals of today
+// and returns ErrDailyWithdrawalLimitExceeded when that exceeds limit. The
+// upserted row stays locked until tx ends, which serializes concurrent
+// withdrawals of the user. A dry run only reads the total.
+func checkDailyWithdrawalLimit(ctx context.Context, tx *sql.Tx, userId uuid.UUID, amount, limit int, dryRun bool) error {
+	query := `
+		INSERT INTO daily_withdrawal_limits (user_id, date, withdrawn)
+		VALUES ($1, get_now()::date, $2)
+		ON CONFLICT (user_id, date) DO UPDATE
+		SET withdrawn = daily_withdrawal_limits.withdrawn + EXCLUDED.withdrawn
+		RETURNING withdrawn`
+	if dryRun {
+		query = `
+			SELECT COALESCE(SUM(withdrawn), 0) + $2
+			FROM daily_withdrawal_limits
+			WHERE user_id = $1 AND date = get_now()::date`
+	}
+
+	var withdrawn int
+	if err := tx.QueryRowContext(ctx, query, userId, amount).Scan(&withdrawn); err != nil {
+		return err
+	}
+
+	if withdrawn > limit {
+		return ErrDailyWithdrawalLimitExceeded
+	}
+
+	return nil
+}
+
+// Withdrawal is the outcome of a withdrawal
+type Withdrawal struct {
+	// Id of the withdrawal row, uuid.Nil for dry runs and withdrawals
+	// covered by debt alone
+	Id     uuid.UUID
+	Amount int
+}
+
+func (m BalanceModel) withdraw(ctx context.Context, userId uuid.UUID, amount int, opts WithdrawOptions, partial bool) (Withdrawal, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Withdraw)
 	defer cancel()
 
-	// Start a transaction
-	tx, err := m.DB.BeginTx(ctx, nil)
+	// Serializable, so that conflicting withdrawals fail and are retried
+	tx, err := m.DB.BeginTx(ctx, serializable)
 	if err != nil {
-		return err
+		return Withdrawal{}, err
 	}
 	defer tx.Rollback()
 
-	// Lock and get available transactions ordered by expiration date (FIFO)
-	query := `
-		SELECT id, remaining_amount
-		FROM transactions
-		WHERE user_id = $1 
-			AND expires_at > NOW() 
-			AND remaining_amount > 0
-		ORDER BY expires_at ASC, created_at ASC
-		FOR UPDATE`
+	if opts.LockTimeout > 0 {
+		// SET does not accept bind parameters
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("SET LOCAL lock_timeout = '%dms'", opts.LockTimeout.Milliseconds()))
+		if err != nil {
+			return Withdrawal{}, err
+		}
+	}
 
-	rows, err := tx.QueryContext(ctx, query, userId)
-	if err != nil {
-		return err
+	withdrawal, err := withdrawTx(ctx, tx, userId, amount, opts, partial)
+	if err != nil || opts.DryRun {
+		return withdrawal, err
 	}
-	defer rows.Close()
 
-	type txRow struct {
-		id              uuid.UUID
-		remainingAmount int
+	if err = tx.Commit(); err != nil {
+		return Withdrawal{}, err
 	}
 
-	var availableTxs []txRow
-	totalAvailable := 0
+	return withdrawal, nil
+}
 
-	for rows.Next() {
-		var tx txRow
-		if err := rows.Scan(&tx.id, &tx.remainingAmount); err != nil {
-			return err
+// withdrawTx performs a withdrawal within tx, which the caller commits
+func withdrawTx(ctx context.Context, tx *sql.Tx, userId uuid.UUID, amount int, opts WithdrawOptions, partial bool) (Withdrawal, error) {
+	// Lock all available transactions and sum them in a single statement
+	totalAvailable, err := balanceForUpdate(ctx, tx, userId)
+	if err != nil {
+		if isLockNotAvailable(err) {
+			return Withdrawal{}, ErrLockTimeout
 		}
-		availableTxs = append(availableTxs, tx)
-		totalAvailable += tx.remainingAmount
+		return Withdrawal{}, err
+	}
+
+	if partial {
+		amount = min(amount, totalAvailable)
 	}
-	rows.Close()
 
 	// Check if we have enough balance
+	deficit := 0
 	if totalAvailable < amount {
-		return ErrInsufficientFunds
+		if !opts.AllowDebt {
+			return Withdrawal{}, ErrInsufficientFunds
+		}
+
+		// Without positive rows there is nothing to lock, so serialize
+		// concurrent debt withdrawals of the user with an advisory lock
+		_, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1::text))`, userId)
+		if err != nil {
+			return Withdrawal{}, err
+		}
+
+		var debt int
+		debtQuery := `
+			SELECT COALESCE(-SUM(remaining_amount), 0)
+			FROM transactions
+			WHERE user_id = $1 AND remaining_amount < 0`
+
+		err = tx.QueryRowContext(ctx, debtQuery, userId).Scan(&debt)
+		if err != nil {
+			return Withdrawal{}, err
+		}
+
+		deficit = amount - totalAvailable
+		if debt+deficit > opts.MaxDebt {
+			return Withdrawal{}, ErrDebtLimitExceeded
+		}
 	}
 
-	// Deduct from transactions FIFO
-	remainingToDeduct := amount
-	updateQuery := `
-		UPDATE transactions
-		SET remaining_amount = $1
-		WHERE id = $2`
+	if opts.MaxDailyAmount > 0 && amount > 0 {
+		err := checkDailyWithdrawalLimit(ctx, tx, userId, amount, opts.MaxDailyAmount, opts.DryRun)
+		if err != nil {
+			return Withdrawal{}, err
+		}
+	}
 
-	for _, txRow := range availableTxs {
-		if remainingToDeduct <= 0 {
-			break
+	if opts.DryRun {
+		return Withdrawal{Amount: amount}, nil
+	}
+
+	order, ok := withdrawOrder[opts.Strategy]
+	if !ok {
+		return Withdrawal{}, fmt.Errorf("unknown withdraw strategy %q", opts.Strategy)
+	}
+
+	// Deduct from transactions in strategy order, every row consumes what
+	// the rows before it did not cover. The amounts taken are recorded as
+	// events of the withdrawal $3.
+	deductQuery := fmt.Sprintf(`
+		WITH deducted AS (
+			UPDATE transactions t
+			SET remaining_amount = t.remaining_amount - LEAST(t.remaining_amount, $2 - fifo.consumed_before)
+			FROM (
+				SELECT id, remaining_amount, COALESCE(SUM(remaining_amount) OVER (
+					ORDER BY %s
+					ROWS BETWEEN UNBOUNDED PRECEDING AND 1 PRECEDING
+				), 0) AS consumed_before
+				FROM transactions
+				WHERE user_id = $1 
+					AND expires_at > get_now() 
+					AND remaining_amount > 0
+			) fifo
+			WHERE t.id = fifo.id AND fifo.consumed_before < $2
+			RETURNING t.id, LEAST(fifo.remaining_amount, $2 - fifo.consumed_before) AS taken
+		)
+		INSERT INTO withdrawal_events (withdrawal_id, transaction_id, amount)
+		SELECT $3, id, taken FROM deducted`, order)
+
+	withdrawal := Withdrawal{Amount: amount}
+
+	covered := min(amount, totalAvailable)
+	if covered > 0 {
+		// Record the withdrawal, nothing remains of it so balances ignore it
+		recordQuery := `
+			INSERT INTO transactions (user_id, amount, expires_at, remaining_amount, direction)
+			VALUES ($1, $2, $3, 0, 'withdrawal')
+			RETURNING id`
+
+		err = tx.QueryRowContext(ctx, recordQuery, userId, -covered, debtExpiresAt).Scan(&withdrawal.Id)
+		if err != nil {
+			return Withdrawal{}, err
 		}
 
-		deductFromThis := remainingToDeduct
-		if deductFromThis > txRow.remainingAmount {
-			deductFromThis = txRow.remainingAmount
+		_, err = tx.ExecContext(ctx, deductQuery, userId, covered, withdrawal.Id)
+		if err != nil {
+			return Withdrawal{}, err
 		}
+	}
+
+	if deficit > 0 {
+		debtQuery := `
+			INSERT INTO transactions (user_id, amount, expires_at, remaining_amount, direction)
+			VALUES ($1, $2, $3, $2, 'withdrawal')
+			RETURNING id`
 
-		newRemaining := txRow.remainingAmount - deductFromThis
-		_, err := tx.ExecContext(ctx, updateQuery, newRemaining, txRow.id)
+		var debtId uuid.UUID
+		err := tx.QueryRowContext(ctx, debtQuery, userId, -deficit, debtExpiresAt).Scan(&debtId)
 		if err != nil {
-			return err
+			return Withdrawal{}, err
+		}
+
+		if withdrawal.Id != uuid.Nil {
+			// Links the debt to the withdrawal, which makes it irreversible
+			_, err = tx.ExecContext(ctx, `INSERT INTO withdrawal_events (withdrawal_id, transaction_id, amount) VALUES ($1, $2, $3)`,
+				withdrawal.Id, debtId, deficit)
+			if err != nil {
+				return Withdrawal{}, err
+			}
 		}
+	}
 
-		remainingToDeduct -= deductFromThis
+	if err = notifyBalance(ctx, tx, userId); err != nil {
+		return Withdrawal{}, err
 	}
 
-	return tx.Commit()
+	return withdrawal, nil
 }
 
-func (m BalanceModel) Update(balance *Balance) error {
-	query := `
-		UPDATE balances
-		SET amount = $2, updated_at = $3
-		WHERE id = $1
-		RETURNING updated_at`
-	args := []any{
-		balance.Id,
-		balance.Amount,
-		time.Now(),
-	}
+// UserWithdrawal is a withdrawal of one user in BulkWithdrawForUsers
+type UserWithdrawal struct {
+	UserID uuid.UUID
+	Amount int
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+// BulkWithdrawResult is the outcome of one UserWithdrawal
+type BulkWithdrawResult struct {
+	UserID uuid.UUID
+	Amount int
+	// WithdrawalId is uuid.Nil when the withdrawal failed
+	WithdrawalId uuid.UUID
+	// Err is one of the errors in withdrawRejections when the withdrawal
+	// of the user failed
+	Err error
+}
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&balance.UpdatedAt)
-	if err != nil {
+// withdrawRejections are the errors withdrawTx rejects a withdrawal with,
+// as opposed to failures of the database
+var withdrawRejections = []error{
+	ErrInsufficientFunds,
+	ErrDebtLimitExceeded,
+	ErrDailyWithdrawalLimitExceeded,
+	ErrLockTimeout,
+}
+
+// BulkWithdrawForUsers settles the withdrawals of several users in a single
+// database transaction, each with opts. A user whose withdrawal fails with
+// one of withdrawRejections is rolled back to a savepoint and reported in
+// its result, the others are still committed. Any other error fails the
+// whole batch.
+func (m TransactionModel) BulkWithdrawForUsers(ctx context.Context, withdrawals []UserWithdrawal, opts WithdrawOptions) ([]BulkWithdrawResult, error) {
+	var results []BulkWithdrawResult
+	err := withRetry(ctx, 3, func() error {
+		var err error
+		results, err = m.bulkWithdraw(ctx, withdrawals, opts)
+		return err
+	})
+	return results, err
+}
+
+func (m TransactionModel) bulkWithdraw(ctx context.Context, withdrawals []UserWithdrawal, opts WithdrawOptions) ([]BulkWithdrawResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, serializable)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if opts.LockTimeout > 0 {
+		// SET does not accept bind parameters
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("SET LOCAL lock_timeout = '%dms'", opts.LockTimeout.Milliseconds()))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	results := make([]BulkWithdrawResult, 0, len(withdrawals))
+	for _, w := range withdrawals {
+		result := BulkWithdrawResult{UserID: w.UserID, Amount: w.Amount}
+
+		if _, err = tx.ExecContext(ctx, `SAVEPOINT bulk_withdrawal`); err != nil {
+			return nil, err
+		}
+
+		withdrawal, err := withdrawTx(ctx, tx, w.UserID, w.Amount, opts, false)
+		switch {
+		case err == nil:
+			result.WithdrawalId = withdrawal.Id
+			_, err = tx.ExecContext(ctx, `RELEASE SAVEPOINT bulk_withdrawal`)
+		case isAnyError(err, withdrawRejections):
+			result.Err = err
+			_, err = tx.ExecContext(ctx, `ROLLBACK TO SAVEPOINT bulk_withdrawal`)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, result)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+func isAnyError(err error, targets []error) bool {
+	for _, target := range targets {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Revert is the outcome of RevertWithdrawal
+type Revert struct {
+	UserId   uuid.UUID `json:"user_id"`
+	Restored int       `json:"restored_amount"`
+	// Forfeited points were taken from grants that expired or were cancelled
+	// since
+	Forfeited int `json:"forfeited_amount"`
+}
+
+// RevertWithdrawal gives the points taken by a withdrawal back to the grants
+// they came from and marks the withdrawal cancelled. Grants that expired or
+// were cancelled in the meantime are not restored. Withdrawals that went into debt cannot be
+// reverted, nor can withdrawals of frozen accounts.
+func (m BalanceModel) RevertWithdrawal(ctx context.Context, withdrawalId uuid.UUID) (Revert, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return Revert{}, err
+	}
+	defer tx.Rollback()
+
+	var revert Revert
+	var cancelledAt sql.NullTime
+	var withdrawn int
+	var withdrawnOn time.Time
+	query := `
+		SELECT user_id, cancelled_at, -amount, created_at::date
+		FROM transactions
+		WHERE id = $1 AND direction = 'withdrawal' AND remaining_amount = 0
+		FOR UPDATE`
+
+	err = tx.QueryRowContext(ctx, query, withdrawalId).Scan(&revert.UserId, &cancelledAt, &withdrawn, &withdrawnOn)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Revert{}, ErrRecordNotFound
+		}
+		return Revert{}, err
+	}
+	if cancelledAt.Valid {
+		return Revert{}, ErrAlreadyReverted
+	}
+
+	// A revert changes the balance like a deposit does, which frozen
+	// accounts do not accept
+	var frozen bool
+	err = tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM frozen_users WHERE user_id = $1)`, revert.UserId).Scan(&frozen)
+	if err != nil {
+		return Revert{}, err
+	}
+	if frozen {
+		return Revert{}, ErrUserFrozen
+	}
+
+	// Locks the grants, so that a concurrent withdrawal cannot take the
+	// restored points before the revert commits
+	query = `
+		SELECT t.amount < 0, t.expires_at > get_now() AND t.cancelled_at IS NULL, e.amount
+		FROM withdrawal_events e
+		JOIN transactions t ON t.id = e.transaction_id
+		WHERE e.withdrawal_id = $1
+		FOR UPDATE OF t`
+
+	rows, err := tx.QueryContext(ctx, query, withdrawalId)
+	if err != nil {
+		return Revert{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var debt, live bool
+		var amount int
+		if err := rows.Scan(&debt, &live, &amount); err != nil {
+			return Revert{}, err
+		}
+
+		switch {
+		case debt:
+			return Revert{}, ErrNotRevertible
+		case live:
+			revert.Restored += amount
+		default:
+			revert.Forfeited += amount
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return Revert{}, err
+	}
+
+	restoreQuery := `
+		UPDATE transactions t
+		SET remaining_amount = t.remaining_amount + e.amount
+		FROM withdrawal_events e
+		WHERE e.withdrawal_id = $1
+			AND t.id = e.transaction_id
+			AND t.expires_at > get_now()
+			AND t.cancelled_at IS NULL`
+
+	if _, err = tx.ExecContext(ctx, restoreQuery, withdrawalId); err != nil {
+		return Revert{}, err
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE transactions SET cancelled_at = get_now() WHERE id = $1`, withdrawalId)
+	if err != nil {
+		return Revert{}, err
+	}
+
+	// A reverted withdrawal no longer counts towards the daily limit
+	limitQuery := `
+		UPDATE daily_withdrawal_limits
+		SET withdrawn = GREATEST(withdrawn - $3, 0)
+		WHERE user_id = $1 AND date = $2`
+
+	if _, err = tx.ExecContext(ctx, limitQuery, revert.UserId, withdrawnOn, withdrawn); err != nil {
+		return Revert{}, err
+	}
+
+	if err = notifyBalance(ctx, tx, revert.UserId); err != nil {
+		return Revert{}, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return Revert{}, err
+	}
+
+	return revert, nil
+}
+
+// GetBalanceForUpdate sums the available points of a user and locks the
+// summed rows until tx ends, so they cannot change before the withdrawal
+func (m BalanceModel) GetBalanceForUpdate(ctx context.Context, tx *sql.Tx, userId uuid.UUID) (int, error) {
+	return balanceForUpdate(ctx, tx, userId)
+}
+
+func balanceForUpdate(ctx context.Context, tx *sql.Tx, userId uuid.UUID) (int, error) {
+	query := `
+		SELECT COALESCE(SUM(remaining_amount), 0)
+		FROM (
+			SELECT remaining_amount
+			FROM transactions
+			WHERE user_id = $1 
+				AND expires_at > get_now() 
+				AND remaining_amount > 0
+			FOR UPDATE
+		) available`
+
+	var balance int
+	err := tx.QueryRowContext(ctx, query, userId).Scan(&balance)
+	return balance, err
+}
+
+func (m BalanceModel) Update(ctx context.Context, balance *Balance) error {
+	query := `
+		UPDATE balances
+		SET amount = $2, updated_at = $3
+		WHERE id = $1
+		RETURNING updated_at`
+	args := []any{
+		balance.Id,
+		balance.Amount,
+		time.Now(),
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&balance.UpdatedAt)
+	if err != nil {
 		return err
 	}
 	return nil
 }
+
+// CompareAndSwap sets the amount of balance id to newAmount only while it is
+// still expectedAmount. A stale expectedAmount or a missing balance yields
+// false without an error.
+func (m BalanceModel) CompareAndSwap(ctx context.Context, id uuid.UUID, expectedAmount, newAmount int) (bool, error) {
+	query := `
+		UPDATE balances
+		SET amount = $3, updated_at = NOW()
+		WHERE id = $1 AND amount = $2
+		RETURNING id`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var updated uuid.UUID
+	err := m.DB.QueryRowContext(ctx, query, id, expectedAmount, newAmount).Scan(&updated)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// balanceAtQuery sums what a user held at the moment %[1]s, rebuilt from the
+// ledger instead of the current remaining amounts: every grant live at that
+// moment counts its amount less what withdrawals made by then, and not
+// reverted by then, took from it, and every debt row counts in full.
+// Withdrawal rows themselves hold nothing and are left out.
+//
+// Debt repaid by a deposit is not recorded per grant, so once the repaying
+// grant expires the repaid part is counted as debt again.
+const balanceAtQuery = `
+	SELECT COALESCE(SUM(CASE WHEN t.amount > 0 THEN t.amount - COALESCE(taken.amount, 0) ELSE t.amount END), 0)
+	FROM transactions t
+	LEFT JOIN LATERAL (
+		SELECT SUM(e.amount) AS amount
+		FROM withdrawal_events e
+		JOIN transactions w ON w.id = e.withdrawal_id
+		WHERE e.transaction_id = t.id
+			AND w.created_at <= %[1]s
+			AND (w.cancelled_at IS NULL OR w.cancelled_at > %[1]s)
+	) taken ON true
+	WHERE t.user_id = $1
+		AND t.created_at <= %[1]s
+		AND t.expires_at > %[1]s
+		AND (t.cancelled_at IS NULL OR t.cancelled_at > %[1]s)
+		AND NOT EXISTS (SELECT 1 FROM withdrawal_events r WHERE r.withdrawal_id = t.id)`
+
+// GetBalanceAt returns the balance of a user at the given moment, debt
+// included. Withdrawals and reverts made after at do not change it.
+func (m TransactionModel) GetBalanceAt(ctx context.Context, userId uuid.UUID, at time.Time) (int, error) {
+	query := fmt.Sprintf(balanceAtQuery, "$2")
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var balance int
+	err := m.DB.QueryRowContext(ctx, query, userId, at).Scan(&balance)
+	return balance, err
+}
+
+type DailyBalance struct {
+	Date    string `json:"date"`
+	Balance int    `json:"balance"`
+}
+
+// GetBalanceHistory returns the balance of a user at the end of every day
+// from from to to (both inclusive), computed like GetBalanceAt per day.
+//
+// The query rebuilds the balance from all grants of the user for every day
+// of the range, so it is expensive: only use it for ranges under 90 days.
+func (m TransactionModel) GetBalanceHistory(ctx context.Context, userId uuid.UUID, from, to time.Time) ([]DailyBalance, error) {
+	endOfDay := "(day + INTERVAL '1 day' - INTERVAL '1 microsecond')"
+	query := fmt.Sprintf(`
+		SELECT day::date, (%s)
+		FROM generate_series($2::date, $3::date, INTERVAL '1 day') AS day
+		ORDER BY day`, fmt.Sprintf(balanceAtQuery, endOfDay))
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userId, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []DailyBalance{}
+	for rows.Next() {
+		var day time.Time
+		var balance DailyBalance
+		if err := rows.Scan(&day, &balance.Balance); err != nil {
+			return nil, err
+		}
+		balance.Date = day.Format(time.DateOnly)
+		history = append(history, balance)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return history, nil
+}
+
+// MigrateUserID moves all transactions of fromUserId to toUserId, merging
+// both histories, and returns the number of moved transactions
+func (m TransactionModel) MigrateUserID(ctx context.Context, fromUserId, toUserId uuid.UUID) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE transactions
+		SET user_id = $2
+		WHERE user_id = $1`
+
+	result, err := tx.ExecContext(ctx, query, fromUserId, toUserId)
+	if err != nil {
+		return 0, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	if err = notifyBalance(ctx, tx, fromUserId, toUserId); err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return rowsAffected, nil
+}
+
+// ReassignTransactions moves the given transactions of fromUserID to
+// toUserID. Nothing is moved and ErrRecordNotFound is returned unless every
+// id is a transaction of fromUserID.
+func (m TransactionModel) ReassignTransactions(ctx context.Context, fromUserID, toUserID uuid.UUID, txIDs []uuid.UUID) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Lock the rows so they cannot change owner between check and update
+	checkQuery := `
+		SELECT COUNT(*)
+		FROM (
+			SELECT id
+			FROM transactions
+			WHERE id = ANY($2::uuid[]) AND user_id = $1
+			FOR UPDATE
+		) owned`
+
+	// Repeated ids would never match the count of locked rows
+	seen := make(map[uuid.UUID]bool, len(txIDs))
+	var ids []uuid.UUID
+	for _, id := range txIDs {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	var owned int
+	err = tx.QueryRowContext(ctx, checkQuery, fromUserID, pq.Array(ids)).Scan(&owned)
+	if err != nil {
+		return 0, err
+	}
+	if owned != len(ids) {
+		return 0, ErrRecordNotFound
+	}
+
+	query := `
+		UPDATE transactions
+		SET user_id = $2
+		WHERE id = ANY($3::uuid[]) AND user_id = $1`
+
+	result, err := tx.ExecContext(ctx, query, fromUserID, toUserID, pq.Array(ids))
+	if err != nil {
+		return 0, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	if err = notifyBalance(ctx, tx, fromUserID, toUserID); err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return rowsAffected, nil
+}
+
+// ExpireAllForUser zeroes and expires every active grant of a user, it
+// returns the number of expired rows and the points forfeited by them
+func (m TransactionModel) ExpireAllForUser(ctx context.Context, userId uuid.UUID) (int64, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	// Lock the rows first so the sum matches what the update zeroes
+	sumQuery := `
+		SELECT COALESCE(SUM(remaining_amount), 0)
+		FROM (
+			SELECT remaining_amount
+			FROM transactions
+			WHERE user_id = $1 AND expires_at > get_now() AND remaining_amount > 0
+			FOR UPDATE
+		) active`
+
+	var forfeited int
+	err = tx.QueryRowContext(ctx, sumQuery, userId).Scan(&forfeited)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	query := `
+		UPDATE transactions
+		SET remaining_amount = 0, expires_at = get_now()
+		WHERE user_id = $1 AND expires_at > get_now() AND remaining_amount > 0`
+
+	result, err := tx.ExecContext(ctx, query, userId)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if err = notifyBalance(ctx, tx, userId); err != nil {
+		return 0, 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+
+	return rowsAffected, forfeited, nil
+}
+
+// RebalanceExpiredToNewGrant converts the unspent points of the user's
+// expired grants into a new grant of their sum times conversionRate,
+// rounded down. It returns nil, nil when nothing would be converted.
+func (m TransactionModel) RebalanceExpiredToNewGrant(ctx context.Context, userID uuid.UUID, conversionRate float64, newLifetimeDays int) (*Transaction, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Lock the rows first so the sum matches what the update zeroes
+	sumQuery := `
+		SELECT COALESCE(SUM(remaining_amount), 0), COALESCE(MAX(external_user_id), '')
+		FROM (
+			SELECT remaining_amount, external_user_id
+			FROM transactions
+			WHERE user_id = $1
+				AND expires_at <= get_now()
+				AND remaining_amount > 0
+				AND cancelled_at IS NULL
+			FOR UPDATE
+		) expired`
+
+	var expired int
+	var externalUserId string
+	err = tx.QueryRowContext(ctx, sumQuery, userID).Scan(&expired, &externalUserId)
+	if err != nil {
+		return nil, err
+	}
+
+	// Points rounding down to nothing stay where they are
+	amount := int(math.Floor(float64(expired) * conversionRate))
+	if amount <= 0 {
+		return nil, nil
+	}
+
+	query := `
+		UPDATE transactions
+		SET remaining_amount = 0
+		WHERE user_id = $1
+			AND expires_at <= get_now()
+			AND remaining_amount > 0
+			AND cancelled_at IS NULL`
+
+	if _, err = tx.ExecContext(ctx, query, userID); err != nil {
+		return nil, err
+	}
+
+	grant := Grant{
+		UserId:         userID,
+		ExternalUserId: externalUserId,
+		Amount:         amount,
+		LifetimeDays:   newLifetimeDays,
+		Category:       DefaultCategory,
+	}
+	transaction, err := insertGrant(ctx, tx, grant)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return transaction, nil
+}
+
+// ExpireByCategory cancels the remaining points of every active grant of
+// the category, e.g. when its campaign ends, and returns the number of grants
+func (m TransactionModel) ExpireByCategory(ctx context.Context, category string, reason string) (int64, error) {
+	query := `
+		UPDATE transactions
+		SET remaining_amount = 0, cancelled_at = get_now(), cancellation_reason = $2
+		WHERE category = $1 AND expires_at > get_now() AND remaining_amount > 0
+		RETURNING user_id`
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rowsAffected, err := execNotifying(ctx, tx, query, category, reason)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return rowsAffected, nil
+}
+
+// CancelByDateRange cancels the grants created between from and to
+// (inclusive) that are not cancelled yet and returns their number.
+// Withdrawal and debt rows are left alone.
+func (m TransactionModel) CancelByDateRange(ctx context.Context, from, to time.Time, reason string) (int64, error) {
+	query := `
+		UPDATE transactions
+		SET remaining_amount = 0, cancelled_at = get_now(), cancellation_reason = $3
+		WHERE created_at BETWEEN $1 AND $2
+			AND cancelled_at IS NULL
+			AND direction = 'deposit'
+		RETURNING user_id`
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rowsAffected, err := execNotifying(ctx, tx, query, from, to, reason)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return rowsAffected, nil
+}
+
+type UserBalance struct {
+	UserId         uuid.UUID `json:"user_id"`
+	ExternalUserId string    `json:"external_user_id,omitempty"`
+	Balance        int       `json:"balance"`
+}
+
+// GetBalancesForUsers returns the available points of every given user in a
+// single query, users without points get a zero balance
+func (m TransactionModel) GetBalancesForUsers(ctx context.Context, userIds []uuid.UUID) (map[uuid.UUID]UserBalance, error) {
+	query := `
+		SELECT user_id, SUM(remaining_amount)
+		FROM transactions
+		WHERE user_id = ANY($1::uuid[]) AND expires_at > get_now() AND remaining_amount <> 0
+		GROUP BY user_id`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ids := make([]string, len(userIds))
+	for i, id := range userIds {
+		ids[i] = id.String()
+	}
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	balances := make(map[uuid.UUID]UserBalance, len(userIds))
+	for _, id := range userIds {
+		balances[id] = UserBalance{UserId: id}
+	}
+
+	for rows.Next() {
+		var balance UserBalance
+		if err := rows.Scan(&balance.UserId, &balance.Balance); err != nil {
+			return nil, err
+		}
+		balances[balance.UserId] = balance
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return balances, nil
+}
+
+type SystemTotals struct {
+	Balance      int `json:"balance"`
+	ActiveUsers  int `json:"active_users"`
+	ExpiringSoon int `json:"expiring_soon"`
+}
+
+// GetSystemTotals aggregates the available points of all users, the points
+// expiring within 30 days and the number of users holding points
+func (m TransactionModel) GetSystemTotals(ctx context.Context) (*SystemTotals, error) {
+	query := `
+		SELECT COALESCE(SUM(remaining_amount), 0),
+			COUNT(DISTINCT user_id),
+			COALESCE(SUM(remaining_amount) FILTER (WHERE expires_at <= get_now() + INTERVAL '30 days'), 0)
+		FROM transactions
+		WHERE expires_at > get_now() AND remaining_amount > 0`
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var totals SystemTotals
+	err := m.DB.QueryRowContext(ctx, query).Scan(&totals.Balance, &totals.ActiveUsers, &totals.ExpiringSoon)
+	if err != nil {
+		return nil, err
+	}
+
+	return &totals, nil
+}
+
+type LeaderboardEntry struct {
+	UserId  uuid.UUID `json:"user_id"`
+	Balance int       `json:"balance"`
+	Rank    int       `json:"rank"`
+}
+
+// GetLeaderboard returns up to limit users with the highest active balance
+func (m TransactionModel) GetLeaderboard(ctx context.Context, limit int) ([]LeaderboardEntry, error) {
+	query := `
+		SELECT user_id, SUM(remaining_amount) AS balance
+		FROM transactions
+		WHERE expires_at > get_now() AND remaining_amount > 0 AND cancelled_at IS NULL
+		GROUP BY user_id
+		ORDER BY balance DESC
+		LIMIT $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []LeaderboardEntry{}
+	for rows.Next() {
+		entry := LeaderboardEntry{Rank: len(entries) + 1}
+		if err := rows.Scan(&entry.UserId, &entry.Balance); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+type ExpiringUserBalance struct {
+	UserID         uuid.UUID `json:"user_id"`
+	TotalExpiring  int       `json:"total_expiring"`
+	EarliestExpiry time.Time `json:"earliest_expiry"`
+}
+
+// GetUsersWithExpiringBalance returns up to limit users with at least
+// minAmount points expiring within withinDays days, soonest expiry first
+func (m TransactionModel) GetUsersWithExpiringBalance(ctx context.Context, withinDays int, minAmount int, limit int) ([]ExpiringUserBalance, error) {
+	query := `
+		SELECT user_id, SUM(remaining_amount), MIN(expires_at) AS earliest_expiry
+		FROM transactions
+		WHERE expires_at > get_now()
+			AND expires_at <= get_now() + $1 * INTERVAL '1 day'
+			AND remaining_amount > 0
+		GROUP BY user_id
+		HAVING SUM(remaining_amount) >= $2
+		ORDER BY earliest_expiry ASC, user_id
+		LIMIT $3`
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, withinDays, minAmount, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []ExpiringUserBalance{}
+	for rows.Next() {
+		var user ExpiringUserBalance
+		if err := rows.Scan(&user.UserID, &user.TotalExpiring, &user.EarliestExpiry); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+type SpenderEntry struct {
+	UserId           uuid.UUID `json:"user_id"`
+	TotalSpent       int       `json:"total_spent"`
+	TransactionCount int       `json:"transaction_count"`
+}
+
+// GetTopSpenders returns up to limit users who withdrew the most points
+// since the given time, reverted withdrawals excluded. Points removed by
+// expiry, cancellation or debt repayment are not spending. TransactionCount
+// counts the withdrawals, the debt row of a withdrawal is part of it.
+func (m TransactionModel) GetTopSpenders(ctx context.Context, limit int, since time.Time) ([]SpenderEntry, error) {
+	// At scale an index on (user_id, created_at) would let this query skip
+	// old rows instead of scanning the whole table
+	query := `
+		SELECT user_id, SUM(-amount) AS total_spent,
+			COUNT(*) FILTER (WHERE NOT EXISTS (
+				SELECT 1 FROM withdrawal_events e WHERE e.transaction_id = t.id
+			))
+		FROM transactions t
+		WHERE created_at >= $1 AND direction = 'withdrawal' AND cancelled_at IS NULL
+		GROUP BY user_id
+		ORDER BY total_spent DESC, user_id
+		LIMIT $2`
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, since, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []SpenderEntry{}
+	for rows.Next() {
+		var entry SpenderEntry
+		if err := rows.Scan(&entry.UserId, &entry.TotalSpent, &entry.TransactionCount); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// WeeklyBatch sums the points expiring in one calendar week, WeekEnd is the
+// start of the following week
+type WeeklyBatch struct {
+	WeekStart   time.Time `json:"week_start"`
+	WeekEnd     time.Time `json:"week_end"`
+	TotalAmount int       `json:"total_amount"`
+	UserCount   int       `json:"user_count"`
+}
+
+// GetWeeklyExpiryBatches forecasts the points expiring in the current and
+// the following weeks-1 weeks (weeks start on Monday). Weeks without
+// expiring points are omitted.
+func (m TransactionModel) GetWeeklyExpiryBatches(ctx context.Context, weeks int) ([]WeeklyBatch, error) {
+	query := `
+		SELECT date_trunc('week', expires_at) AS week_start,
+			date_trunc('week', expires_at) + INTERVAL '1 week',
+			SUM(remaining_amount),
+			COUNT(DISTINCT user_id)
+		FROM transactions
+		WHERE expires_at > get_now()
+			AND expires_at < date_trunc('week', get_now()) + $1 * INTERVAL '1 week'
+			AND remaining_amount > 0
+		GROUP BY week_start
+		ORDER BY week_start`
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, weeks)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	batches := []WeeklyBatch{}
+	for rows.Next() {
+		var batch WeeklyBatch
+		if err := rows.Scan(&batch.WeekStart, &batch.WeekEnd, &batch.TotalAmount, &batch.UserCount); err != nil {
+			return nil, err
+		}
+		batches = append(batches, batch)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return batches, nil
+}
+
+// TransactionFilter narrows List, zero fields do not filter
+type TransactionFilter struct {
+	UserId uuid.UUID
+	Tag    string
+}
+
+// ListByTag returns a page of transactions carrying the tag, newest first
+func (m TransactionModel) ListByTag(ctx context.Context, tag string, page Pagination) ([]Transaction, ListMetadata, error) {
+	return m.List(ctx, TransactionFilter{Tag: tag}, page)
+}
+
+// List returns a page of the transactions matching filter, newest first
+func (m TransactionModel) List(ctx context.Context, filter TransactionFilter, page Pagination) ([]Transaction, ListMetadata, error) {
+	b := sqlbuilder.Select(
+		"count(*) OVER()", "id", "user_id", "COALESCE(external_user_id, '')", "amount", "created_at",
+		"expires_at", "remaining_amount", "category", "tags", "cancelled_at",
+	).From("transactions")
+
+	if filter.UserId != uuid.Nil {
+		b.Where("user_id = ?", filter.UserId)
+	}
+	if filter.Tag != "" {
+		b.Where("? = ANY(tags)", filter.Tag)
+	}
+
+	query, args := b.
+		OrderBy("created_at", "DESC").
+		OrderBy("id", "").
+		Limit(page.limit()).
+		Offset(page.offset()).
+		Build()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, ListMetadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	transactions := []Transaction{}
+
+	for rows.Next() {
+		var transaction Transaction
+		err := rows.Scan(
+			&totalRecords,
+			&transaction.Id,
+			&transaction.UserId,
+			&transaction.ExternalUserId,
+			&transaction.Amount,
+			&transaction.CreatedAt,
+			&transaction.ExpiresAt,
+			&transaction.RemainingAmount,
+			&transaction.Category,
+			pq.Array(&transaction.Tags),
+			&transaction.CancelledAt,
+		)
+		if err != nil {
+			return nil, ListMetadata{}, err
+		}
+		transaction.DisplayName = displayName(transaction.Category, transaction.Tags)
+		transaction.Reference = reference(transaction.Tags)
+		transactions = append(transactions, transaction)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, ListMetadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, page.Page, page.PageSize)
+
+	return transactions, metadata, nil
+}
+
+// ListExpiredWithRemainder returns grants that expired in [from, to) with at
+// least minAmount points never spent, oldest expiration first
+func (m TransactionModel) ListExpiredWithRemainder(ctx context.Context, from, to time.Time, minAmount int) ([]Transaction, error) {
+	query, args := sqlbuilder.Select(
+		"id", "user_id", "COALESCE(external_user_id, '')", "amount", "created_at",
+		"expires_at", "remaining_amount", "category", "tags",
+	).
+		From("transactions").
+		Where("expires_at >= ? AND expires_at < ?", from, to).
+		Where("expires_at <= get_now()").
+		Where("remaining_amount > 0").
+		Where("remaining_amount >= ?", minAmount).
+		OrderBy("expires_at", "").
+		OrderBy("id", "").
+		Build()
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transactions := []Transaction{}
+	for rows.Next() {
+		var transaction Transaction
+		err := rows.Scan(
+			&transaction.Id,
+			&transaction.UserId,
+			&transaction.ExternalUserId,
+			&transaction.Amount,
+			&transaction.CreatedAt,
+			&transaction.ExpiresAt,
+			&transaction.RemainingAmount,
+			&transaction.Category,
+			pq.Array(&transaction.Tags),
+		)
+		if err != nil {
+			return nil, err
+		}
+		transaction.DisplayName = displayName(transaction.Category, transaction.Tags)
+		transaction.Reference = reference(transaction.Tags)
+		transactions = append(transactions, transaction)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return transactions, nil
+}
+
+// TouchExpiry moves the expiration of the user's active grants to at least
+// extendByDays days from now and returns the number of grants updated.
+// Grants that already expired stay expired.
+func (m TransactionModel) TouchExpiry(ctx context.Context, userId uuid.UUID, extendByDays int) (int64, error) {
+	query := `
+		UPDATE transactions
+		SET expires_at = get_now() + $2 * INTERVAL '1 day'
+		WHERE user_id = $1
+			AND amount > 0
+			AND remaining_amount > 0
+			AND expires_at > get_now()
+			AND expires_at < get_now() + $2 * INTERVAL '1 day'`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userId, extendByDays)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// ExpiringGrant is a grant with points left that expires within a day
+type ExpiringGrant struct {
+	Id        uuid.UUID
+	UserId    uuid.UUID
+	ExpiresAt time.Time
+	Amount    int
+}
+
+// GetGrantsExpiringTomorrow returns the grants expiring 23 to 25 hours from
+// now that were not warned about yet. The two hour window lets an hourly scan
+// catch every grant even when a run is late.
+func (m TransactionModel) GetGrantsExpiringTomorrow(ctx context.Context) ([]ExpiringGrant, error) {
+	query := `
+		SELECT id, user_id, expires_at, remaining_amount
+		FROM transactions
+		WHERE expires_at BETWEEN get_now() + INTERVAL '23 hours' AND get_now() + INTERVAL '25 hours'
+			AND remaining_amount > 0
+			AND warned_at IS NULL
+		ORDER BY expires_at, id`
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var grants []ExpiringGrant
+	for rows.Next() {
+		var grant ExpiringGrant
+		if err := rows.Scan(&grant.Id, &grant.UserId, &grant.ExpiresAt, &grant.Amount); err != nil {
+			return nil, err
+		}
+		grants = append(grants, grant)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return grants, nil
+}
+
+// MarkWarned records that the owners of the given grants were warned about
+// their expiration
+func (m TransactionModel) MarkWarned(ctx context.Context, ids []uuid.UUID) error {
+	query := `
+		UPDATE transactions
+		SET warned_at = get_now()
+		WHERE id = ANY($1::uuid[])`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, pq.Array(ids))
+	return err
+}
+
+// StreamForUser calls fn for every transaction of a user created in
+// [from, to), oldest first, reading them through a cursor instead of loading
+// them all. A zero from or to leaves that side of the range open.
+func (m TransactionModel) StreamForUser(ctx context.Context, userId uuid.UUID, from, to time.Time, fn func(Transaction) error) error {
+	query := `
+		SELECT id, user_id, COALESCE(external_user_id, ''), amount, created_at,
+			expires_at, remaining_amount, category, tags
+		FROM transactions
+		WHERE user_id = $1
+			AND ($2::timestamptz IS NULL OR created_at >= $2)
+			AND ($3::timestamptz IS NULL OR created_at < $3)
+		ORDER BY created_at, id`
+
+	rows, err := m.DB.QueryContext(ctx, query, userId, nullTime(from), nullTime(to))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var transaction Transaction
+		err := rows.Scan(
+			&transaction.Id,
+			&transaction.UserId,
+			&transaction.ExternalUserId,
+			&transaction.Amount,
+			&transaction.CreatedAt,
+			&transaction.ExpiresAt,
+			&transaction.RemainingAmount,
+			&transaction.Category,
+			pq.Array(&transaction.Tags),
+		)
+		if err != nil {
+			return err
+		}
+		transaction.DisplayName = displayName(transaction.Category, transaction.Tags)
+		transaction.Reference = reference(transaction.Tags)
+
+		if err := fn(transaction); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// nullTime maps the zero time to NULL
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+// GetBalanceByCategory returns the available points of a user per category
+func (m TransactionModel) GetBalanceByCategory(ctx context.Context, userId uuid.UUID) (map[string]int, error) {
+	query := `
+		SELECT category, SUM(remaining_amount)
+		FROM transactions
+		WHERE user_id = $1 AND expires_at > get_now() AND remaining_amount > 0
+		GROUP BY category`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	breakdown := make(map[string]int)
+	for rows.Next() {
+		var category string
+		var amount int
+		if err := rows.Scan(&category, &amount); err != nil {
+			return nil, err
+		}
+		breakdown[category] = amount
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return breakdown, nil
+}
+
+type TagSummary struct {
+	Tag            string `json:"tag"`
+	TotalGranted   int    `json:"total_granted"`
+	TotalRemaining int    `json:"total_remaining"`
+}
+
+// GetTagSummary returns granted and still available points per tag
+func (m TransactionModel) GetTagSummary(ctx context.Context) ([]TagSummary, error) {
+	query := `
+		SELECT tag, SUM(amount), COALESCE(SUM(remaining_amount) FILTER (WHERE expires_at > get_now()), 0)
+		FROM transactions, unnest(tags) AS tag
+		WHERE amount > 0
+		GROUP BY tag
+		ORDER BY tag`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	summaries := []TagSummary{}
+	for rows.Next() {
+		var summary TagSummary
+		if err := rows.Scan(&summary.Tag, &summary.TotalGranted, &summary.TotalRemaining); err != nil {
+			return nil, err
+		}
+		summaries = append(summaries, summary)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return summaries, nil
+}
+
+// TransactionSummary is an overview of all transactions of a user.
+// Withdrawals are transactions too, TotalWithdrawn sums their amounts.
+type TransactionSummary struct {
+	TotalTransactions     int        `json:"total_transactions"`
+	ActiveTransactions    int        `json:"active_transactions"`
+	ExpiredTransactions   int        `json:"expired_transactions"`
+	CancelledTransactions int        `json:"cancelled_transactions"`
+	TotalDeposited        int        `json:"total_deposited"`
+	TotalWithdrawn        int        `json:"total_withdrawn"`
+	CurrentBalance        int        `json:"current_balance"`
+	EarliestExpiry        *time.Time `json:"earliest_expiry"`
+	LatestDepositAt       *time.Time `json:"latest_deposit_at"`
+}
+
+// GetTransactionSummary computes the summary of a user in a single query,
+// a user without transactions gets a zero summary
+func (m TransactionModel) GetTransactionSummary(ctx context.Context, userId uuid.UUID) (*TransactionSummary, error) {
+	query := `
+		WITH user_transactions AS (
+			SELECT amount, remaining_amount, direction, created_at, expires_at, cancelled_at,
+				expires_at > get_now() AS live
+			FROM transactions
+			WHERE user_id = $1
+		)
+		SELECT
+			COUNT(*),
+			COUNT(*) FILTER (WHERE live AND remaining_amount > 0),
+			COUNT(*) FILTER (WHERE NOT live),
+			COUNT(*) FILTER (WHERE cancelled_at IS NOT NULL),
+			COALESCE(SUM(amount) FILTER (WHERE amount > 0), 0),
+			-COALESCE(SUM(amount) FILTER (WHERE direction = 'withdrawal' AND cancelled_at IS NULL), 0),
+			COALESCE(SUM(remaining_amount) FILTER (WHERE live), 0),
+			MIN(expires_at) FILTER (WHERE live AND remaining_amount > 0),
+			MAX(created_at) FILTER (WHERE amount > 0)
+		FROM user_transactions`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var summary TransactionSummary
+	err := m.DB.QueryRowContext(ctx, query, userId).Scan(
+		&summary.TotalTransactions,
+		&summary.ActiveTransactions,
+		&summary.ExpiredTransactions,
+		&summary.CancelledTransactions,
+		&summary.TotalDeposited,
+		&summary.TotalWithdrawn,
+		&summary.CurrentBalance,
+		&summary.EarliestExpiry,
+		&summary.LatestDepositAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &summary, nil
+}
+
+// RetentionScore describes how actively a user used their points within
+// the lookback period
+type RetentionScore struct {
+	ActiveDays        int        `json:"active_days"`
+	TotalTransactions int        `json:"total_transactions"`
+	AvgDailySpend     float64    `json:"avg_daily_spend"`
+	LastActive        *time.Time `json:"last_active"`
+}
+
+// GetUserRetentionScore summarizes the user's transactions of the last
+// lookbackDays days, a user without any yields zeroes and no LastActive
+func (m TransactionModel) GetUserRetentionScore(ctx context.Context, userID uuid.UUID, lookbackDays int) (*RetentionScore, error) {
+	query := `
+		WITH recent AS (
+			SELECT date_trunc('day', created_at) AS day, amount, direction, cancelled_at, created_at
+			FROM transactions
+			WHERE user_id = $1 AND created_at > get_now() - $2 * INTERVAL '1 day'
+		)
+		SELECT
+			COUNT(DISTINCT day),
+			COUNT(*),
+			-COALESCE(SUM(amount) FILTER (WHERE direction = 'withdrawal' AND cancelled_at IS NULL), 0)::float8 / $2,
+			MAX(created_at)
+		FROM recent`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var score RetentionScore
+	err := m.DB.QueryRowContext(ctx, query, userID, lookbackDays).Scan(
+		&score.ActiveDays,
+		&score.TotalTransactions,
+		&score.AvgDailySpend,
+		&score.LastActive,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &score, nil
+}
+
+// EarningVelocity is the rate at which a user received points within a window
+type EarningVelocity struct {
+	PointsPerDay     float64 `json:"points_per_day"`
+	PointsPerWeek    float64 `json:"points_per_week"`
+	TotalInWindow    int     `json:"total_in_window"`
+	TransactionCount int     `json:"transaction_count"`
+}
+
+// GetEarningVelocity averages the user's deposits of the last windowDays
+// days over the whole window, idle days included
+func (m TransactionModel) GetEarningVelocity(ctx context.Context, userID uuid.UUID, windowDays int) (*EarningVelocity, error) {
+	query := `
+		SELECT COALESCE(SUM(amount), 0), COUNT(*)
+		FROM transactions
+		WHERE user_id = $1
+			AND direction = 'deposit'
+			AND created_at > get_now() - $2 * INTERVAL '1 day'`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var velocity EarningVelocity
+	err := m.DB.QueryRowContext(ctx, query, userID, windowDays).Scan(&velocity.TotalInWindow, &velocity.TransactionCount)
+	if err != nil {
+		return nil, err
+	}
+
+	velocity.PointsPerDay = float64(velocity.TotalInWindow) / float64(windowDays)
+	velocity.PointsPerWeek = velocity.PointsPerDay * 7
+
+	return &velocity, nil
+}
+
+// DeleteAllForUser removes every row referring to the user, leaving no
+// trace of them. It exists for test isolation and must never be reachable
+// in production.
+func (m TransactionModel) DeleteAllForUser(ctx context.Context, userId uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	queries := []string{
+		`DELETE FROM transactions WHERE user_id = $1`,
+		`DELETE FROM balances WHERE id = $1`,
+		`DELETE FROM balance_snapshots WHERE user_id = $1`,
+		`DELETE FROM notifications WHERE user_id = $1`,
+		`DELETE FROM frozen_users WHERE user_id = $1`,
+		`DELETE FROM api_keys WHERE user_id = $1`,
+		`DELETE FROM daily_withdrawal_limits WHERE user_id = $1`,
+	}
+	for _, query := range queries {
+		if _, err := tx.ExecContext(ctx, query, userId); err != nil {
+			return err
+		}
+	}
+
+	if err = notifyBalance(ctx, tx, userId); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DateRangeSum is the points deposited and withdrawn in one period
+type DateRangeSum struct {
+	Period    string `json:"period"`
+	Deposited int    `json:"deposited"`
+	Withdrawn int    `json:"withdrawn"`
+	NetChange int    `json:"net_change"`
+}
+
+var periodLayouts = map[string]string{
+	"day":   time.DateOnly,
+	"week":  time.DateOnly,
+	"month": "2006-01",
+}
+
+// ValidGranularity reports whether SumByDateRange accepts granularity
+func ValidGranularity(granularity string) bool {
+	_, ok := periodLayouts[granularity]
+	return ok
+}
+
+// SumByDateRange totals deposits and withdrawals created in [from, to) per
+// day, week (named by its Monday) or month. Periods without transactions
+// are omitted.
+func (m TransactionModel) SumByDateRange(ctx context.Context, from, to time.Time, granularity string) ([]DateRangeSum, error) {
+	layout, ok := periodLayouts[granularity]
+	if !ok {
+		return nil, fmt.Errorf("unknown granularity %q", granularity)
+	}
+
+	query := `
+		SELECT date_trunc($3, created_at) AS period,
+			COALESCE(SUM(amount) FILTER (WHERE direction = 'deposit'), 0),
+			-COALESCE(SUM(amount) FILTER (WHERE direction = 'withdrawal' AND cancelled_at IS NULL), 0)
+		FROM transactions
+		WHERE created_at >= $1 AND created_at < $2
+		GROUP BY period
+		ORDER BY period`
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, from, to, granularity)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sums := []DateRangeSum{}
+	for rows.Next() {
+		var period time.Time
+		var sum DateRangeSum
+		if err := rows.Scan(&period, &sum.Deposited, &sum.Withdrawn); err != nil {
+			return nil, err
+		}
+		sum.Period = period.Format(layout)
+		sum.NetChange = sum.Deposited - sum.Withdrawn
+		sums = append(sums, sum)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sums, nil
+}
+
+// ActiveTransaction is a grant with points left, with figures for review
+type ActiveTransaction struct {
+	Transaction
+	DaysUntilExpiry int     `json:"days_until_expiry"`
+	PercentConsumed float64 `json:"percent_consumed"`
+}
+
+// GetActiveTransactions returns the grants of a user with points left that
+// are neither expired nor cancelled, soonest expiring first
+func (m TransactionModel) GetActiveTransactions(ctx context.Context, userId uuid.UUID) ([]ActiveTransaction, error) {
+	query := `
+		SELECT id, user_id, COALESCE(external_user_id, ''), amount, created_at,
+			expires_at, remaining_amount, category, tags, get_now()
+		FROM transactions
+		WHERE user_id = $1
+			AND expires_at > get_now()
+			AND remaining_amount > 0
+			AND cancelled_at IS NULL
+		ORDER BY expires_at, id`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transactions := []ActiveTransaction{}
+	for rows.Next() {
+		var transaction ActiveTransaction
+		var now time.Time
+		err := rows.Scan(
+			&transaction.Id,
+			&transaction.UserId,
+			&transaction.ExternalUserId,
+			&transaction.Amount,
+			&transaction.CreatedAt,
+			&transaction.ExpiresAt,
+			&transaction.RemainingAmount,
+			&transaction.Category,
+			pq.Array(&transaction.Tags),
+			&now,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		transaction.DisplayName = displayName(transaction.Category, transaction.Tags)
+		transaction.Reference = reference(transaction.Tags)
+
+		// Whole days left, a grant expiring within 24 hours has 0
+		transaction.DaysUntilExpiry = max(int(transaction.ExpiresAt.Sub(now)/(24*time.Hour)), 0)
+		consumed := float64(transaction.Amount-transaction.RemainingAmount) / float64(transaction.Amount) * 100
+		transaction.PercentConsumed = math.Round(consumed*100) / 100
+
+		transactions = append(transactions, transaction)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return transactions, nil
+}
+
+// GrantImpact is what a simulated withdrawal takes from one grant
+type GrantImpact struct {
+	TransactionId   uuid.UUID `json:"transaction_id"`
+	ExpiresAt       time.Time `json:"expires_at"`
+	RemainingBefore int       `json:"remaining_before"`
+	Deducted        int       `json:"deducted"`
+	RemainingAfter  int       `json:"remaining_after"`
+}
+
+type SimulationResult struct {
+	WouldSucceed   bool          `json:"would_succeed"`
+	AffectedGrants []GrantImpact `json:"affected_grants"`
+	RemainingAfter int           `json:"remaining_after"`
+}
+
+// SimulateWithdraw previews a withdrawal with opts in a read-only
+// transaction and reports the grants it would consume, in the order of the
+// strategy. Debt and daily limit settings are checked like a real withdrawal
+// does, a rejected withdrawal is reported through WouldSucceed with the
+// current balance. Nothing is locked or written, so a concurrent withdrawal
+// can change the outcome.
+func (m TransactionModel) SimulateWithdraw(ctx context.Context, userID uuid.UUID, amount int, opts WithdrawOptions) (*SimulationResult, error) {
+	order, ok := withdrawOrder[opts.Strategy]
+	if !ok {
+		return nil, fmt.Errorf("unknown withdraw strategy %q", opts.Strategy)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// The available points and the debt, the balance is their difference
+	query := `
+		SELECT COALESCE(SUM(remaining_amount) FILTER (WHERE remaining_amount > 0), 0),
+			COALESCE(-SUM(remaining_amount) FILTER (WHERE remaining_amount < 0), 0)
+		FROM transactions
+		WHERE user_id = $1 AND expires_at > get_now() AND remaining_amount <> 0`
+
+	var available, debt int
+	if err = tx.QueryRowContext(ctx, query, userID).Scan(&available, &debt); err != nil {
+		return nil, err
+	}
+
+	result := &SimulationResult{AffectedGrants: []GrantImpact{}, RemainingAfter: available - debt}
+
+	if deficit := amount - available; deficit > 0 && (!opts.AllowDebt || debt+deficit > opts.MaxDebt) {
+		return result, nil
+	}
+
+	if opts.MaxDailyAmount > 0 && amount > 0 {
+		err := checkDailyWithdrawalLimit(ctx, tx, userID, amount, opts.MaxDailyAmount, true)
+		if err != nil {
+			if errors.Is(err, ErrDailyWithdrawalLimitExceeded) {
+				return result, nil
+			}
+			return nil, err
+		}
+	}
+
+	result.WouldSucceed = true
+	result.RemainingAfter -= amount
+
+	// The same running total as the deduction of withdrawTx
+	query = fmt.Sprintf(`
+		SELECT id, expires_at, remaining_amount, LEAST(remaining_amount, $2 - consumed_before)
+		FROM (
+			SELECT id, created_at, expires_at, remaining_amount, COALESCE(SUM(remaining_amount) OVER (
+				ORDER BY %[1]s
+				ROWS BETWEEN UNBOUNDED PRECEDING AND 1 PRECEDING
+			), 0) AS consumed_before
+			FROM transactions
+			WHERE user_id = $1
+				AND expires_at > get_now()
+				AND remaining_amount > 0
+		) fifo
+		WHERE consumed_before < $2
+		ORDER BY %[1]s`, order)
+
+	rows, err := tx.QueryContext(ctx, query, userID, min(amount, available))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var grant GrantImpact
+		err := rows.Scan(&grant.TransactionId, &grant.ExpiresAt, &grant.RemainingBefore, &grant.Deducted)
+		if err != nil {
+			return nil, err
+		}
+		grant.RemainingAfter = grant.RemainingBefore - grant.Deducted
+		result.AffectedGrants = append(result.AffectedGrants, grant)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// ComputeGiniCoefficient measures the inequality of current balances across
+// users holding points, from 0 (all equal) approaching 1 as the points
+// concentrate in one of them. Users without points are not counted, so a
+// single holder yields 0
+func (m TransactionModel) ComputeGiniCoefficient(ctx context.Context) (float64, error) {
+	query := `
+		SELECT user_id, SUM(remaining_amount) AS bal
+		FROM transactions
+		WHERE expires_at > get_now() AND remaining_amount > 0
+		GROUP BY user_id
+		ORDER BY bal`
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var balances []int
+	for rows.Next() {
+		var userId uuid.UUID
+		var balance int
+		if err := rows.Scan(&userId, &balance); err != nil {
+			return 0, err
+		}
+		balances = append(balances, balance)
+	}
+
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	return gini(balances), nil
+}
+
+// gini computes the sample Gini coefficient of ascending values, scaled by
+// n/(n-1) so that one value holding the whole total yields 1 for any n >= 2.
+// Fewer than two values have no inequality and yield 0
+func gini(sorted []int) float64 {
+	n := len(sorted)
+	if n < 2 {
+		return 0
+	}
+
+	var total, weighted float64
+	for i, x := range sorted {
+		total += float64(x)
+		weighted += float64(i+1) * float64(x)
+	}
+	if total == 0 {
+		return 0
+	}
+
+	g := 2*weighted/(float64(n)*total) - float64(n+1)/float64(n)
+	return g * float64(n) / float64(n-1)
+}
@@ -0,0 +1,191 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/google/uuid"
+	"math"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGini(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []int
+		want   float64
+	}{
+		{"no users", nil, 0},
+		{"single holder", []int{500}, 0},
+		{"equal balances", []int{10, 10, 10, 10}, 0},
+		{"one holds everything", []int{0, 0, 0, 100}, 1},
+		{"two users", []int{1, 3}, 0.5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := gini(tt.values); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("gini(%v) = %v, want %v", tt.values, got, tt.want)
+			}
+		})
+	}
+}
+
+// testDB connects to the migrated database in LEDGER_TEST_DSN and skips the
+// test when it is not set
+func testDB(t testing.TB) *sql.DB {
+	t.Helper()
+
+	dsn := os.Getenv("LEDGER_TEST_DSN")
+	if dsn == "" {
+		t.Skip("LEDGER_TEST_DSN is not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+func TestGetBalanceAtIgnoresLaterWithdrawals(t *testing.T) {
+	db := testDB(t)
+	models := NewModels(db)
+	ctx := context.Background()
+
+	userId := uuid.New()
+	t.Cleanup(func() { models.Transactions.DeleteAllForUser(ctx, userId) })
+
+	deposit, err := models.Balances.AddBonusPoints(ctx, Grant{UserId: userId, Amount: 100, LifetimeDays: 30, Category: DefaultCategory}, DepositOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := deposit.CreatedAt
+
+	// created_at has a precision of a second
+	time.Sleep(2 * time.Second)
+
+	if _, err := models.Balances.WithdrawBonusPoints(ctx, userId, 30, WithdrawOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	balance, err := models.Transactions.GetBalanceAt(ctx, userId, at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != 100 {
+		t.Errorf("balance at deposit = %d, want 100", balance)
+	}
+
+	balance, err = models.Transactions.GetBalanceAt(ctx, userId, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != 70 {
+		t.Errorf("balance after withdrawal = %d, want 70", balance)
+	}
+}
+
+func TestBulkWithdrawForUsers(t *testing.T) {
+	db := testDB(t)
+	models := NewModels(db)
+	ctx := context.Background()
+
+	users := []uuid.UUID{uuid.New(), uuid.New(), uuid.New()}
+	for _, userId := range users {
+		t.Cleanup(func() { models.Transactions.DeleteAllForUser(ctx, userId) })
+		if _, err := models.Balances.AddBonusPoints(ctx, Grant{UserId: userId, Amount: 100, LifetimeDays: 30, Category: DefaultCategory}, DepositOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	results, err := models.Transactions.BulkWithdrawForUsers(ctx, []UserWithdrawal{
+		{UserID: users[0], Amount: 40},
+		{UserID: users[1], Amount: 500},
+		{UserID: users[2], Amount: 100},
+	}, WithdrawOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("got %d results, want 3", len(results))
+	}
+
+	wantBalances := []int{60, 100, 0}
+	for i, result := range results {
+		failed := i == 1
+		if failed != errors.Is(result.Err, ErrInsufficientFunds) {
+			t.Errorf("result %d error = %v", i, result.Err)
+		}
+		if failed != (result.WithdrawalId == uuid.Nil) {
+			t.Errorf("result %d withdrawal id = %s", i, result.WithdrawalId)
+		}
+
+		balance, _, err := models.Balances.GetBalanceWithExpiration(ctx, users[i], 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if balance != wantBalances[i] {
+			t.Errorf("balance of user %d = %d, want %d", i, balance, wantBalances[i])
+		}
+	}
+}
+
+func TestCompareAndSwapConcurrent(t *testing.T) {
+	db := testDB(t)
+	models := NewModels(db)
+	ctx := context.Background()
+
+	id := uuid.New()
+	if _, err := db.Exec(`INSERT INTO balances (id, amount) VALUES ($1, 100)`, id); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Exec(`DELETE FROM balances WHERE id = $1`, id) })
+
+	newAmounts := []int{150, 50}
+	swapped := make([]bool, len(newAmounts))
+	errs := make([]error, len(newAmounts))
+
+	var wg sync.WaitGroup
+	for i, newAmount := range newAmounts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			swapped[i], errs[i] = models.Balances.CompareAndSwap(ctx, id, 100, newAmount)
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if swapped[0] == swapped[1] {
+		t.Fatalf("swapped = %v, want exactly one", swapped)
+	}
+
+	winner := newAmounts[0]
+	if swapped[1] {
+		winner = newAmounts[1]
+	}
+
+	var amount int
+	if err := db.QueryRow(`SELECT amount FROM balances WHERE id = $1`, id).Scan(&amount); err != nil {
+		t.Fatal(err)
+	}
+	if amount != winner {
+		t.Errorf("amount = %d, want %d", amount, winner)
+	}
+
+	// A stale expected amount never applies
+	ok, err := models.Balances.CompareAndSwap(ctx, id, 100, 0)
+	if err != nil || ok {
+		t.Errorf("stale swap = %t, %v, want false, nil", ok, err)
+	}
+}
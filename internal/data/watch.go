@@ -0,0 +1,204 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// balanceChannel is the NOTIFY channel of balance changes, the payload is
+// "<user_id>:<balance>"
+const balanceChannel = "balance_changed"
+
+var ErrWatchUnavailable = errors.New("balance watching is not configured")
+
+// notifyBalance queues a notification with the balance as seen by tx for
+// each of the users, PostgreSQL delivers them only when tx commits
+func notifyBalance(ctx context.Context, tx *sql.Tx, userIds ...uuid.UUID) error {
+	if len(userIds) == 0 {
+		return nil
+	}
+
+	query := `
+		SELECT pg_notify($2, u.id::text || ':' || COALESCE(SUM(t.remaining_amount), 0))
+		FROM unnest($1::uuid[]) u(id)
+		LEFT JOIN transactions t ON t.user_id = u.id
+			AND t.expires_at > get_now()
+			AND t.remaining_amount <> 0
+		GROUP BY u.id`
+
+	_, err := tx.ExecContext(ctx, query, pq.Array(userIds), balanceChannel)
+	return err
+}
+
+// execNotifying runs query, an UPDATE returning user_id, and notifies the
+// balances of the updated users. It returns the number of updated rows.
+func execNotifying(ctx context.Context, tx *sql.Tx, query string, args ...any) (int64, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var updated int64
+	seen := make(map[uuid.UUID]bool)
+	var userIds []uuid.UUID
+	for rows.Next() {
+		var userId uuid.UUID
+		if err := rows.Scan(&userId); err != nil {
+			return 0, err
+		}
+		updated++
+		if !seen[userId] {
+			seen[userId] = true
+			userIds = append(userIds, userId)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	rows.Close()
+
+	if err = notifyBalance(ctx, tx, userIds...); err != nil {
+		return 0, err
+	}
+
+	return updated, nil
+}
+
+// BalanceWatcher listens for balance notifications on a dedicated
+// connection and fans them out to the subscribers of each user. The
+// connection is opened by the first subscriber.
+type BalanceWatcher struct {
+	dsn string
+
+	startMu  sync.Mutex
+	listener *pq.Listener
+
+	mu   sync.Mutex
+	subs map[uuid.UUID]map[chan int]struct{}
+}
+
+func NewBalanceWatcher(dsn string) *BalanceWatcher {
+	return &BalanceWatcher{
+		dsn:  dsn,
+		subs: make(map[uuid.UUID]map[chan int]struct{}),
+	}
+}
+
+// start connects and listens until Close unless already listening. The
+// listener reconnects on its own, notifications sent while disconnected
+// are lost.
+func (w *BalanceWatcher) start() error {
+	w.startMu.Lock()
+	defer w.startMu.Unlock()
+
+	if w.listener != nil {
+		return nil
+	}
+
+	listener := pq.NewListener(w.dsn, 10*time.Second, time.Minute, nil)
+	if err := listener.Listen(balanceChannel); err != nil {
+		listener.Close()
+		return err
+	}
+
+	w.listener = listener
+	go w.run()
+
+	return nil
+}
+
+func (w *BalanceWatcher) run() {
+	// Notify is closed by Close, nil marks a reconnect
+	for n := range w.listener.Notify {
+		if n == nil {
+			continue
+		}
+
+		id, balance, ok := strings.Cut(n.Extra, ":")
+		if !ok {
+			continue
+		}
+		userId, err := uuid.Parse(id)
+		if err != nil {
+			continue
+		}
+		b, err := strconv.Atoi(balance)
+		if err != nil {
+			continue
+		}
+
+		w.dispatch(userId, b)
+	}
+}
+
+// dispatch hands balance to every subscriber of userId. A slow subscriber
+// only gets the latest balance, older ones are dropped.
+func (w *BalanceWatcher) dispatch(userId uuid.UUID, balance int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for ch := range w.subs[userId] {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- balance
+	}
+}
+
+func (w *BalanceWatcher) subscribe(ctx context.Context, userId uuid.UUID) (<-chan int, error) {
+	if err := w.start(); err != nil {
+		return nil, err
+	}
+
+	ch := make(chan int, 1)
+
+	w.mu.Lock()
+	if w.subs[userId] == nil {
+		w.subs[userId] = make(map[chan int]struct{})
+	}
+	w.subs[userId][ch] = struct{}{}
+	w.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		w.mu.Lock()
+		defer w.mu.Unlock()
+
+		delete(w.subs[userId], ch)
+		if len(w.subs[userId]) == 0 {
+			delete(w.subs, userId)
+		}
+		close(ch)
+	}()
+
+	return ch, nil
+}
+
+func (w *BalanceWatcher) Close() error {
+	w.startMu.Lock()
+	defer w.startMu.Unlock()
+
+	if w.listener == nil {
+		return nil
+	}
+	return w.listener.Close()
+}
+
+// WatchBalance streams the new balance of the user after every committed
+// change until ctx is done, then the channel is closed
+func (m BalanceModel) WatchBalance(ctx context.Context, userID uuid.UUID) (<-chan int, error) {
+	if m.Watcher == nil {
+		return nil, ErrWatchUnavailable
+	}
+	return m.Watcher.subscribe(ctx, userID)
+}
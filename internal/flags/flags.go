@@ -0,0 +1,86 @@
+// Package flags holds feature flags that can be changed without a restart,
+// they are read from a JSON file or the FEATURE_FLAGS_JSON variable.
+package flags
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+type FeatureFlags struct {
+	// NewWithdrawalStrategyPct is the percentage (0-100) of withdrawals
+	// using the new withdrawal strategy
+	NewWithdrawalStrategyPct int `json:"new_withdrawal_strategy_pct"`
+	// EnableNegativeBalance allows debt in addition to -allow-negative-balance
+	EnableNegativeBalance bool `json:"enable_negative_balance"`
+}
+
+func (f FeatureFlags) validate() error {
+	if f.NewWithdrawalStrategyPct < 0 || f.NewWithdrawalStrategyPct > 100 {
+		return errors.New("new_withdrawal_strategy_pct must be between 0 and 100")
+	}
+	return nil
+}
+
+// Store holds the current flags and is safe for concurrent use. Without a
+// file the flags come from FEATURE_FLAGS_JSON and never change.
+type Store struct {
+	path  string
+	flags atomic.Pointer[FeatureFlags]
+}
+
+// NewStore loads the flags from path, or from FEATURE_FLAGS_JSON when path
+// is empty. Neither being set yields the zero flags.
+func NewStore(path string) (*Store, error) {
+	s := &Store{path: path}
+
+	var b []byte
+	if path != "" {
+		var err error
+		if b, err = os.ReadFile(path); err != nil {
+			return nil, err
+		}
+	} else {
+		b = []byte(os.Getenv("FEATURE_FLAGS_JSON"))
+	}
+
+	if err := s.set(b); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) Get() FeatureFlags {
+	return *s.flags.Load()
+}
+
+// Reload re-reads the file, keeping the current flags when it is invalid
+func (s *Store) Reload() error {
+	if s.path == "" {
+		return nil
+	}
+
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	return s.set(b)
+}
+
+func (s *Store) set(b []byte) error {
+	var f FeatureFlags
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &f); err != nil {
+			return fmt.Errorf("parse feature flags: %w", err)
+		}
+	}
+	if err := f.validate(); err != nil {
+		return err
+	}
+
+	s.flags.Store(&f)
+	return nil
+}
@@ -0,0 +1,28 @@
+// Package hooks lets external systems (email, push, analytics) react to
+// ledger events.
+//
+// Hooks are fire-and-forget: they run in their own goroutine after the
+// change is committed, the request does not wait for them and their
+// failures (including panics) are only logged. Slow hooks therefore never
+// delay responses, but a hook must not assume it runs before the client
+// sees the result.
+package hooks
+
+import (
+	"simple-ledger.itmo.ru/internal/data"
+)
+
+// Hooks holds the optional callbacks, nil fields are skipped. The zero
+// value is a valid no-op set of hooks.
+type Hooks struct {
+	// OnDeposit is called with the stored grant
+	OnDeposit func(*data.Transaction)
+	// OnWithdrawal is called with the withdrawn amount as Transaction.Amount
+	// and the balance left after the withdrawal
+	OnWithdrawal func(*data.Transaction, int)
+	// OnExpiry is called for every grant expired by a cleanup job
+	OnExpiry func(*data.Transaction)
+	// OnRevert is called with the reverted withdrawal, the restored amount
+	// as Transaction.Amount, and the balance after the revert
+	OnRevert func(*data.Transaction, int)
+}
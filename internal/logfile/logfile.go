@@ -0,0 +1,89 @@
+// Package logfile provides a log destination that cooperates with logrotate
+// and can roll itself over once it grows too large.
+package logfile
+
+import (
+	"os"
+	"sync"
+)
+
+// File is an append-only log file safe for concurrent use
+type File struct {
+	path    string
+	maxSize int64
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// Open opens path for appending, creating it when missing. With maxSize > 0
+// the file is renamed to path.1 (replacing an older one) and a fresh file is
+// started before a write would make it larger than maxSize bytes.
+func Open(path string, maxSize int64) (*File, error) {
+	lf := &File{path: path, maxSize: maxSize}
+	if err := lf.open(); err != nil {
+		return nil, err
+	}
+	return lf, nil
+}
+
+func (lf *File) open() error {
+	f, err := os.OpenFile(lf.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	lf.f = f
+	lf.size = info.Size()
+	return nil
+}
+
+func (lf *File) Write(p []byte) (int, error) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+
+	if lf.maxSize > 0 && lf.size > 0 && lf.size+int64(len(p)) > lf.maxSize {
+		if err := lf.roll(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := lf.f.Write(p)
+	lf.size += int64(n)
+	return n, err
+}
+
+func (lf *File) roll() error {
+	if err := lf.f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(lf.path, lf.path+".1"); err != nil {
+		return err
+	}
+	return lf.open()
+}
+
+// Reopen closes the file and opens path again, after logrotate moved it
+func (lf *File) Reopen() error {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+
+	if err := lf.f.Close(); err != nil {
+		return err
+	}
+	return lf.open()
+}
+
+func (lf *File) Close() error {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+
+	return lf.f.Close()
+}
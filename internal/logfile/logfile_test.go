@@ -0,0 +1,112 @@
+package logfile
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestLoggerWritesToFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.log")
+
+	lf, err := Open(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lf.Close()
+
+	logger := slog.New(slog.NewTextHandler(lf, nil))
+	logger.Info("starting server", "port", 8080)
+	logger.Error("database unavailable")
+
+	got := readFile(t, path)
+	for _, want := range []string{`msg="starting server" port=8080`, `level=ERROR msg="database unavailable"`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("log %q lacks %q", got, want)
+		}
+	}
+}
+
+func TestOpenAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.log")
+	if err := os.WriteFile(path, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lf, err := Open(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lf.Close()
+
+	if _, err := lf.Write([]byte("new\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, path); got != "old\nnew\n" {
+		t.Errorf("log = %q", got)
+	}
+}
+
+func TestReopenAfterRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.log")
+
+	lf, err := Open(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lf.Close()
+
+	lf.Write([]byte("before\n"))
+
+	// What logrotate does before sending SIGHUP
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := lf.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	lf.Write([]byte("after\n"))
+
+	if got := readFile(t, path+".1"); got != "before\n" {
+		t.Errorf("rotated log = %q", got)
+	}
+	if got := readFile(t, path); got != "after\n" {
+		t.Errorf("new log = %q", got)
+	}
+}
+
+func TestRollOverMaxSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.log")
+
+	lf, err := Open(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lf.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n"} {
+		if _, err := lf.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only one old file is kept
+	if got := readFile(t, path+".1"); got != "second\n" {
+		t.Errorf("rolled log = %q", got)
+	}
+	if got := readFile(t, path); got != "third\n" {
+		t.Errorf("current log = %q", got)
+	}
+}
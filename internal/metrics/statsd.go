@@ -0,0 +1,31 @@
+package metrics
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// StatsD pushes metrics to a StatsD (or Datadog agent) server over UDP.
+// Delivery is best effort, like the protocol itself.
+type StatsD struct {
+	conn net.Conn
+}
+
+func NewStatsD(addr string) (*StatsD, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StatsD{conn: conn}, nil
+}
+
+func (s *StatsD) Gauge(name string, value float64) error {
+	_, err := fmt.Fprintf(s.conn, "%s:%s|g", name, strconv.FormatFloat(value, 'f', -1, 64))
+	return err
+}
+
+func (s *StatsD) Close() error {
+	return s.conn.Close()
+}
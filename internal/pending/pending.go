@@ -0,0 +1,28 @@
+// Package pending tracks operations in flight per user, so that duplicate
+// requests can be rejected before they reach the database.
+package pending
+
+import (
+	"github.com/google/uuid"
+	"sync"
+)
+
+// PendingSet is a set of user ids safe for concurrent use. The zero value
+// is an empty set.
+type PendingSet struct {
+	m sync.Map
+}
+
+func New() *PendingSet {
+	return &PendingSet{}
+}
+
+// TryAcquire adds userId to the set, it returns false when already present
+func (s *PendingSet) TryAcquire(userId uuid.UUID) bool {
+	_, loaded := s.m.LoadOrStore(userId, struct{}{})
+	return !loaded
+}
+
+func (s *PendingSet) Release(userId uuid.UUID) {
+	s.m.Delete(userId)
+}
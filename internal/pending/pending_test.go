@@ -0,0 +1,50 @@
+package pending
+
+import (
+	"github.com/google/uuid"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestTryAcquireConcurrent(t *testing.T) {
+	s := New()
+	userId := uuid.New()
+
+	var acquired atomic.Int32
+	var wg sync.WaitGroup
+	for range 100 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if s.TryAcquire(userId) {
+				acquired.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := acquired.Load(); got != 1 {
+		t.Fatalf("acquired %d times, want 1", got)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	s := New()
+	alice, bob := uuid.New(), uuid.New()
+
+	if !s.TryAcquire(alice) {
+		t.Fatal("empty set refused alice")
+	}
+	if !s.TryAcquire(bob) {
+		t.Error("bob is blocked by alice")
+	}
+	if s.TryAcquire(alice) {
+		t.Error("alice acquired twice")
+	}
+
+	s.Release(alice)
+	if !s.TryAcquire(alice) {
+		t.Error("alice not acquirable after release")
+	}
+}
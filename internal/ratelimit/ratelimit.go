@@ -0,0 +1,152 @@
+// Package ratelimit limits how often a user may do something within a
+// sliding window of time.
+package ratelimit
+
+import (
+	"github.com/google/uuid"
+	"sync"
+	"time"
+)
+
+// SlidingWindow allows each user at most limit events within any window.
+// An event is reserved before the limited operation runs and only counted
+// when the operation succeeds, reservations in flight count against the
+// limit so that concurrent operations cannot all pass. Timestamps older
+// than the window are pruned when the user is checked, users without recent
+// events are evicted at most once per window.
+type SlidingWindow struct {
+	limit  int
+	window time.Duration
+	users  sync.Map // uuid.UUID -> *userEvents
+	now    func() time.Time
+
+	sweepMu   sync.Mutex
+	lastSweep time.Time
+}
+
+type userEvents struct {
+	mu    sync.Mutex
+	times []time.Time
+	// reserved counts the reservations neither committed nor cancelled yet
+	reserved int
+	// evicted entries are no longer in users, Reserve must not use them
+	evicted bool
+}
+
+func New(limit int, window time.Duration) *SlidingWindow {
+	return &SlidingWindow{
+		limit:  limit,
+		window: window,
+		now:    time.Now,
+	}
+}
+
+// Reservation is an event of a user that is not counted yet. Exactly one of
+// Commit and Cancel takes effect, later calls are no-ops.
+type Reservation struct {
+	s      *SlidingWindow
+	events *userEvents
+	done   bool
+}
+
+// Reserve reserves an event of userId when the user's events in the window
+// and reservations in flight are fewer than limit. Otherwise it returns nil
+// and how long until the oldest event leaves the window.
+func (s *SlidingWindow) Reserve(userId uuid.UUID) (*Reservation, time.Duration) {
+	now := s.now()
+	s.sweep(now)
+
+	for {
+		v, _ := s.users.LoadOrStore(userId, &userEvents{})
+		events := v.(*userEvents)
+
+		events.mu.Lock()
+		if events.evicted {
+			// Lost a race with sweep, the next LoadOrStore stores a new entry
+			events.mu.Unlock()
+			continue
+		}
+
+		cutoff := now.Add(-s.window)
+		events.prune(cutoff)
+
+		if len(events.times)+events.reserved >= s.limit {
+			retryAfter := s.window
+			if len(events.times) > 0 {
+				retryAfter = events.times[0].Sub(cutoff)
+			}
+			events.mu.Unlock()
+			return nil, retryAfter
+		}
+
+		events.reserved++
+		events.mu.Unlock()
+		return &Reservation{s: s, events: events}, 0
+	}
+}
+
+// Commit counts the reserved event now
+func (r *Reservation) Commit() {
+	r.events.mu.Lock()
+	defer r.events.mu.Unlock()
+
+	if r.done {
+		return
+	}
+	r.done = true
+
+	now := r.s.now()
+	r.events.reserved--
+	r.events.prune(now.Add(-r.s.window))
+	r.events.times = append(r.events.times, now)
+}
+
+// Cancel releases the reservation without counting an event, so failed
+// attempts are free
+func (r *Reservation) Cancel() {
+	r.events.mu.Lock()
+	defer r.events.mu.Unlock()
+
+	if r.done {
+		return
+	}
+	r.done = true
+	r.events.reserved--
+}
+
+// sweep evicts the users without events in the window nor reservations in
+// flight, unless that was done less than a window ago
+func (s *SlidingWindow) sweep(now time.Time) {
+	if !s.sweepMu.TryLock() {
+		return
+	}
+	defer s.sweepMu.Unlock()
+
+	if now.Sub(s.lastSweep) < s.window {
+		return
+	}
+	s.lastSweep = now
+
+	cutoff := now.Add(-s.window)
+	s.users.Range(func(key, v any) bool {
+		events := v.(*userEvents)
+
+		events.mu.Lock()
+		events.prune(cutoff)
+		if len(events.times) == 0 && events.reserved == 0 {
+			events.evicted = true
+			s.users.CompareAndDelete(key, events)
+		}
+		events.mu.Unlock()
+		return true
+	})
+}
+
+// prune drops the timestamps not after cutoff, they are appended in order
+func (e *userEvents) prune(cutoff time.Time) {
+	i := 0
+	for i < len(e.times) && !e.times[i].After(cutoff) {
+		i++
+	}
+	e.times = e.times[i:]
+}
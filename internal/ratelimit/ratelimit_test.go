@@ -0,0 +1,168 @@
+package ratelimit
+
+import (
+	"github.com/google/uuid"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestWindow returns a limiter whose clock is moved with the returned
+// function
+func newTestWindow(limit int, window time.Duration) (*SlidingWindow, func(time.Duration)) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	s := New(limit, window)
+	s.now = func() time.Time { return now }
+	return s, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestSlidingWindowRejectsOverLimit(t *testing.T) {
+	s, advance := newTestWindow(10, time.Minute)
+	userId := uuid.New()
+
+	// 11 withdrawals within one second
+	for i := 1; i <= 10; i++ {
+		r, _ := s.Reserve(userId)
+		if r == nil {
+			t.Fatalf("withdrawal %d rejected", i)
+		}
+		r.Commit()
+		advance(90 * time.Millisecond)
+	}
+
+	r, retryAfter := s.Reserve(userId)
+	if r != nil {
+		t.Fatal("withdrawal 11 allowed")
+	}
+	if want := 59100 * time.Millisecond; retryAfter != want {
+		t.Errorf("retry after %v, want %v", retryAfter, want)
+	}
+
+	if r, _ := s.Reserve(uuid.New()); r == nil {
+		t.Error("other user rejected")
+	}
+
+	advance(retryAfter)
+	if r, _ := s.Reserve(userId); r == nil {
+		t.Error("withdrawal rejected after the oldest left the window")
+	}
+}
+
+func TestSlidingWindowCountsOnlyCommitted(t *testing.T) {
+	s, _ := newTestWindow(1, time.Minute)
+	userId := uuid.New()
+
+	for range 5 {
+		r, _ := s.Reserve(userId)
+		if r == nil {
+			t.Fatal("cancelled attempts used up the limit")
+		}
+		r.Cancel()
+	}
+
+	r, _ := s.Reserve(userId)
+	r.Commit()
+	r.Cancel()
+	if r, _ := s.Reserve(userId); r != nil {
+		t.Error("committed event not counted")
+	}
+}
+
+func TestSlidingWindowCountsReservationsInFlight(t *testing.T) {
+	s, _ := newTestWindow(3, time.Minute)
+	userId := uuid.New()
+
+	var reservations []*Reservation
+	for i := 1; i <= 3; i++ {
+		r, _ := s.Reserve(userId)
+		if r == nil {
+			t.Fatalf("reservation %d rejected", i)
+		}
+		reservations = append(reservations, r)
+	}
+
+	if r, _ := s.Reserve(userId); r != nil {
+		t.Fatal("reservation over the limit allowed while others are in flight")
+	}
+
+	reservations[0].Cancel()
+	if r, _ := s.Reserve(userId); r == nil {
+		t.Error("cancelled reservation still counted")
+	}
+}
+
+func TestSlidingWindowConcurrentReservations(t *testing.T) {
+	s := New(10, time.Minute)
+	userId := uuid.New()
+
+	var wg sync.WaitGroup
+	var allowed atomic.Int32
+	for range 100 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if r, _ := s.Reserve(userId); r != nil {
+				allowed.Add(1)
+				r.Commit()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := allowed.Load(); n != 10 {
+		t.Errorf("%d of 100 concurrent withdrawals allowed, want 10", n)
+	}
+}
+
+func TestSlidingWindowEvictsIdleUsers(t *testing.T) {
+	s, advance := newTestWindow(10, time.Minute)
+	idle, active, reserving := uuid.New(), uuid.New(), uuid.New()
+
+	r, _ := s.Reserve(idle)
+	r.Commit()
+	inFlight, _ := s.Reserve(reserving)
+	advance(2 * time.Minute)
+	r, _ = s.Reserve(active)
+	r.Commit()
+
+	if _, ok := s.users.Load(idle); ok {
+		t.Error("idle user not evicted")
+	}
+	if _, ok := s.users.Load(active); !ok {
+		t.Error("active user evicted")
+	}
+	if _, ok := s.users.Load(reserving); !ok {
+		t.Error("user with a reservation in flight evicted")
+	}
+	inFlight.Cancel()
+
+	if r, _ := s.Reserve(idle); r == nil {
+		t.Error("evicted user rejected")
+	}
+	if _, ok := s.users.Load(idle); !ok {
+		t.Error("evicted user not stored again")
+	}
+}
+
+func BenchmarkSlidingWindow(b *testing.B) {
+	const users = 10000
+
+	s := New(10, time.Minute)
+	ids := make([]uuid.UUID, users)
+	for i := range ids {
+		ids[i] = uuid.New()
+	}
+
+	b.SetParallelism(users / 100)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if r, _ := s.Reserve(ids[i%users]); r != nil {
+				r.Commit()
+			}
+			i += 7
+		}
+	})
+}
@@ -0,0 +1,110 @@
+// Package sqlbuilder assembles PostgreSQL SELECT statements whose WHERE
+// clause depends on the filters given, numbering the bind parameters.
+package sqlbuilder
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// SelectBuilder builds a single SELECT statement. Conditions are written
+// with ? placeholders which are replaced by $1, $2, ... in the order the
+// arguments were added.
+type SelectBuilder struct {
+	columns []string
+	from    string
+	where   []string
+	orderBy []string
+	args    []any
+	limit   int
+	offset  int
+}
+
+// Select starts a statement returning the given columns
+func Select(columns ...string) *SelectBuilder {
+	return &SelectBuilder{columns: columns}
+}
+
+func (b *SelectBuilder) From(table string) *SelectBuilder {
+	b.from = table
+	return b
+}
+
+// Where adds a condition joined to the others with AND. It panics when the
+// number of ? placeholders differs from the number of args.
+func (b *SelectBuilder) Where(condition string, args ...any) *SelectBuilder {
+	if n := strings.Count(condition, "?"); n != len(args) {
+		panic(fmt.Sprintf("sqlbuilder: condition %q has %d placeholders but %d args", condition, n, len(args)))
+	}
+
+	var sb strings.Builder
+	next := 0
+	for _, r := range condition {
+		if r != '?' {
+			sb.WriteRune(r)
+			continue
+		}
+		sb.WriteString(b.bind(args[next]))
+		next++
+	}
+
+	b.where = append(b.where, sb.String())
+	return b
+}
+
+// OrderBy appends a sort column, dir is ASC, DESC or empty for the default
+func (b *SelectBuilder) OrderBy(col, dir string) *SelectBuilder {
+	if dir != "" {
+		col += " " + dir
+	}
+	b.orderBy = append(b.orderBy, col)
+	return b
+}
+
+// Limit caps the number of rows, zero means no limit
+func (b *SelectBuilder) Limit(n int) *SelectBuilder {
+	b.limit = n
+	return b
+}
+
+// Offset skips the first n rows
+func (b *SelectBuilder) Offset(n int) *SelectBuilder {
+	b.offset = n
+	return b
+}
+
+// Build returns the statement and its arguments. LIMIT and OFFSET are bound
+// after the WHERE arguments.
+func (b *SelectBuilder) Build() (string, []any) {
+	// Clone so that Build can be called more than once
+	args := slices.Clone(b.args)
+	bind := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	var sb strings.Builder
+	sb.WriteString("SELECT " + strings.Join(b.columns, ", "))
+	sb.WriteString(" FROM " + b.from)
+	if len(b.where) > 0 {
+		sb.WriteString(" WHERE " + strings.Join(b.where, " AND "))
+	}
+	if len(b.orderBy) > 0 {
+		sb.WriteString(" ORDER BY " + strings.Join(b.orderBy, ", "))
+	}
+	if b.limit > 0 {
+		sb.WriteString(" LIMIT " + bind(b.limit))
+	}
+	if b.offset > 0 {
+		sb.WriteString(" OFFSET " + bind(b.offset))
+	}
+
+	return sb.String(), args
+}
+
+func (b *SelectBuilder) bind(v any) string {
+	b.args = append(b.args, v)
+	return "$" + strconv.Itoa(len(b.args))
+}
@@ -0,0 +1,84 @@
+package sqlbuilder
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSelectBuild(t *testing.T) {
+	tests := []struct {
+		name      string
+		builder   *SelectBuilder
+		wantQuery string
+		wantArgs  []any
+	}{
+		{
+			name:      "no conditions",
+			builder:   Select("id", "amount").From("transactions"),
+			wantQuery: "SELECT id, amount FROM transactions",
+			wantArgs:  []any{},
+		},
+		{
+			name: "multiple conditions",
+			builder: Select("id").From("transactions").
+				Where("user_id = ?", "u1").
+				Where("created_at BETWEEN ? AND ?", "2025-01-01", "2025-02-01").
+				Where("cancelled_at IS NULL"),
+			wantQuery: "SELECT id FROM transactions WHERE user_id = $1 AND created_at BETWEEN $2 AND $3 AND cancelled_at IS NULL",
+			wantArgs:  []any{"u1", "2025-01-01", "2025-02-01"},
+		},
+		{
+			name: "multiple order by columns",
+			builder: Select("id").From("transactions").
+				OrderBy("expires_at", "ASC").
+				OrderBy("created_at", "DESC").
+				OrderBy("id", ""),
+			wantQuery: "SELECT id FROM transactions ORDER BY expires_at ASC, created_at DESC, id",
+			wantArgs:  []any{},
+		},
+		{
+			name: "limit and offset bound after conditions",
+			builder: Select("id").From("transactions").
+				Limit(20).
+				Where("amount > ?", 0).
+				Offset(40).
+				Where("category = ?", "referral"),
+			wantQuery: "SELECT id FROM transactions WHERE amount > $1 AND category = $2 LIMIT $3 OFFSET $4",
+			wantArgs:  []any{0, "referral", 20, 40},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, args := tt.builder.Build()
+			if query != tt.wantQuery {
+				t.Errorf("query\n got: %s\nwant: %s", query, tt.wantQuery)
+			}
+			if len(args) != 0 || len(tt.wantArgs) != 0 {
+				if !reflect.DeepEqual(args, tt.wantArgs) {
+					t.Errorf("args %v, want %v", args, tt.wantArgs)
+				}
+			}
+		})
+	}
+}
+
+func TestSelectBuildTwice(t *testing.T) {
+	b := Select("id").From("transactions").Where("user_id = ?", "u1").Limit(10)
+
+	first, firstArgs := b.Build()
+	second, secondArgs := b.Build()
+	if first != second || !reflect.DeepEqual(firstArgs, secondArgs) {
+		t.Errorf("second Build = %q %v, want %q %v", second, secondArgs, first, firstArgs)
+	}
+}
+
+func TestWherePanicsOnPlaceholderMismatch(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Where did not panic")
+		}
+	}()
+
+	Select("id").From("transactions").Where("user_id = ? AND amount > ?", "u1")
+}
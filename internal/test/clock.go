@@ -0,0 +1,29 @@
+// Package test holds helpers for tests running against a real database.
+package test
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+// AdvanceClock moves the time seen by get_now() forward by duration. The
+// override is a session setting, so db must be limited to a single
+// connection with db.SetMaxOpenConns(1). The override is cleared when the
+// test finishes.
+func AdvanceClock(t *testing.T, db *sql.DB, duration time.Duration) {
+	t.Helper()
+
+	query := `
+		SELECT set_config('ledger.now_override', (get_now() + $1 * INTERVAL '1 microsecond')::text, false)`
+
+	if _, err := db.Exec(query, duration.Microseconds()); err != nil {
+		t.Fatalf("advance clock: %v", err)
+	}
+
+	t.Cleanup(func() {
+		if _, err := db.Exec(`SELECT set_config('ledger.now_override', '', false)`); err != nil {
+			t.Errorf("reset clock: %v", err)
+		}
+	})
+}
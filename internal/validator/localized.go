@@ -0,0 +1,107 @@
+package validator
+
+import (
+	"embed"
+	"encoding/json"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// DefaultLocale is used for unknown locales and missing messages
+const DefaultLocale = "en"
+
+//go:embed locales/*.json
+var localeFS embed.FS
+
+// messages maps locale -> message key -> template
+var messages = loadMessages()
+
+func loadMessages() map[string]map[string]*template.Template {
+	files, err := localeFS.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+
+	all := make(map[string]map[string]*template.Template, len(files))
+	for _, file := range files {
+		b, err := localeFS.ReadFile(path.Join("locales", file.Name()))
+		if err != nil {
+			panic(err)
+		}
+
+		var raw map[string]string
+		if err := json.Unmarshal(b, &raw); err != nil {
+			panic(err)
+		}
+
+		locale := strings.TrimSuffix(file.Name(), ".json")
+		all[locale] = make(map[string]*template.Template, len(raw))
+		for key, text := range raw {
+			all[locale][key] = template.Must(template.New(key).Parse(text))
+		}
+	}
+	return all
+}
+
+// LocalizedValidator renders error messages from the embedded locale files
+type LocalizedValidator struct {
+	*Validator
+	locale string
+}
+
+// NewLocalized returns a validator for locale, falling back to English
+func NewLocalized(locale string) *LocalizedValidator {
+	if _, ok := messages[locale]; !ok {
+		locale = DefaultLocale
+	}
+	return &LocalizedValidator{Validator: New(), locale: locale}
+}
+
+// CheckMsg adds the message messageKey for field when cond is false. The
+// template gets .Field and .Value (the constraint, e.g. a maximum).
+func (v *LocalizedValidator) CheckMsg(cond bool, field, messageKey string, value any) {
+	if !cond {
+		v.AddError(field, v.message(field, messageKey, value))
+	}
+}
+
+// CheckMsgFatal is CheckMsg with the fail-fast behaviour of CheckFatal
+func (v *LocalizedValidator) CheckMsgFatal(cond bool, field, messageKey string, value any) {
+	if !cond {
+		v.CheckFatal(false, field, v.message(field, messageKey, value))
+	}
+}
+
+func (v *LocalizedValidator) message(field, key string, value any) string {
+	tmpl, ok := messages[v.locale][key]
+	if !ok {
+		tmpl, ok = messages[DefaultLocale][key]
+	}
+	if !ok {
+		return key
+	}
+
+	var sb strings.Builder
+	data := struct {
+		Field string
+		Value any
+	}{field, value}
+	if err := tmpl.Execute(&sb, data); err != nil {
+		return key
+	}
+	return sb.String()
+}
+
+// MatchLocale returns the first supported language of an Accept-Language
+// header, quality values are ignored in favour of the listed order
+func MatchLocale(acceptLanguage string) string {
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, _, _ := strings.Cut(strings.TrimSpace(part), ";")
+		lang, _, _ := strings.Cut(strings.ToLower(tag), "-")
+		if _, ok := messages[lang]; ok {
+			return lang
+		}
+	}
+	return DefaultLocale
+}
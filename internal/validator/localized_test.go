@@ -0,0 +1,82 @@
+package validator
+
+import "testing"
+
+func TestCheckMsg(t *testing.T) {
+	tests := []struct {
+		name   string
+		locale string
+		key    string
+		value  any
+		want   string
+	}{
+		{"english", "en", "must_be_positive", nil, "must be positive"},
+		{"russian", "ru", "must_be_positive", nil, "должно быть положительным"},
+		{"unknown locale", "de", "must_be_positive", nil, "must be positive"},
+		{"english value", "en", "must_be_maximum", 100, "must be a maximum of 100"},
+		{"russian value", "ru", "must_be_maximum", 100, "должно быть не больше 100"},
+		{"map value", "en", "must_not_contain_more_than", map[string]any{"max": 20, "noun": "tags"}, "must not contain more than 20 tags"},
+		{"unknown key", "en", "no_such_message", nil, "no_such_message"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewLocalized(tt.locale)
+			v.CheckMsg(false, "field", tt.key, tt.value)
+			if got := v.Errors["field"]; got != tt.want {
+				t.Errorf("message = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocalesHaveSameKeys(t *testing.T) {
+	for locale, msgs := range messages {
+		for key := range messages[DefaultLocale] {
+			if _, ok := msgs[key]; !ok {
+				t.Errorf("%s is missing %q", locale, key)
+			}
+		}
+		for key := range msgs {
+			if _, ok := messages[DefaultLocale][key]; !ok {
+				t.Errorf("%s has %q, which %s lacks", locale, key, DefaultLocale)
+			}
+		}
+	}
+}
+
+func TestMatchLocale(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", "en"},
+		{"ru", "ru"},
+		{"ru-RU,ru;q=0.9,en;q=0.8", "ru"},
+		{"de-DE, ru;q=0.5", "ru"},
+		{"EN-us", "en"},
+		{"fr, de", "en"},
+	}
+
+	for _, tt := range tests {
+		if got := MatchLocale(tt.header); got != tt.want {
+			t.Errorf("MatchLocale(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestCheckMsgFatalStopsValidation(t *testing.T) {
+	v := NewLocalized("ru")
+	v.CheckMsgFatal(false, "user_id", "must_be_uuid", nil)
+	v.CheckMsg(false, "amount", "must_be_positive", nil)
+
+	if v.Valid() {
+		t.Fatal("validator is valid after a fatal check failed")
+	}
+	if _, ok := v.Errors["amount"]; ok {
+		t.Error("check after a failed fatal check was recorded")
+	}
+	if len(v.Errors) != 1 {
+		t.Errorf("errors = %v, want only user_id", v.Errors)
+	}
+}
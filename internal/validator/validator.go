@@ -4,6 +4,7 @@ import "regexp"
 
 type Validator struct {
 	Errors map[string]string
+	halted bool
 }
 
 func New() *Validator {
@@ -14,7 +15,12 @@ func (v *Validator) Valid() bool {
 	return len(v.Errors) == 0
 }
 
+// AddError records message for key unless key already has one or a
+// CheckFatal failed before
 func (v *Validator) AddError(key, message string) {
+	if v.halted {
+		return
+	}
 	if _, exists := v.Errors[key]; !exists {
 		v.Errors[key] = message
 	}
@@ -26,6 +32,15 @@ func (v *Validator) Check(ok bool, key, message string) {
 	}
 }
 
+// CheckFatal is Check for conditions later checks depend on. On failure
+// the validator stays invalid and ignores all further checks.
+func (v *Validator) CheckFatal(ok bool, key, message string) {
+	if !ok {
+		v.AddError(key, message)
+		v.halted = true
+	}
+}
+
 func IsPermitted[T comparable](value T, permittedValues ...T) bool {
 	for i := range permittedValues {
 		if value == permittedValues[i] {
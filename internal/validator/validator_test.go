@@ -0,0 +1,66 @@
+package validator
+
+import "testing"
+
+func TestCheckFatal(t *testing.T) {
+	tests := []struct {
+		name   string
+		checks func(v *Validator)
+		want   map[string]string
+	}{
+		{
+			"passing fatal check",
+			func(v *Validator) {
+				v.CheckFatal(true, "user_id", "must be uuid")
+				v.Check(false, "amount", "must be positive")
+			},
+			map[string]string{"amount": "must be positive"},
+		},
+		{
+			"failing fatal check skips later checks",
+			func(v *Validator) {
+				v.CheckFatal(false, "user_id", "must be uuid")
+				v.Check(false, "amount", "must be positive")
+				v.CheckFatal(false, "type", "must be deposit or withdrawal")
+			},
+			map[string]string{"user_id": "must be uuid"},
+		},
+		{
+			"earlier errors are kept",
+			func(v *Validator) {
+				v.Check(false, "amount", "must be positive")
+				v.CheckFatal(false, "user_id", "must be uuid")
+				v.AddError("type", "must be deposit or withdrawal")
+			},
+			map[string]string{"amount": "must be positive", "user_id": "must be uuid"},
+		},
+		{
+			"field already failed",
+			func(v *Validator) {
+				v.Check(false, "user_id", "must be provided")
+				v.CheckFatal(false, "user_id", "must be uuid")
+				v.Check(false, "amount", "must be positive")
+			},
+			map[string]string{"user_id": "must be provided"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := New()
+			tt.checks(v)
+
+			if v.Valid() {
+				t.Fatal("validator is valid")
+			}
+			if len(v.Errors) != len(tt.want) {
+				t.Fatalf("errors = %v, want %v", v.Errors, tt.want)
+			}
+			for key, message := range tt.want {
+				if v.Errors[key] != message {
+					t.Errorf("errors = %v, want %v", v.Errors, tt.want)
+				}
+			}
+		})
+	}
+}
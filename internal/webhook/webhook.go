@@ -0,0 +1,88 @@
+// Package webhook delivers JSON payloads to an operator-configured URL.
+//
+// When a secret is configured every request carries the header
+//
+//	X-Signature: sha256=<hex>
+//
+// where <hex> is the lowercase hex encoded HMAC-SHA256 of the raw request
+// body keyed with the secret. Receivers recompute the HMAC over the body
+// exactly as received (before any JSON decoding) and compare it to the
+// header in constant time, see VerifySignature.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const signaturePrefix = "sha256="
+
+type Sender struct {
+	URL    string
+	Secret string
+	Client *http.Client
+}
+
+func NewSender(url, secret string) *Sender {
+	return &Sender{
+		URL:    url,
+		Secret: secret,
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Send posts payload to the webhook URL, any non-2xx response is an error
+func (s *Sender) Send(ctx context.Context, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if s.Secret != "" {
+		req.Header.Set("X-Signature", Sign([]byte(s.Secret), payload))
+	}
+
+	res, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+// Sign returns the X-Signature header value for payload
+func Sign(secret, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature reports whether header is a valid signature of payload
+func VerifySignature(secret, payload []byte, header string) bool {
+	signature, ok := strings.CutPrefix(header, signaturePrefix)
+	if !ok {
+		return false
+	}
+
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return hmac.Equal(got, mac.Sum(nil))
+}
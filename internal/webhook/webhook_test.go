@@ -0,0 +1,72 @@
+package webhook
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSendSignsPayload(t *testing.T) {
+	var body []byte
+	var signature string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		signature = r.Header.Get("X-Signature")
+	}))
+	defer server.Close()
+
+	secret := []byte("s3cret")
+	payload := []byte(`{"type":"deposit","user_id":"42","amount":100}`)
+	if err := NewSender(server.URL, string(secret)).Send(context.Background(), payload); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		secret  []byte
+		payload []byte
+		header  string
+		want    bool
+	}{
+		{"correct secret", secret, body, signature, true},
+		{"wrong secret", []byte("guess"), body, signature, false},
+		{"tampered body", secret, []byte(`{"type":"deposit","user_id":"42","amount":1000}`), signature, false},
+		{"missing prefix", secret, body, signature[len(signaturePrefix):], false},
+		{"not hex", secret, body, signaturePrefix + "zz", false},
+		{"no header", secret, body, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := VerifySignature(tt.secret, tt.payload, tt.header); got != tt.want {
+				t.Errorf("VerifySignature = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendWithoutSecret(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Signature") != "" {
+			t.Error("unsigned sender sent X-Signature")
+		}
+	}))
+	defer server.Close()
+
+	if err := NewSender(server.URL, "").Send(context.Background(), []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSendRejectsErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	if err := NewSender(server.URL, "").Send(context.Background(), []byte(`{}`)); err == nil {
+		t.Error("502 response not reported")
+	}
+}
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS frozen_users (
+    user_id uuid PRIMARY KEY,
+    reason TEXT NOT NULL,
+    frozen_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    frozen_by TEXT NOT NULL
+);
@@ -0,0 +1,8 @@
+ALTER TABLE transactions
+    DROP CONSTRAINT IF EXISTS amount_check,
+    DROP CONSTRAINT IF EXISTS remaining_amount_check;
+
+ALTER TABLE transactions
+    ADD CONSTRAINT transactions_amount_check CHECK (amount > 0),
+    ADD CONSTRAINT transactions_remaining_amount_check CHECK (remaining_amount >= 0),
+    ADD CONSTRAINT remaining_amount_check CHECK (remaining_amount <= amount);
@@ -0,0 +1,12 @@
+ALTER TABLE transactions
+    DROP CONSTRAINT IF EXISTS transactions_amount_check,
+    DROP CONSTRAINT IF EXISTS transactions_remaining_amount_check,
+    DROP CONSTRAINT IF EXISTS remaining_amount_check;
+
+-- Debt rows have a negative amount and a remaining amount between it and zero
+ALTER TABLE transactions
+    ADD CONSTRAINT amount_check CHECK (amount <> 0),
+    ADD CONSTRAINT remaining_amount_check CHECK (
+        (amount > 0 AND remaining_amount BETWEEN 0 AND amount) OR
+        (amount < 0 AND remaining_amount BETWEEN amount AND 0)
+    );
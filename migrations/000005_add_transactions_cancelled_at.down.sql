@@ -0,0 +1 @@
+ALTER TABLE transactions DROP COLUMN IF EXISTS cancelled_at;
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS balance_snapshots (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id uuid NOT NULL,
+    balance int NOT NULL,
+    expirations jsonb NOT NULL DEFAULT '{}',
+    snapshot_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    label TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX idx_balance_snapshots_user_id ON balance_snapshots(user_id, snapshot_at);
@@ -0,0 +1 @@
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS category VARCHAR(64) NOT NULL DEFAULT 'default';
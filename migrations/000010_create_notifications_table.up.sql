@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS notifications (
+    id bigserial PRIMARY KEY,
+    user_id uuid NOT NULL,
+    type TEXT NOT NULL CHECK (type IN ('expiry_warning', 'expiry_occurred')),
+    points int NOT NULL,
+    expires_on date NOT NULL,
+    sent_at timestamp(0) with time zone,
+    delivery_status TEXT NOT NULL DEFAULT 'pending' CHECK (delivery_status IN ('pending', 'sent', 'failed'))
+);
+
+CREATE UNIQUE INDEX idx_notifications_user_type_expires ON notifications(user_id, type, expires_on);
@@ -0,0 +1,5 @@
+-- get_now returns the ledger.now_override session setting when set and NOW()
+-- otherwise, so tests can move the clock without rewriting rows
+CREATE OR REPLACE FUNCTION get_now() RETURNS timestamp with time zone AS $$
+    SELECT COALESCE(NULLIF(current_setting('ledger.now_override', true), '')::timestamp with time zone, NOW())
+$$ LANGUAGE sql STABLE;
@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS transactions_bump_user_version ON transactions;
+DROP FUNCTION IF EXISTS bump_user_version();
+DROP TABLE IF EXISTS user_versions;
@@ -0,0 +1,35 @@
+CREATE TABLE IF NOT EXISTS user_versions (
+    user_id uuid PRIMARY KEY,
+    version bigint NOT NULL,
+    updated_at timestamp with time zone NOT NULL
+);
+
+-- Every change to a user's transactions bumps their version, balance reads
+-- compare it to skip the aggregation when nothing changed
+CREATE OR REPLACE FUNCTION bump_user_version() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP IN ('UPDATE', 'DELETE') THEN
+        INSERT INTO user_versions (user_id, version, updated_at)
+        VALUES (OLD.user_id, 1, get_now())
+        ON CONFLICT (user_id) DO UPDATE
+        SET version = user_versions.version + 1, updated_at = EXCLUDED.updated_at;
+    END IF;
+    IF TG_OP IN ('INSERT', 'UPDATE') AND (TG_OP = 'INSERT' OR NEW.user_id <> OLD.user_id) THEN
+        INSERT INTO user_versions (user_id, version, updated_at)
+        VALUES (NEW.user_id, 1, get_now())
+        ON CONFLICT (user_id) DO UPDATE
+        SET version = user_versions.version + 1, updated_at = EXCLUDED.updated_at;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER transactions_bump_user_version
+AFTER INSERT OR UPDATE OR DELETE ON transactions
+FOR EACH ROW EXECUTE FUNCTION bump_user_version();
+
+INSERT INTO user_versions (user_id, version, updated_at)
+SELECT user_id, 1, NOW()
+FROM transactions
+GROUP BY user_id
+ON CONFLICT DO NOTHING;
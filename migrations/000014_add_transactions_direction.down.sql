@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_transactions_created_at;
+ALTER TABLE transactions DROP CONSTRAINT IF EXISTS direction_check;
+ALTER TABLE transactions DROP COLUMN IF EXISTS direction;
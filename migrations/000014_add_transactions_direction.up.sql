@@ -0,0 +1,14 @@
+-- Withdrawals are recorded as rows with a negative amount: debt rows as
+-- before and, for the points taken from grants, rows with nothing remaining.
+-- Withdrawals made before this migration are not recorded.
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS direction VARCHAR(10) NOT NULL DEFAULT 'deposit';
+
+UPDATE transactions SET direction = 'withdrawal' WHERE amount < 0;
+
+ALTER TABLE transactions
+    ADD CONSTRAINT direction_check CHECK (
+        (direction = 'deposit' AND amount > 0) OR
+        (direction = 'withdrawal' AND amount < 0)
+    );
+
+CREATE INDEX IF NOT EXISTS idx_transactions_created_at ON transactions(created_at);
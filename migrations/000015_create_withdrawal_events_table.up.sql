@@ -0,0 +1,8 @@
+-- Points taken by a withdrawal from each grant, and the debt row it created,
+-- so that the withdrawal can be reverted
+CREATE TABLE IF NOT EXISTS withdrawal_events (
+    withdrawal_id uuid NOT NULL REFERENCES transactions(id) ON DELETE CASCADE,
+    transaction_id uuid NOT NULL REFERENCES transactions(id) ON DELETE CASCADE,
+    amount int NOT NULL CHECK (amount > 0),
+    PRIMARY KEY (withdrawal_id, transaction_id)
+);
@@ -0,0 +1,7 @@
+-- Points withdrawn per user and day, kept only while a daily limit is configured
+CREATE TABLE IF NOT EXISTS daily_withdrawal_limits (
+    user_id uuid NOT NULL,
+    date date NOT NULL,
+    withdrawn int NOT NULL DEFAULT 0,
+    UNIQUE (user_id, date)
+);
@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS transactions_audit ON transactions;
+DROP FUNCTION IF EXISTS log_transaction_change();
+DROP TABLE IF EXISTS transaction_audit_log;
@@ -0,0 +1,37 @@
+-- Changes to transactions recorded by the database itself, so that updates
+-- made with direct SQL are audited as well. changed_at follows get_now(), so
+-- entries line up with the transactions under a test clock.
+CREATE TABLE IF NOT EXISTS transaction_audit_log (
+    id bigserial PRIMARY KEY,
+    operation text NOT NULL,
+    transaction_id uuid NOT NULL,
+    old_remaining int,
+    new_remaining int,
+    old_expires_at timestamp(0) with time zone,
+    new_expires_at timestamp(0) with time zone,
+    changed_at timestamp(0) with time zone NOT NULL DEFAULT get_now()
+);
+
+CREATE INDEX IF NOT EXISTS transaction_audit_log_transaction_id_idx ON transaction_audit_log (transaction_id);
+
+CREATE OR REPLACE FUNCTION log_transaction_change() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'INSERT' THEN
+        INSERT INTO transaction_audit_log (operation, transaction_id, new_remaining, new_expires_at)
+        VALUES (TG_OP, NEW.id, NEW.remaining_amount, NEW.expires_at);
+        RETURN NEW;
+    ELSIF TG_OP = 'UPDATE' THEN
+        INSERT INTO transaction_audit_log (operation, transaction_id, old_remaining, new_remaining, old_expires_at, new_expires_at)
+        VALUES (TG_OP, NEW.id, OLD.remaining_amount, NEW.remaining_amount, OLD.expires_at, NEW.expires_at);
+        RETURN NEW;
+    ELSE
+        INSERT INTO transaction_audit_log (operation, transaction_id, old_remaining, old_expires_at)
+        VALUES (TG_OP, OLD.id, OLD.remaining_amount, OLD.expires_at);
+        RETURN OLD;
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER transactions_audit
+AFTER INSERT OR UPDATE OR DELETE ON transactions
+FOR EACH ROW EXECUTE FUNCTION log_transaction_change();